@@ -3,10 +3,16 @@ package accounts
 import (
 	"embed"
 	"net/http"
+	"time"
 
 	database "github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/device"
+	"github.com/cloudlink-omega/accounts/pkg/email"
 	oauth "github.com/cloudlink-omega/accounts/pkg/oauth"
 	pages "github.com/cloudlink-omega/accounts/pkg/pages"
+	"github.com/cloudlink-omega/accounts/pkg/password"
+	"github.com/cloudlink-omega/accounts/pkg/proxy"
+	"github.com/cloudlink-omega/accounts/pkg/ratelimit"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	v0 "github.com/cloudlink-omega/accounts/pkg/v0"
 	v1 "github.com/cloudlink-omega/accounts/pkg/v1"
@@ -18,6 +24,15 @@ import (
 	"gorm.io/gorm"
 )
 
+// How often accounts that are due to be deleted are purged.
+const PURGE_INTERVAL = time.Hour
+
+// How often the mail outbox is checked for mail that is due to be retried. New mail is sent right away.
+const OUTBOX_INTERVAL = 30 * time.Second
+
+// How often data exports are checked for ones left unfinished by a stopped worker. New exports are built right away.
+const EXPORT_INTERVAL = time.Minute
+
 //go:embed assets/*
 var embedded_assets embed.FS
 
@@ -31,6 +46,39 @@ type Accounts struct {
 	OAuth *oauth.OAuth
 	App   *fiber.App
 	DB    *database.Database
+
+	// Queues mail and delivers it in the background. Replace its Mailer after calling New to
+	// change how mail is delivered (i.e. with an email.MemoryMailer in tests).
+	Outbox *email.Outbox
+
+	// Password requirements shared by every API version. Modify it after calling New to
+	// change the requirements, or to load a breached password list.
+	PasswordPolicy *password.Policy
+
+	// Emails users when they log in from a new device or location. Shared by every API version and OAuth.
+	LoginAlerts *device.Alerts
+
+	// Finds where sessions and logins came from. Nil unless EnableGeoIP is called.
+	GeoIP *device.GeoIP
+
+	// Reverse proxies whose X-Forwarded-For and Forwarded headers are believed. Trusts no one
+	// unless TrustProxies is called, so the address of the peer is used.
+	Proxies *proxy.Proxies
+
+	// Counts requests against the rate limits of each API version and OAuth, which are set in
+	// their RateLimits. Counters are kept in memory; replace its Store after calling New with a
+	// fiber.Storage that every instance shares (i.e. Redis) to share them, though counts across
+	// instances are approximate. Call its Exempt to let addresses or accounts skip rate limits.
+	RateLimiter *ratelimit.Limiter
+
+	// Stops the background job that purges accounts once their deletion grace period ends.
+	StopPurgeJob func()
+
+	// Stops the background worker that delivers queued mail.
+	StopOutbox func()
+
+	// Stops the background worker that builds data exports, once the one being built is stored.
+	StopExports func()
 }
 
 // New creates a new Accounts instance.
@@ -39,13 +87,15 @@ type Accounts struct {
 // Accounts service. It is meant to be mounted to a higher-level router.
 //
 // The main purpose of New is to provide a simple way to create a new Accounts instance that
-// is pre-configured with the most commonly used endpoints and settings.
+// is pre-configured with the most commonly used endpoints and settings. It panics if the
+// settings are invalid. NewFromConfig takes the same settings and more as a Config, and
+// returns an error instead.
 func New(
 
 	// Router path is the path that the Accounts server will be mounted to.
 	router_path string,
 
-	// Server URL is the full hostname or URL that the server will be deployed to.
+	// Server URL is the full URL (i.e. https://accounts.example.com) that the server will be deployed to.
 	server_url string,
 
 	// API Domain is the domain (or subdomain) that authorized cookies are permitted on.
@@ -78,42 +128,139 @@ func New(
 	// Set true to bypass email verification during development
 	bypass_email_registration bool,
 
-	// Set to "true" to defer database migration and seeding
+	// Set to "true" to defer database migration and seeding to another instance
 	defer_migrate ...bool,
 
 ) *Accounts {
+	srv, err := NewFromConfig(&Config{
+		RouterPath:              router_path,
+		ServerURL:               server_url,
+		APIDomain:               api_domain,
+		APIURL:                  api_url,
+		ServerName:              server_name,
+		PrimaryWebsite:          primary_website,
+		ServerSecret:            server_secret,
+		EnforceHTTPS:            enforce_https,
+		DB:                      db,
+		Cache:                   cache,
+		Mail:                    email_config,
+		BypassEmailRegistration: bypass_email_registration,
+		SkipMigration:           len(defer_migrate) > 0 && defer_migrate[0],
+	})
+	if err != nil {
+		panic(err)
+	}
+	return srv
+}
 
-	// Truncate ending / in router_path if it exists
-	if router_path[len(router_path)-1] == '/' {
-		router_path = router_path[:len(router_path)-1]
+// NewFromConfig creates a new Accounts instance from a Config, which is validated first. See
+// FromEnv to read it from the environment.
+func NewFromConfig(config *Config) (*Accounts, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
 
 	// Initialize database
-	accounts_db := &database.Database{DB: db, ServerSecret: server_secret, Cache: cache}
-	if len(defer_migrate) > 0 && !defer_migrate[0] {
+	accounts_db := &database.Database{DB: config.DB, ServerSecret: config.ServerSecret, Cache: config.Cache}
+	if !config.SkipMigration {
 		if err := common.MigrateAndSeed(accounts_db.DB); err != nil {
-			panic(err)
+			return nil, err
+		}
+		if err := accounts_db.Migrate(); err != nil {
+			return nil, err
 		}
 	}
 
+	// Initialize the mail outbox
+	outbox, err := email.NewOutbox(accounts_db, config.Mail)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create new instance
 	srv := &Accounts{
-		Page:  pages.New(router_path, server_url, api_url, server_name, primary_website, server_secret, accounts_db),
-		OAuth: oauth.New(router_path, server_url, enforce_https, api_domain, server_secret, accounts_db),
-		APIv1: v1.New(router_path, enforce_https, api_domain, server_url, server_secret, accounts_db, email_config, server_name, bypass_email_registration),
-		APIv0: v0.New(router_path, enforce_https, api_domain, server_url, server_secret, accounts_db, email_config, server_name, bypass_email_registration),
-		DB:    accounts_db,
+		Page:    pages.New(config.RouterPath, config.ServerURL, config.APIURL, config.ServerName, config.PrimaryWebsite, config.ServerSecret, accounts_db),
+		OAuth:   oauth.New(config.RouterPath, config.ServerURL, config.EnforceHTTPS, config.APIDomain, config.ServerSecret, accounts_db, config.Mail, outbox, config.ServerName),
+		APIv1:   v1.New(config.RouterPath, config.EnforceHTTPS, config.APIDomain, config.ServerURL, config.ServerSecret, accounts_db, config.Mail, outbox, config.ServerName, config.BypassEmailRegistration),
+		APIv0:   v0.New(config.RouterPath, config.EnforceHTTPS, config.APIDomain, config.ServerURL, config.ServerSecret, accounts_db, config.Mail, outbox, config.ServerName, config.BypassEmailRegistration),
+		DB:      accounts_db,
+		Outbox:  outbox,
+		Proxies: &proxy.Proxies{},
 	}
 
 	// Link Pages to OAuth providers
 	srv.Page.Providers = srv.OAuth.Providers
 
+	// Share a single password policy between API versions
+	srv.PasswordPolicy = password.DefaultPolicy()
+	srv.APIv1.PasswordPolicy = srv.PasswordPolicy
+	srv.APIv0.PasswordPolicy = srv.PasswordPolicy
+
+	// Share a single rate limiter between API versions and OAuth
+	srv.RateLimiter = ratelimit.New(nil)
+	srv.APIv1.RateLimiter = srv.RateLimiter
+	srv.APIv0.RateLimiter = srv.RateLimiter
+	srv.OAuth.RateLimiter = srv.RateLimiter
+
+	// Share login alerts between API versions and OAuth
+	srv.LoginAlerts = device.NewAlerts(accounts_db, outbox, config.ServerURL, config.RouterPath, config.ServerName)
+	srv.APIv1.LoginAlerts = srv.LoginAlerts
+	srv.APIv0.LoginAlerts = srv.LoginAlerts
+	srv.OAuth.LoginAlerts = srv.LoginAlerts
+
+	// Enable the OAuth providers that were configured
+	if config.Google.ID != "" {
+		srv.OAuth.Google(config.Google.ID, config.Google.Secret)
+	}
+	if config.GitHub.ID != "" {
+		srv.OAuth.GitHub(config.GitHub.ID, config.GitHub.Secret)
+	}
+	if config.Discord.ID != "" {
+		srv.OAuth.Discord(config.Discord.ID, config.Discord.Secret)
+	}
+
+	// Configure optional features before anything runs in the background
+	if err := srv.TrustProxies(config.TrustedProxies...); err != nil {
+		return nil, err
+	}
+	if err := srv.Proxies.SetHeader(config.TrustedProxyHeader); err != nil {
+		return nil, err
+	}
+	if err := srv.RateLimiter.Exempt(config.RateLimitExempt...); err != nil {
+		return nil, err
+	}
+	if config.GeoIPDatabase != "" {
+		if err := srv.EnableGeoIP(config.GeoIPDatabase); err != nil {
+			return nil, err
+		}
+	}
+	if config.BreachedPasswords != "" {
+		if srv.PasswordPolicy.Breached, err = password.OpenBreachList(config.BreachedPasswords); err != nil {
+			return nil, err
+		}
+	}
+
+	// Purge deleted accounts in the background
+	srv.StopPurgeJob = accounts_db.StartPurgeJob(PURGE_INTERVAL)
+
+	// Deliver mail in the background
+	srv.StopOutbox = func() {}
+	if config.Mail.Enabled {
+		srv.StopOutbox = outbox.Start(OUTBOX_INTERVAL)
+	}
+
+	// Build data exports in the background
+	srv.StopExports = srv.APIv1.StartExports(EXPORT_INTERVAL)
+
 	// Initialize template engine
 	engine := html.NewFileSystem(http.FS(embedded_templates), ".html")
 
 	// Initialize app
 	srv.App = fiber.New(fiber.Config{Views: engine, ErrorHandler: srv.Page.ErrorPage})
 
+	// Find the address of the client before anything uses it
+	srv.App.Use(srv.Proxies.Handler())
+
 	// Configure routes
 	srv.App.Route("/oauth", srv.OAuth.Routes)
 	srv.App.Route("/api/v1", srv.APIv1.Routes)
@@ -133,5 +280,28 @@ func New(
 	})
 
 	// Return created instance
-	return srv
+	return srv, nil
+}
+
+// EnableGeoIP opens a MaxMind-format database (.mmdb), such as GeoLite2 City or DB-IP City Lite, and uses it to show
+// the city and country of sessions and logins. Addresses are looked up locally, without any network calls.
+// Geolocation is off by default, since locations are personal data. Call it before the server starts handling requests.
+func (srv *Accounts) EnableGeoIP(path string) error {
+	geoip, err := device.OpenGeoIP(path)
+	if err != nil {
+		return err
+	}
+	srv.GeoIP = geoip
+	srv.APIv1.GeoIP = geoip
+	srv.Page.GeoIP = geoip
+	srv.LoginAlerts.GeoIP = geoip
+	return nil
+}
+
+// TrustProxies sets the reverse proxies in front of the server, as CIDR ranges ("10.0.0.0/8") or single addresses.
+// Requests from them are logged and rate limited by the client address in their X-Forwarded-For header (or
+// Forwarded, see proxy.Proxies.SetHeader), while it is ignored on requests from anyone else. Call it before the
+// server starts handling requests.
+func (srv *Accounts) TrustProxies(trusted ...string) error {
+	return srv.Proxies.Set(trusted...)
 }
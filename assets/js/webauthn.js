@@ -0,0 +1,77 @@
+/*!
+ * Passkey helpers: convert between the server's JSON options and the browser's WebAuthn API
+ */
+
+(() => {
+	'use strict';
+
+	// The server encodes binary fields as unpadded base64url
+	const decode = (value) => {
+		const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+		const padded = base64 + '='.repeat((4 - (base64.length % 4)) % 4);
+		return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer;
+	};
+
+	const encode = (buffer) => {
+		const bytes = new Uint8Array(buffer);
+		let binary = '';
+		for (let i = 0; i < bytes.length; i++) {
+			binary += String.fromCharCode(bytes[i]);
+		}
+		return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+	};
+
+	const decode_descriptors = (list) => (list || []).map((descriptor) => ({ ...descriptor, id: decode(descriptor.id) }));
+
+	window.passkeys = {
+
+		// Whether this browser can use passkeys at all
+		supported: () => window.PublicKeyCredential !== undefined && navigator.credentials !== undefined,
+
+		// Runs navigator.credentials.create() with options from /webauthn/register/begin, returning JSON for /webauthn/register/finish
+		create: async (options) => {
+			const publicKey = {
+				...options.publicKey,
+				challenge: decode(options.publicKey.challenge),
+				user: { ...options.publicKey.user, id: decode(options.publicKey.user.id) },
+				excludeCredentials: decode_descriptors(options.publicKey.excludeCredentials),
+			};
+			const credential = await navigator.credentials.create({ publicKey });
+			return {
+				id: credential.id,
+				rawId: encode(credential.rawId),
+				type: credential.type,
+				authenticatorAttachment: credential.authenticatorAttachment,
+				clientExtensionResults: credential.getClientExtensionResults(),
+				response: {
+					clientDataJSON: encode(credential.response.clientDataJSON),
+					attestationObject: encode(credential.response.attestationObject),
+					transports: credential.response.getTransports ? credential.response.getTransports() : [],
+				},
+			};
+		},
+
+		// Runs navigator.credentials.get() with options from /webauthn/login/begin or a login response, returning JSON for /webauthn/login/finish
+		get: async (options) => {
+			const publicKey = {
+				...options.publicKey,
+				challenge: decode(options.publicKey.challenge),
+				allowCredentials: decode_descriptors(options.publicKey.allowCredentials),
+			};
+			const credential = await navigator.credentials.get({ publicKey });
+			return {
+				id: credential.id,
+				rawId: encode(credential.rawId),
+				type: credential.type,
+				authenticatorAttachment: credential.authenticatorAttachment,
+				clientExtensionResults: credential.getClientExtensionResults(),
+				response: {
+					clientDataJSON: encode(credential.response.clientDataJSON),
+					authenticatorData: encode(credential.response.authenticatorData),
+					signature: encode(credential.response.signature),
+					userHandle: credential.response.userHandle ? encode(credential.response.userHandle) : null,
+				},
+			};
+		},
+	};
+})();
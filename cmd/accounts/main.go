@@ -0,0 +1,90 @@
+// Command accounts runs the Accounts service on its own, configured by environment variables or a .env file (see
+// .env.example). It is meant for development and containers. In production, Accounts is usually mounted into the
+// backend instead.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	accounts "github.com/cloudlink-omega/accounts"
+	"github.com/cloudlink-omega/accounts/pkg/standalone"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// How long requests that are still running are given to finish when the server is stopped.
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+func main() {
+	env_file := flag.String("env", ".env", "path to a .env file, skipped if it doesn't exist")
+	flag.Parse()
+
+	// Read the .env file, if there is one
+	if err := standalone.LoadEnvFile(*env_file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
+
+	config, err := accounts.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Connect to the database and build the cache
+	if config.DB, err = standalone.DatabaseFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	config.Cache = &types.DBCache{}
+
+	srv, err := accounts.NewFromConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for provider := range srv.OAuth.Providers {
+		log.Infof("Enabled OAuth provider %s", provider)
+	}
+
+	// Mount the service where its links point to
+	mount_path := config.RouterPath
+	if mount_path == "" {
+		mount_path = "/"
+	}
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Mount(mount_path, srv.App)
+
+	// Serve until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	listen_err := make(chan error, 1)
+	go func() {
+		log.Infof("Listening on %s, serving %s", config.APIURL, config.ServerURL+config.RouterPath)
+		listen_err <- app.Listen(config.APIURL)
+	}()
+	select {
+	case <-ctx.Done():
+	case err := <-listen_err:
+		log.Fatal(err)
+	}
+
+	// Let running requests finish, then stop background work
+	log.Info("Shutting down")
+	if err := app.ShutdownWithTimeout(SHUTDOWN_TIMEOUT); err != nil {
+		log.Error(err)
+	}
+	srv.StopExports()
+	srv.StopOutbox()
+	srv.StopPurgeJob()
+	if err := srv.GeoIP.Close(); err != nil {
+		log.Error(err)
+	}
+	if sql_db, err := config.DB.DB(); err == nil {
+		sql_db.Close()
+	}
+}
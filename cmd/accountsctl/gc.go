@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/cloudlink-omega/accounts/pkg/database"
+)
+
+// Counts of what was deleted, by kind (see the database.GARBAGE_* constants).
+type Collected map[string]int64
+
+// Deletes expired data, the same way the server's purge job does.
+func gc(db *database.Database, args []string) (fmt.Stringer, error) {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	if err := parse_args(flags, args, "gc", 0, 0); err != nil {
+		return nil, err
+	}
+
+	collected, err := db.CollectGarbage()
+	if err != nil {
+		return nil, err
+	}
+	return Collected(collected), nil
+}
+
+func (c Collected) String() string {
+	var lines []string
+	for _, kind := range slices.Sorted(maps.Keys(c)) {
+		lines = append(lines, fmt.Sprintf("%s: %d", strings.ReplaceAll(kind, "_", " "), c[kind]))
+	}
+	return strings.Join(lines, "\n")
+}
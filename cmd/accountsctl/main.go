@@ -0,0 +1,168 @@
+// Command accountsctl does maintenance that would otherwise need the database to be edited by hand: looking up
+// users, setting their flags, resetting their MFA, revoking their sessions, rotating the server secret and removing
+// expired data. It connects to the same database as the accounts command, configured by the same environment
+// variables or .env file (see .env.example).
+//
+// Every command runs in a single transaction. With -dry-run it is rolled back at the end, so the output shows what
+// would have changed without changing anything.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/standalone"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/goccy/go-json"
+)
+
+const USAGE = `Usage: accountsctl [-env file] [-json] [-dry-run] <command> [arguments]
+
+Commands:
+  user show <user>                      Show a user, by ID, username or email address
+  user find [-limit n] <query>          Find users whose ID, username or email address contains the query
+  user set-flag <user> <flag>...        Set flags on a user, i.e. admin or banned
+  user clear-flag <user> <flag>...      Clear flags on a user
+  user reset-mfa <user>                 Remove a user's TOTP, recovery codes and passkeys
+  sessions revoke [-session id] <user>  Log a user out everywhere, or out of one session
+  secret rotate [-new secret]           Re-encrypt user data with a new server secret, generated if not given
+  gc                                    Delete expired data and purge accounts whose deletion is due
+
+Flags:
+`
+
+// ErrUsage is returned when a command is given the wrong arguments, after its usage has been printed.
+var ErrUsage = errors.New("invalid arguments")
+
+// A command runs against the database and returns its result, which is printed as JSON or with its String method.
+type command func(db *database.Database, args []string) (fmt.Stringer, error)
+
+var commands = map[string]map[string]command{
+	"user": {
+		"show":       user_show,
+		"find":       user_find,
+		"set-flag":   user_set_flag,
+		"clear-flag": user_clear_flag,
+		"reset-mfa":  user_reset_mfa,
+	},
+	"sessions": {
+		"revoke": sessions_revoke,
+	},
+	"secret": {
+		"rotate": secret_rotate,
+	},
+	"gc": {
+		"": gc,
+	},
+}
+
+func main() {
+	env_file := flag.String("env", ".env", "path to a .env file, skipped if it doesn't exist")
+	as_json := flag.Bool("json", false, "print results as JSON")
+	dry_run := flag.Bool("dry-run", false, "roll back every change, only showing what would happen")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), USAGE)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Find the command
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	group, ok := commands[args[0]]
+	if !ok {
+		fail_usage("unknown command %q", args[0])
+	}
+	run, ok := group[""]
+	if ok {
+		args = args[1:]
+	} else {
+		if len(args) < 2 {
+			fail_usage("%s needs a subcommand", args[0])
+		}
+		if run, ok = group[args[1]]; !ok {
+			fail_usage("unknown command %q", args[0]+" "+args[1])
+		}
+		args = args[2:]
+	}
+
+	// Read the .env file, if there is one
+	if err := standalone.LoadEnvFile(*env_file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fail(err)
+	}
+
+	// Connect to the database, and run the command in a transaction
+	db, err := standalone.DatabaseFromEnv()
+	if err != nil {
+		fail(err)
+	}
+	tx := db.Begin()
+	if tx.Error != nil {
+		fail(tx.Error)
+	}
+	result, err := run(&database.Database{
+		DB:           tx,
+		ServerSecret: os.Getenv("SERVER_SECRET"),
+		Cache:        &types.DBCache{},
+	}, args)
+	if err != nil || *dry_run {
+		tx.Rollback()
+	} else if err = tx.Commit().Error; err != nil {
+		fail(err)
+	}
+	if errors.Is(err, ErrUsage) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	// Print the result
+	if *as_json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			fail(err)
+		}
+	} else {
+		fmt.Println(result)
+	}
+	if *dry_run {
+		fmt.Fprintln(os.Stderr, "Dry run, nothing was changed.")
+	}
+}
+
+// Parses the flags of a subcommand, and checks that it was given between min and max arguments. Returns ErrUsage
+// after printing the usage of the subcommand if it wasn't. A negative max allows any number of arguments.
+func parse_args(flags *flag.FlagSet, args []string, usage string, min int, max int) error {
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: accountsctl %s\n", usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	if flags.NArg() < min || (max >= 0 && flags.NArg() > max) {
+		flags.Usage()
+		return ErrUsage
+	}
+	return nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "accountsctl:", err)
+	os.Exit(1)
+}
+
+func fail_usage(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "accountsctl: "+format+"\n\n", args...)
+	flag.Usage()
+	os.Exit(2)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/cloudlink-omega/accounts/pkg/database"
+)
+
+// Size of a generated server secret, for AES-256.
+const SECRET_SIZE = 32
+
+type SecretRotated struct {
+	Users     int    `json:"users"`
+	Secret    string `json:"secret"`
+	Generated bool   `json:"generated"`
+}
+
+// Re-encrypts every user's data with a new server secret. The current secret is read from SERVER_SECRET.
+func secret_rotate(db *database.Database, args []string) (fmt.Stringer, error) {
+	flags := flag.NewFlagSet("secret rotate", flag.ContinueOnError)
+	new_secret := flags.String("new", "", "base64 encoded secret to rotate to, generated if empty")
+	if err := parse_args(flags, args, "secret rotate [-new secret]", 0, 0); err != nil {
+		return nil, err
+	}
+
+	if db.ServerSecret == "" {
+		return nil, errors.New("SERVER_SECRET must be set to the current server secret")
+	}
+	if err := database.ValidateServerSecret(db.ServerSecret); err != nil {
+		return nil, fmt.Errorf("SERVER_SECRET: %w", err)
+	}
+
+	result := &SecretRotated{Secret: *new_secret}
+	if result.Secret == "" {
+		secret := make([]byte, SECRET_SIZE)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		result.Secret = base64.StdEncoding.EncodeToString(secret)
+		result.Generated = true
+	}
+	if result.Secret == db.ServerSecret {
+		return nil, errors.New("the new server secret is the same as the current one")
+	}
+
+	var err error
+	if result.Users, err = db.RotateServerSecret(result.Secret); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *SecretRotated) String() string {
+	return fmt.Sprintf("Rotated %d user(s) and revoked every session. Set SERVER_SECRET to the new secret and restart every server:\n%s", s.Users, s.Secret)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+type SessionsRevoked struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Revoked  int64  `json:"revoked"`
+}
+
+// Logs a user out of every session, or only the one given with -session.
+func sessions_revoke(db *database.Database, args []string) (fmt.Stringer, error) {
+	flags := flag.NewFlagSet("sessions revoke", flag.ContinueOnError)
+	session_id := flags.String("session", "", "ID of the only session to revoke")
+	if err := parse_args(flags, args, "sessions revoke [-session id] <user>", 1, 1); err != nil {
+		return nil, err
+	}
+
+	user, err := find_user(db, flags.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SessionsRevoked{ID: user.ID, Username: user.Username}
+	if *session_id != "" {
+		deleted, err := db.DeleteUserSession(user.ID, *session_id)
+		if err != nil {
+			return nil, err
+		}
+		if !deleted {
+			return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, *session_id)
+		}
+		result.Revoked = 1
+	} else {
+		if result.Revoked, err = count_sessions(db, user.ID); err != nil {
+			return nil, err
+		}
+		if err := db.DeleteAllSessions(user.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Log the event
+	common.LogEvent(db.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_session_revoked",
+		Details:    fmt.Sprintf("Revoked %d session(s) by an admin", result.Revoked),
+		Successful: true,
+	})
+
+	return result, nil
+}
+
+func (s *SessionsRevoked) String() string {
+	return fmt.Sprintf("%s (%s): %d session(s) revoked", s.Username, s.ID, s.Revoked)
+}
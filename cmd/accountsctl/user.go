@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/storage/pkg/bitfield"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+)
+
+// How many users user find returns, unless -limit is given.
+const DEFAULT_FIND_LIMIT = 20
+
+var ErrUserNotFound = errors.New("user not found")
+
+type UserInfo struct {
+	ID                   string     `json:"id"`
+	Username             string     `json:"username"`
+	Email                string     `json:"email"`
+	Flags                []string   `json:"flags"`
+	Providers            []string   `json:"providers"`
+	Passkeys             int        `json:"passkeys"`
+	Sessions             int64      `json:"sessions"`
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for,omitempty"`
+}
+
+type UserList []*UserSummary
+
+type UserSummary struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Flags    []string `json:"flags"`
+}
+
+type FlagsChanged struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Before   []string `json:"before"`
+	After    []string `json:"after"`
+}
+
+type MFAReset struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	TOTP     bool   `json:"totp"`     // Whether TOTP was enabled.
+	Passkeys int64  `json:"passkeys"` // How many passkeys were removed.
+}
+
+// Shows everything about a user that can be changed with the other commands.
+func user_show(db *database.Database, args []string) (fmt.Stringer, error) {
+	flags := flag.NewFlagSet("user show", flag.ContinueOnError)
+	if err := parse_args(flags, args, "user show <user>", 1, 1); err != nil {
+		return nil, err
+	}
+
+	user, err := find_user(db, flags.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &UserInfo{
+		ID:       user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+		Flags:    flag_names(user.State),
+	}
+	if info.Providers, err = db.GetLinkedProviders(user.ID); err != nil {
+		return nil, err
+	}
+	if info.Providers == nil {
+		info.Providers = []string{}
+	}
+	passkeys, err := db.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	info.Passkeys = len(passkeys)
+	if info.Sessions, err = count_sessions(db, user.ID); err != nil {
+		return nil, err
+	}
+	deletion, err := db.GetScheduledDeletion(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if deletion != nil {
+		info.DeletionScheduledFor = &deletion.ScheduledFor
+	}
+	return info, nil
+}
+
+// Lists users whose ID, username or email address contains the query.
+func user_find(db *database.Database, args []string) (fmt.Stringer, error) {
+	flags := flag.NewFlagSet("user find", flag.ContinueOnError)
+	limit := flags.Int("limit", DEFAULT_FIND_LIMIT, "most users to list")
+	if err := parse_args(flags, args, "user find [-limit n] <query>", 1, 1); err != nil {
+		return nil, err
+	}
+
+	users, err := db.FindUsers(flags.Arg(0), *limit)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make(UserList, len(users))
+	for i, user := range users {
+		list[i] = &UserSummary{
+			ID:       user.ID,
+			Username: user.Username,
+			Email:    user.Email,
+			Flags:    flag_names(user.State),
+		}
+	}
+	return list, nil
+}
+
+func user_set_flag(db *database.Database, args []string) (fmt.Stringer, error) {
+	return change_flags(db, "set-flag", args, (*bitfield.Bitfield8).Set)
+}
+
+func user_clear_flag(db *database.Database, args []string) (fmt.Stringer, error) {
+	return change_flags(db, "clear-flag", args, (*bitfield.Bitfield8).Clear)
+}
+
+// Sets or clears the named flags on a user with change.
+func change_flags(db *database.Database, name string, args []string, change func(*bitfield.Bitfield8, uint)) (fmt.Stringer, error) {
+	flags := flag.NewFlagSet("user "+name, flag.ContinueOnError)
+	if err := parse_args(flags, args, "user "+name+" <user> <flag>...\n\nFlags: "+strings.Join(all_flag_names(), ", "), 2, -1); err != nil {
+		return nil, err
+	}
+
+	user, err := find_user(db, flags.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+
+	state := user.State
+	for _, flag_name := range flags.Args()[1:] {
+		bit, err := parse_flag(flag_name)
+		if err != nil {
+			return nil, err
+		}
+		change(&state, bit)
+	}
+	if err := db.UpdateUserState(user.ID, state); err != nil {
+		return nil, err
+	}
+
+	result := &FlagsChanged{
+		ID:       user.ID,
+		Username: user.Username,
+		Before:   flag_names(user.State),
+		After:    flag_names(state),
+	}
+
+	// Log the event
+	common.LogEvent(db.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_flags_changed",
+		Details:    "Changed by an admin from [" + strings.Join(result.Before, ", ") + "] to [" + strings.Join(result.After, ", ") + "]",
+		Successful: true,
+	})
+
+	return result, nil
+}
+
+// Removes a user's TOTP, recovery codes and passkeys, i.e. when they have lost their authenticator and can't
+// recover their account themselves. Their password (or OAuth) is then enough to log in.
+func user_reset_mfa(db *database.Database, args []string) (fmt.Stringer, error) {
+	flags := flag.NewFlagSet("user reset-mfa", flag.ContinueOnError)
+	if err := parse_args(flags, args, "user reset-mfa <user>", 1, 1); err != nil {
+		return nil, err
+	}
+
+	user, err := find_user(db, flags.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.DeleteTotp(user); err != nil {
+		return nil, err
+	}
+	passkeys, err := db.DeleteWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	state := user.State
+	state.Clear(constants.USER_IS_TOTP_ENABLED)
+	if err := db.UpdateUserState(user.ID, state); err != nil {
+		return nil, err
+	}
+
+	// Log the event
+	common.LogEvent(db.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_mfa_reset",
+		Details:    "Reset by an admin",
+		Successful: true,
+	})
+
+	return &MFAReset{
+		ID:       user.ID,
+		Username: user.Username,
+		TOTP:     user.State.Read(constants.USER_IS_TOTP_ENABLED),
+		Passkeys: passkeys,
+	}, nil
+}
+
+// Finds a user by their ID, email address or username, in that order.
+func find_user(db *database.Database, query string) (*types.User, error) {
+	user, err := db.GetUser(query)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if strings.Contains(query, "@") {
+		user, err = db.GetUserByEmail(query)
+	} else {
+		user, err = db.GetSimilarUserByUsername(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, query)
+	}
+	return user, nil
+}
+
+// Counts the user's sessions that haven't expired.
+func count_sessions(db *database.Database, user_id string) (int64, error) {
+	var count int64
+	err := db.DB.Model(&types.UserSession{}).Where("user_id = ? AND expires_at > ?", user_id, time.Now()).Count(&count).Error
+	return count, err
+}
+
+// Decodes the flags of a user's state to their names.
+func flag_names(state bitfield.Bitfield8) []string {
+	names := []string{}
+	for bit := uint(0); bit < 8; bit++ {
+		if name, ok := constants.USER_FLAG_NAMES[bit]; ok && state.Read(bit) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func all_flag_names() []string {
+	return flag_names(bitfield.Bitfield8(0xff))
+}
+
+// Returns the bit of a flag from its name, as listed in constants.USER_FLAG_NAMES.
+func parse_flag(name string) (uint, error) {
+	for bit, flag_name := range constants.USER_FLAG_NAMES {
+		if flag_name == name {
+			return bit, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown flag %q, expected one of %s", name, strings.Join(all_flag_names(), ", "))
+}
+
+func (u *UserInfo) String() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", u.ID)
+	fmt.Fprintf(w, "Username:\t%s\n", u.Username)
+	fmt.Fprintf(w, "Email:\t%s\n", u.Email)
+	fmt.Fprintf(w, "Flags:\t%s\n", or_none(u.Flags))
+	fmt.Fprintf(w, "Providers:\t%s\n", or_none(u.Providers))
+	fmt.Fprintf(w, "Passkeys:\t%d\n", u.Passkeys)
+	fmt.Fprintf(w, "Sessions:\t%d\n", u.Sessions)
+	if u.DeletionScheduledFor != nil {
+		fmt.Fprintf(w, "Deletion:\tscheduled for %s\n", u.DeletionScheduledFor.UTC().Format(time.RFC3339))
+	}
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (l UserList) String() string {
+	if len(l) == 0 {
+		return "No users found."
+	}
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL\tFLAGS")
+	for _, user := range l {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", user.ID, user.Username, user.Email, strings.Join(user.Flags, ","))
+	}
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (f *FlagsChanged) String() string {
+	return fmt.Sprintf("%s (%s): flags changed from %s to %s", f.Username, f.ID, or_none(f.Before), or_none(f.After))
+}
+
+func (m *MFAReset) String() string {
+	totp := "TOTP wasn't enabled"
+	if m.TOTP {
+		totp = "TOTP disabled"
+	}
+	return fmt.Sprintf("%s (%s): %s, %d passkey(s) removed", m.Username, m.ID, totp, m.Passkeys)
+}
+
+func or_none(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ", ")
+}
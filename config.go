@@ -0,0 +1,183 @@
+package accounts
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrServerURLMissing = errors.New("server URL is required")
+	ErrServerURLInvalid = errors.New("server URL must be an absolute http or https URL")
+	ErrSecretMissing    = errors.New("server secret is required")
+	ErrSecretInvalid    = errors.New("server secret must be a base64 encoded 16, 24 or 32 byte key, i.e. from `openssl rand 32 | base64`")
+	ErrDatabaseMissing  = errors.New("database is required")
+)
+
+// OAuthClient is the client ID and secret of an app registered with an OAuth provider.
+type OAuthClient struct {
+	ID     string
+	Secret string
+}
+
+// Config is everything needed to create an Accounts instance with NewFromConfig. Only ServerURL, ServerSecret and DB
+// are required, the rest have defaults that are filled in by Validate.
+type Config struct {
+	RouterPath     string // Path that the Accounts server will be mounted to. Defaults to the root.
+	ServerURL      string // Full URL that the server will be deployed to. OAuth redirect URLs must match it.
+	APIDomain      string // Domain (or subdomain) that authorized cookies are permitted on. Defaults to the host of ServerURL.
+	APIURL         string // Interface that the Accounts server will listen to. Defaults to the host and port of ServerURL.
+	ServerName     string // Label of the server. Format: [Country Code]-[Server Nickname]-[Designation]. Defaults to the host of ServerURL.
+	PrimaryWebsite string // URL of the primary website. Defaults to ServerURL.
+	ServerSecret   string // Encrypts and signs JWT cookies and user data. A base64 encoded AES key, see database.ValidateServerSecret.
+	EnforceHTTPS   bool   // Require HTTPS for cookies.
+
+	DB    *gorm.DB       // Database, passed into GORM.
+	Cache *types.DBCache // Cache interface. Defaults to an empty cache.
+	Mail  *structs.MailConfig
+
+	BypassEmailRegistration bool // Skip email verification during development.
+	SkipMigration           bool // Don't migrate and seed the database, i.e. when another instance already does.
+
+	// OAuth apps. Providers without a client ID are disabled.
+	Google  OAuthClient
+	GitHub  OAuthClient
+	Discord OAuthClient
+
+	TrustedProxies     []string // Reverse proxies in front of the server, see Accounts.TrustProxies.
+	TrustedProxyHeader string   // Header they put the client's address in, X-Forwarded-For (default) or Forwarded.
+	GeoIPDatabase      string   // MaxMind-format database to geolocate sessions with, see Accounts.EnableGeoIP. Off if empty.
+	RateLimitExempt    []string // Addresses and accounts that skip rate limits, see ratelimit.Limiter.Exempt.
+	BreachedPasswords  string   // Breached password hashes to reject, see password.BreachList. Off if empty.
+}
+
+// Validate checks the configuration, and fills in defaults for anything that was left empty.
+func (c *Config) Validate() error {
+	if c.ServerURL == "" {
+		return ErrServerURLMissing
+	}
+	server_url, err := url.Parse(c.ServerURL)
+	if err != nil || (server_url.Scheme != "http" && server_url.Scheme != "https") || server_url.Host == "" {
+		return ErrServerURLInvalid
+	}
+	c.ServerURL = strings.TrimSuffix(c.ServerURL, "/")
+
+	if c.ServerSecret == "" {
+		return ErrSecretMissing
+	}
+	if database.ValidateServerSecret(c.ServerSecret) != nil {
+		return ErrSecretInvalid
+	}
+	if c.DB == nil {
+		return ErrDatabaseMissing
+	}
+
+	// The router path is joined with other paths, so it never ends with a /
+	c.RouterPath = strings.TrimSuffix(c.RouterPath, "/")
+
+	if c.APIDomain == "" {
+		c.APIDomain = server_url.Hostname()
+	}
+	if c.APIURL == "" {
+		c.APIURL = server_url.Host
+	}
+	if c.ServerName == "" {
+		c.ServerName = server_url.Hostname()
+	}
+	if c.PrimaryWebsite == "" {
+		c.PrimaryWebsite = c.ServerURL
+	}
+	if c.Cache == nil {
+		c.Cache = &types.DBCache{}
+	}
+	if c.Mail == nil {
+		c.Mail = &structs.MailConfig{}
+	}
+	return nil
+}
+
+// FromEnv reads the configuration from the environment variables documented in .env.example. The database isn't
+// read, so DB has to be set before the configuration is used.
+func FromEnv() (*Config, error) {
+	config := &Config{
+		RouterPath:        os.Getenv("ROUTER_PATH"),
+		ServerURL:         os.Getenv("SERVER_URL"),
+		APIDomain:         os.Getenv("API_DOMAIN"),
+		APIURL:            os.Getenv("API_URL"),
+		ServerName:        os.Getenv("SERVER_NAME"),
+		PrimaryWebsite:    os.Getenv("PRIMARY_WEBSITE"),
+		ServerSecret:      os.Getenv("SERVER_SECRET"),
+		Google:            OAuthClient{ID: os.Getenv("GOOGLE_KEY"), Secret: os.Getenv("GOOGLE_SECRET")},
+		GitHub:            OAuthClient{ID: os.Getenv("GITHUB_KEY"), Secret: os.Getenv("GITHUB_SECRET")},
+		Discord:           OAuthClient{ID: os.Getenv("DISCORD_KEY"), Secret: os.Getenv("DISCORD_SECRET")},
+		GeoIPDatabase:     os.Getenv("GEOIP_DATABASE"),
+		BreachedPasswords: os.Getenv("BREACHED_PASSWORDS"),
+		Mail: &structs.MailConfig{
+			Server:    os.Getenv("MAIL_SERVER"),
+			Username:  os.Getenv("MAIL_USERNAME"),
+			Password:  os.Getenv("MAIL_PASSWORD"),
+			From:      os.Getenv("MAIL_FROM"),
+			Transport: os.Getenv("MAIL_TRANSPORT"),
+			Security:  os.Getenv("MAIL_SECURITY"),
+			Directory: os.Getenv("MAIL_DIRECTORY"),
+		},
+		TrustedProxies:     env_list("TRUSTED_PROXIES"),
+		TrustedProxyHeader: os.Getenv("TRUSTED_PROXY_HEADER"),
+		RateLimitExempt:    env_list("RATE_LIMIT_EXEMPT"),
+	}
+
+	var err error
+	if config.EnforceHTTPS, err = env_bool("ENFORCE_HTTPS"); err != nil {
+		return nil, err
+	}
+	if config.BypassEmailRegistration, err = env_bool("BYPASS_EMAIL_REGISTRATION"); err != nil {
+		return nil, err
+	}
+	if config.SkipMigration, err = env_bool("SKIP_MIGRATION"); err != nil {
+		return nil, err
+	}
+	if config.Mail.Enabled, err = env_bool("MAIL_ENABLED"); err != nil {
+		return nil, err
+	}
+	if config.Mail.SkipVerify, err = env_bool("MAIL_SKIP_VERIFY"); err != nil {
+		return nil, err
+	}
+	if port := os.Getenv("MAIL_PORT"); port != "" {
+		if config.Mail.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("MAIL_PORT: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// Reads a boolean environment variable. Unset means false.
+func env_bool(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", name, err)
+	}
+	return b, nil
+}
+
+// Reads a comma-separated environment variable.
+func env_list(name string) []string {
+	var list []string
+	for _, entry := range strings.Split(os.Getenv(name), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
@@ -12,6 +12,9 @@ import (
 
 type Context fiber.Ctx
 
+// How long after logging in or re-authenticating the user can make sensitive changes to their account.
+const REAUTH_WINDOW = 10 * time.Minute
+
 type Auth struct {
 	ServerURL  string
 	SessionKey string
@@ -39,35 +42,99 @@ func (s *Auth) GetRecoveryClaims(c *fiber.Ctx) *structs.Claims {
 	if cookie == "" {
 		return nil
 	}
-	return s.GetClaimsFromToken(cookie)
+	claims := &structs.Claims{}
+	if err := s.parse(cookie, claims, structs.AUDIENCE_RECOVERY); err != nil {
+		return nil
+	}
+	return claims
 }
 
+// GetClaimsFromToken returns the claims of a session token, or nil if the token isn't valid or its session has since
+// been logged out or revoked. Every API version, whether the token comes from a cookie or a request body, reads
+// tokens through here so that revoked sessions can't be used.
 func (s *Auth) GetClaimsFromToken(token string) *structs.Claims {
 	claims := &structs.Claims{}
-	tkn, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (any, error) {
-		return []byte(s.SessionKey), nil
-	})
-	if err != nil {
-		panic(err)
-	}
-	if !tkn.Valid {
-		panic(fiber.ErrUnauthorized)
+	if err := s.parse(token, claims, structs.AUDIENCE_SESSION); err != nil || !s.session_active(claims) {
+		return nil
 	}
 	return claims
 }
 
 func (s *Auth) GetState(state_data string) (*structs.State, error) {
 	state := &structs.State{}
-	tkn, err := jwt.ParseWithClaims(state_data, state, func(token *jwt.Token) (any, error) {
+	return state, s.parse(state_data, state, structs.AUDIENCE_STATE)
+}
+
+func (s *Auth) GetOnboarding(c *fiber.Ctx) (*structs.Onboarding, error) {
+	cookie := c.Cookies("clomega-onboarding")
+	if cookie == "" {
+		return nil, fmt.Errorf("missing onboarding cookie")
+	}
+	onboarding := &structs.Onboarding{}
+	return onboarding, s.parse(cookie, onboarding, structs.AUDIENCE_ONBOARDING)
+}
+
+func (s *Auth) GetLinkRequest(c *fiber.Ctx) (*structs.LinkRequest, error) {
+	cookie := c.Cookies("clomega-link")
+	if cookie == "" {
+		return nil, fmt.Errorf("missing link cookie")
+	}
+	link := &structs.LinkRequest{}
+	return link, s.parse(cookie, link, structs.AUDIENCE_LINK)
+}
+
+func (s *Auth) GetExportToken(token string) (*structs.ExportToken, error) {
+	export := &structs.ExportToken{}
+	return export, s.parse(token, export, structs.AUDIENCE_EXPORT)
+}
+
+func (s *Auth) GetMagicLinkToken(token string) (*structs.MagicLinkToken, error) {
+	magic := &structs.MagicLinkToken{}
+	return magic, s.parse(token, magic, structs.AUDIENCE_MAGIC_LINK)
+}
+
+func (s *Auth) GetMFAPending(c *fiber.Ctx) (*structs.MFAPending, error) {
+	cookie := c.Cookies("clomega-mfa")
+	if cookie == "" {
+		return nil, fmt.Errorf("missing mfa pending token")
+	}
+	return s.GetMFAToken(cookie)
+}
+
+// GetMFAToken reads an mfa_token returned by the login endpoint, which may come from the request body instead of the cookie.
+func (s *Auth) GetMFAToken(token string) (*structs.MFAPending, error) {
+	pending := &structs.MFAPending{}
+	return pending, s.parse(token, pending, structs.AUDIENCE_MFA)
+}
+
+func (s *Auth) GetWebAuthnCeremony(c *fiber.Ctx) (*structs.WebAuthnCeremony, error) {
+	cookie := c.Cookies("clomega-webauthn")
+	if cookie == "" {
+		return nil, fmt.Errorf("missing webauthn ceremony")
+	}
+	ceremony := &structs.WebAuthnCeremony{}
+	return ceremony, s.parse(cookie, ceremony, structs.AUDIENCE_WEBAUTHN)
+}
+
+// Reads a token signed by this server into claims, checking that it's the expected kind of token (see
+// structs.Token), and that it hasn't expired.
+func (s *Auth) parse(token string, claims structs.Token, audience string) error {
+	tkn, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (any, error) {
 		return []byte(s.SessionKey), nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS512.Alg()}), jwt.WithIssuer(s.ServerURL), jwt.WithAudience(audience))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if !tkn.Valid {
-		return nil, fmt.Errorf("invalid state jwt")
+		return fmt.Errorf("invalid %s jwt", audience)
 	}
-	return state, nil
+	return nil
+}
+
+// RecentlyAuthenticated returns true if the user logged in or re-authenticated within the REAUTH_WINDOW, as required
+// for sensitive changes to their account.
+func (s *Auth) RecentlyAuthenticated(claims *structs.Claims) bool {
+	return claims != nil && claims.AuthTime != nil && time.Since(claims.AuthTime.Time) <= REAUTH_WINDOW
 }
 
 func (s *Auth) ValidFromNormal(c *fiber.Ctx) bool {
@@ -78,46 +145,31 @@ func (s *Auth) ValidFromNormal(c *fiber.Ctx) bool {
 	return s.ValidFromToken(cookie)
 }
 
+// Sessions can be logged out or revoked before their token expires, so check that it still exists. Tokens without a
+// session (i.e. for recovery) are only limited by their expiry.
+func (s *Auth) session_active(claims *structs.Claims) bool {
+	return claims.SessionID == "" || s.DB.SessionExists(claims.SessionID)
+}
+
 func (s *Auth) ValidFromRecovery(c *fiber.Ctx) bool {
-	cookie := c.Cookies("clomega-recovery")
-	if cookie == "" {
-		return false
-	}
-	return s.ValidFromToken(cookie)
+	return s.GetRecoveryClaims(c) != nil
 }
 
 func (s *Auth) ValidFromToken(token string) bool {
-	tkn, err := jwt.Parse(token, func(token *jwt.Token) (any, error) {
-		return []byte(s.SessionKey), nil
-	})
-	return err == nil && tkn.Valid
-}
-
-func (s *Auth) Create(claims any, expiration time.Time) string {
-
-	var token *jwt.Token
-	switch c := claims.(type) {
-	case *structs.Claims:
-		c.RegisteredClaims = jwt.RegisteredClaims{
-			Issuer:    s.ServerURL,
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(expiration),
-		}
-		token = jwt.NewWithClaims(jwt.SigningMethodHS512, c)
-	case *structs.State:
-		c.RegisteredClaims = jwt.RegisteredClaims{
-			Issuer:    s.ServerURL,
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			ExpiresAt: jwt.NewNumericDate(expiration),
-		}
-		token = jwt.NewWithClaims(jwt.SigningMethodHS512, c)
-	default:
-		panic("missing implementation for claims type")
+	return s.GetClaimsFromToken(token) != nil
+}
+
+// Create signs a token, marking it with the audience of its kind.
+func (s *Auth) Create(claims structs.Token, expiration time.Time) string {
+	*claims.Registered() = jwt.RegisteredClaims{
+		Issuer:    s.ServerURL,
+		Audience:  jwt.ClaimStrings{claims.TokenAudience()},
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		NotBefore: jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(expiration),
 	}
 
-	token_string, err := token.SignedString([]byte(s.SessionKey))
+	token_string, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString([]byte(s.SessionKey))
 
 	if err != nil {
 		panic(fmt.Sprintf("failed to create token: %s", err))
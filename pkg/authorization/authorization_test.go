@@ -0,0 +1,90 @@
+package authorization
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const TEST_SERVER_URL = "https://accounts.example.com"
+
+func TestTokenAudience(t *testing.T) {
+	auth := New(TEST_SERVER_URL, "secret", nil)
+	expiration := time.Now().Add(time.Hour)
+
+	// Every kind of token, along with a reader for it. Recovery tokens don't have a session, so neither do the
+	// session tokens here; that keeps the database out of it.
+	kinds := []struct {
+		name  string
+		token structs.Token
+		read  func(token string) bool
+	}{
+		{"session", &structs.Claims{ULID: "user"}, func(token string) bool { return auth.GetClaimsFromToken(token) != nil }},
+		{"recovery", &structs.Claims{ClaimType: 1, ULID: "user"}, func(token string) bool {
+			claims := &structs.Claims{}
+			return auth.parse(token, claims, structs.AUDIENCE_RECOVERY) == nil
+		}},
+		{"state", &structs.State{}, func(token string) bool { _, err := auth.GetState(token); return err == nil }},
+		{"onboarding", &structs.Onboarding{}, func(token string) bool {
+			return auth.parse(token, &structs.Onboarding{}, structs.AUDIENCE_ONBOARDING) == nil
+		}},
+		{"link", &structs.LinkRequest{}, func(token string) bool {
+			return auth.parse(token, &structs.LinkRequest{}, structs.AUDIENCE_LINK) == nil
+		}},
+		{"mfa", &structs.MFAPending{}, func(token string) bool { _, err := auth.GetMFAToken(token); return err == nil }},
+		{"export", &structs.ExportToken{}, func(token string) bool { _, err := auth.GetExportToken(token); return err == nil }},
+		{"magic link", &structs.MagicLinkToken{}, func(token string) bool { _, err := auth.GetMagicLinkToken(token); return err == nil }},
+		{"webauthn", &structs.WebAuthnCeremony{}, func(token string) bool {
+			return auth.parse(token, &structs.WebAuthnCeremony{}, structs.AUDIENCE_WEBAUTHN) == nil
+		}},
+	}
+
+	// Each token is only accepted by the reader for its own kind
+	for _, kind := range kinds {
+		token := auth.Create(kind.token, expiration)
+		for _, reader := range kinds {
+			if accepted := reader.read(token); accepted != (kind.name == reader.name) {
+				t.Errorf("%s token read as %s: accepted = %v", kind.name, reader.name, accepted)
+			}
+		}
+	}
+}
+
+func TestTokenValidation(t *testing.T) {
+	auth := New(TEST_SERVER_URL, "secret", nil)
+	sign := func(claims jwt.Claims, method jwt.SigningMethod, key any) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	registered := func(issuer string, audience string, expiration time.Time) jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{audience},
+			ExpiresAt: jwt.NewNumericDate(expiration),
+		}
+	}
+	later := time.Now().Add(time.Hour)
+
+	cases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", sign(&structs.ExportToken{RegisteredClaims: registered(TEST_SERVER_URL, structs.AUDIENCE_EXPORT, later)}, jwt.SigningMethodHS512, []byte("secret")), true},
+		{"no audience", sign(&structs.ExportToken{RegisteredClaims: registered(TEST_SERVER_URL, "", later)}, jwt.SigningMethodHS512, []byte("secret")), false},
+		{"other issuer", sign(&structs.ExportToken{RegisteredClaims: registered("https://other.example.com", structs.AUDIENCE_EXPORT, later)}, jwt.SigningMethodHS512, []byte("secret")), false},
+		{"expired", sign(&structs.ExportToken{RegisteredClaims: registered(TEST_SERVER_URL, structs.AUDIENCE_EXPORT, time.Now().Add(-time.Minute))}, jwt.SigningMethodHS512, []byte("secret")), false},
+		{"other key", sign(&structs.ExportToken{RegisteredClaims: registered(TEST_SERVER_URL, structs.AUDIENCE_EXPORT, later)}, jwt.SigningMethodHS512, []byte("other")), false},
+		{"other method", sign(&structs.ExportToken{RegisteredClaims: registered(TEST_SERVER_URL, structs.AUDIENCE_EXPORT, later)}, jwt.SigningMethodHS256, []byte("secret")), false},
+	}
+	for _, test := range cases {
+		if _, err := auth.GetExportToken(test.token); (err == nil) != test.valid {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+	}
+}
@@ -17,6 +17,18 @@ const (
 	USER_IS_ADMIN            uint = 7 // If the last bit is set, the user is a server admin.
 )
 
+// Names of the user flags, used when the state is shown to users (i.e. in data exports).
+var USER_FLAG_NAMES = map[uint]string{
+	USER_IS_EMAIL_REGISTERED: "email_registered",
+	USER_IS_ACTIVE:           "active",
+	USER_IS_BLOCKED:          "blocked",
+	USER_IS_BANNED:           "banned",
+	USER_IS_EMAIL_DISABLED:   "email_disabled",
+	USER_IS_OAUTH_ONLY:       "oauth_only",
+	USER_IS_TOTP_ENABLED:     "totp_enabled",
+	USER_IS_ADMIN:            "admin",
+}
+
 // Session flags
 const (
 	SESSION_IS_ACTIVE uint = 0 // If the first bit is set, the session is active (set false to revoke the session).
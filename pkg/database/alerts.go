@@ -0,0 +1,67 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// CreateLoginAlert stores an alert for a new session. Only the hash of the token is kept.
+func (d *Database) CreateLoginAlert(user_id string, session_id string, token string, expires time.Time) error {
+	return d.DB.Create(&LoginAlert{
+		ID:        ulid.Make().String(),
+		UserID:    user_id,
+		SessionID: session_id,
+		Token:     hash_token(token),
+		ExpiresAt: expires,
+	}).Error
+}
+
+// UseLoginAlert consumes the alert for a token, so it can only be acted on once. Returns nil if the token is
+// unknown, has expired or was already used.
+func (d *Database) UseLoginAlert(token string) (*LoginAlert, error) {
+	var alert *LoginAlert
+	err := d.DB.Where("token = ? AND used_at IS NULL AND expires_at > ?", hash_token(token), time.Now()).First(&alert).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := d.DB.Model(&LoginAlert{}).
+		Where("id = ? AND used_at IS NULL", alert.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, nil
+	}
+	return alert, nil
+}
+
+// GetLoginAlerts returns the alerts sent to the user, oldest first, until they are removed once expired.
+func (d *Database) GetLoginAlerts(user_id string) ([]*LoginAlert, error) {
+	var alerts []*LoginAlert
+	err := d.DB.Where("user_id = ?", user_id).Order("created_at").Find(&alerts).Error
+	return alerts, err
+}
+
+// DeleteExpiredLoginAlerts removes alerts that can no longer be acted on.
+func (d *Database) DeleteExpiredLoginAlerts() error {
+	return d.DB.Where("expires_at < ?", time.Now()).Delete(&LoginAlert{}).Error
+}
+
+// GetUserEventsSince returns the user's events with the given ID that were logged after since, newest first.
+func (d *Database) GetUserEventsSince(user_id string, event_id string, since time.Time) ([]*types.UserEvent, error) {
+	var events []*types.UserEvent
+	err := d.DB.
+		Where("user_id = ? AND event_id = ? AND created_at > ?", user_id, event_id, since).
+		Order("created_at DESC").
+		Find(&events).Error
+	return events, err
+}
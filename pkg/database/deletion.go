@@ -0,0 +1,160 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/storage/pkg/bitfield"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ScheduleDeletion marks the user's account to be purged at the given time, replacing any existing schedule.
+func (d *Database) ScheduleDeletion(user_id string, when time.Time) error {
+	return d.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(&AccountDeletion{
+		UserID:       user_id,
+		ScheduledFor: when,
+	}).Error
+}
+
+// GetScheduledDeletion returns the user's pending deletion, or nil if there isn't one.
+func (d *Database) GetScheduledDeletion(user_id string) (*AccountDeletion, error) {
+	var deletion *AccountDeletion
+	err := d.DB.First(&deletion, "user_id = ?", user_id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deletion, nil
+}
+
+// CancelDeletion removes the user's pending deletion. Returns true if one was cancelled.
+func (d *Database) CancelDeletion(user_id string) (bool, error) {
+	result := d.DB.Where("user_id = ?", user_id).Delete(&AccountDeletion{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// PurgeDeletedAccounts purges every account whose deletion is due, and returns how many were purged.
+func (d *Database) PurgeDeletedAccounts() (int, error) {
+	var due []*AccountDeletion
+	if err := d.DB.Where("scheduled_for <= ?", time.Now()).Find(&due).Error; err != nil {
+		return 0, err
+	}
+
+	var purged int
+	for _, deletion := range due {
+		if err := d.PurgeUser(deletion.UserID); err != nil {
+			return purged, fmt.Errorf("failed to purge user %s: %w", deletion.UserID, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// PurgeUser removes all personal data belonging to a user, including their sessions, MFA secrets, verification
+// codes, provider links and event logs. The user record itself is kept so that references to it (i.e. from
+// other services) remain valid, but it is anonymized and blocked so it can never be logged into again.
+func (d *Database) PurgeUser(user_id string) error {
+
+	// The anonymized username and email are derived from the ID so they remain unique
+	suffix := strings.ToLower(user_id[max(len(user_id)-12, 0):])
+	username := "deleted_" + suffix
+	email := suffix + "@deleted.invalid"
+	var state bitfield.Bitfield8
+	state.Set(constants.USER_IS_BLOCKED)
+
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{
+			&types.UserSession{},
+			&types.UserTOTP{},
+			&types.RecoveryCode{},
+			&types.Verification{},
+			&types.UserGoogle{},
+			&types.UserDiscord{},
+			&types.UserGitHub{},
+			&types.UserEvent{},
+			&UsernameKey{},
+			&EmailKey{},
+			&UsernameHistory{},
+			&EmailChange{},
+			&DataExport{},
+			&AccountDeletion{},
+			&MagicLink{},
+			&WebAuthnCredential{},
+			&PendingTOTP{},
+			&TOTPCounter{},
+			&VerificationAttempts{},
+			&LoginAlert{},
+		} {
+			if err := tx.Where("user_id = ?", user_id).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+
+		// Mail to the user holds their address and personal details
+		if err := tx.Where("recipient = (?)", tx.Model(&types.User{}).Select("email").Where("id = ?", user_id)).Delete(&OutboxMail{}).Error; err != nil {
+			return err
+		}
+
+		// Anonymize the user
+		return tx.Model(&types.User{}).Where("id = ?", user_id).Updates(map[string]any{
+			"username": username,
+			"email":    email,
+			"password": "",
+			"secret":   "",
+			"state":    uint8(state),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// Scrub the cached copy of the user, since it still holds their personal data
+	if cached_user, ok := d.Cache.Get("user", user_id); ok {
+		user := cached_user.(*types.User)
+		user.Username, user.Email, user.Password, user.Secret, user.State = username, email, "", "", state
+	}
+
+	// Log the event
+	common.LogEvent(d.DB, &types.SystemEvent{
+		EventID:    "user_purged",
+		Details:    "",
+		Successful: true,
+	})
+
+	return nil
+}
+
+// StartPurgeJob collects garbage every interval (see CollectGarbage), until the returned function is called.
+func (d *Database) StartPurgeJob(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				collected, err := d.CollectGarbage()
+				if err != nil {
+					log.Error("Failed to collect garbage: ", err)
+				}
+				if purged := collected[GARBAGE_DELETED_ACCOUNTS]; purged > 0 {
+					log.Info("Purged ", purged, " deleted account(s)")
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
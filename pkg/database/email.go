@@ -0,0 +1,134 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// CreateEmailChange stores a new email change request, replacing any unconfirmed request for the same user.
+func (d *Database) CreateEmailChange(change *EmailChange) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND confirmed_at IS NULL", change.UserID).Delete(&EmailChange{}).Error; err != nil {
+			return err
+		}
+		change.ID = ulid.Make().String()
+		return tx.Create(change).Error
+	})
+}
+
+// GetPendingEmailChange returns the user's unconfirmed, unexpired email change request, or nil if there isn't one.
+func (d *Database) GetPendingEmailChange(user_id string) (*EmailChange, error) {
+	var change *EmailChange
+	err := d.DB.
+		Where("user_id = ? AND confirmed_at IS NULL AND expires_at > ?", user_id, time.Now()).
+		Order("created_at DESC").
+		First(&change).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// GetEmailChanges returns every email change the user has requested, oldest first.
+func (d *Database) GetEmailChanges(user_id string) ([]*EmailChange, error) {
+	var changes []*EmailChange
+	err := d.DB.Where("user_id = ?", user_id).Order("created_at").Find(&changes).Error
+	return changes, err
+}
+
+// ErrEmailChangeUsed is returned when an email change was confirmed or reverted by another request first.
+var ErrEmailChangeUsed = errors.New("email change has already been used")
+
+// ConfirmEmailChange changes the user's email address to the new one, marks the change as confirmed and stores the
+// hash of the revert token, which stays valid for the given duration. Nothing is changed unless all of it succeeds,
+// so the change can still be used if it fails. Returns ErrEmailInUse if another user has the new address.
+func (d *Database) ConfirmEmailChange(change *EmailChange, revert_token string, revert_window time.Duration) error {
+	now := time.Now()
+	revert_expires := now.Add(revert_window)
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&EmailChange{}).Where("id = ? AND confirmed_at IS NULL", change.ID).Updates(map[string]any{
+			"confirmed_at":      now,
+			"revert_expires_at": revert_expires,
+			"revert_token":      hash_token(revert_token),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrEmailChangeUsed
+		}
+		return update_user_email(tx, change.UserID, change.NewEmail)
+	})
+	if errors.Is(err, ErrEmailChangeUsed) {
+		return err
+	} else if err != nil {
+		return d.email_key_error(change.NewEmail, err)
+	}
+
+	d.email_updated(change.UserID, change.NewEmail)
+	change.ConfirmedAt = &now
+	change.RevertExpiresAt = &revert_expires
+	change.RevertToken = hash_token(revert_token)
+	return nil
+}
+
+// GetRevertableEmailChange finds a confirmed change using the revert token sent to the old address. Returns nil if
+// the token is unknown, has expired or was already used.
+func (d *Database) GetRevertableEmailChange(revert_token string) (*EmailChange, error) {
+	var change *EmailChange
+	err := d.DB.
+		Where("revert_token = ? AND reverted_at IS NULL AND revert_expires_at > ?", hash_token(revert_token), time.Now()).
+		First(&change).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// RevertEmailChange restores the user's old email address, prevents the revert token from being used again, and
+// cancels any other pending changes. Nothing is changed unless all of it succeeds. Returns ErrEmailInUse if another
+// user has the old address.
+func (d *Database) RevertEmailChange(change *EmailChange) error {
+	now := time.Now()
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&EmailChange{}).Where("id = ? AND reverted_at IS NULL", change.ID).Update("reverted_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrEmailChangeUsed
+		}
+		if err := tx.Where("user_id = ? AND confirmed_at IS NULL", change.UserID).Delete(&EmailChange{}).Error; err != nil {
+			return err
+		}
+		return update_user_email(tx, change.UserID, change.OldEmail)
+	})
+	if errors.Is(err, ErrEmailChangeUsed) {
+		return err
+	} else if err != nil {
+		return d.email_key_error(change.OldEmail, err)
+	}
+
+	d.email_updated(change.UserID, change.OldEmail)
+	change.RevertedAt = &now
+	return nil
+}
+
+// Tokens are only stored as hashes, so a database leak can't be used to revert changes.
+func hash_token(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -18,6 +18,17 @@ const (
 	argon2KeySize     = 32
 )
 
+// ValidateServerSecret checks that a server secret is a base64 encoded AES-128, AES-192 or AES-256 key, since
+// encrypting user secrets with anything else panics.
+func ValidateServerSecret(server_secret string) error {
+	key, err := base64.StdEncoding.DecodeString(server_secret)
+	if err != nil {
+		return err
+	}
+	_, err = aes.NewCipher(key)
+	return err
+}
+
 // deriveKey generates a 256-bit key using the Argon2ID key derivation function.
 // It combines the user's secret and the server's secret to produce a secure key.
 //
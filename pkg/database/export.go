@@ -0,0 +1,108 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// CreateExport stores a new, pending data export for the user. The locale is used for the email sent once it's ready.
+func (d *Database) CreateExport(user_id string, format string, locale string, expires time.Time) (*DataExport, error) {
+	export := &DataExport{
+		ID:        ulid.Make().String(),
+		UserID:    user_id,
+		Format:    format,
+		Locale:    locale,
+		Status:    EXPORT_PENDING,
+		ExpiresAt: expires,
+	}
+	return export, d.DB.Create(export).Error
+}
+
+// GetExport returns a data export by ID, without the archive itself, or nil if it doesn't exist or has expired.
+// Use GetExportData to load the archive.
+func (d *Database) GetExport(id string) (*DataExport, error) {
+	var export *DataExport
+	err := d.DB.Omit("data").Where("id = ? AND expires_at > ?", id, time.Now()).First(&export).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// GetExportData returns the archive of a finished data export, or nil if it doesn't exist or has expired.
+func (d *Database) GetExportData(id string) ([]byte, error) {
+	var export *DataExport
+	err := d.DB.Select("data").Where("id = ? AND status = ? AND expires_at > ?", id, EXPORT_READY, time.Now()).First(&export).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return export.Data, nil
+}
+
+// GetLatestExport returns the user's most recent unexpired data export, without the archive itself.
+func (d *Database) GetLatestExport(user_id string) (*DataExport, error) {
+	var export *DataExport
+	err := d.DB.Omit("data").
+		Where("user_id = ? AND expires_at > ?", user_id, time.Now()).
+		Order("created_at DESC").
+		First(&export).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// GetDueExports returns up to limit pending data exports that no worker is building, oldest first.
+func (d *Database) GetDueExports(limit int) ([]*DataExport, error) {
+	var exports []*DataExport
+	err := d.DB.Omit("data").
+		Where("status = ? AND leased_until <= ? AND expires_at > ?", EXPORT_PENDING, time.Now(), time.Now()).
+		Order("created_at ASC").
+		Limit(limit).
+		Find(&exports).Error
+	return exports, err
+}
+
+// ClaimExport reserves a pending data export for building until the lease runs out, so other workers skip it.
+// Returns false if another worker claimed it first. If the worker dies mid-build, it is retried once the lease runs out.
+func (d *Database) ClaimExport(export *DataExport, lease time.Duration) (bool, error) {
+	result := d.DB.Model(&DataExport{}).
+		Where("id = ? AND status = ? AND leased_until = ?", export.ID, EXPORT_PENDING, export.LeasedUntil).
+		Update("leased_until", time.Now().Add(lease))
+	return result.RowsAffected == 1, result.Error
+}
+
+// FinishExport stores the built archive, or the reason it couldn't be built, and returns the stored export
+// without the archive itself.
+func (d *Database) FinishExport(id string, data []byte, export_err error) (*DataExport, error) {
+	updates := map[string]any{"status": EXPORT_READY, "data": data}
+	if export_err != nil {
+		updates = map[string]any{"status": EXPORT_FAILED, "error": export_err.Error()}
+	}
+	if err := d.DB.Model(&DataExport{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+
+	var export *DataExport
+	if err := d.DB.Omit("data").Where("id = ?", id).First(&export).Error; err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// DeleteExpiredExports removes data exports that can no longer be downloaded.
+func (d *Database) DeleteExpiredExports() error {
+	return d.DB.Where("expires_at < ?", time.Now()).Delete(&DataExport{}).Error
+}
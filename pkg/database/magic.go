@@ -0,0 +1,87 @@
+package database
+
+import (
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// Wrong codes that can be entered for a magic link before it is discarded.
+const MAGIC_LINK_MAX_ATTEMPTS = 5
+
+// CreateMagicLink stores a new magic link for the user, replacing any they had before.
+func (d *Database) CreateMagicLink(user_id string, code string, expires time.Time) (*MagicLink, error) {
+	link := &MagicLink{
+		ID:        ulid.Make().String(),
+		UserID:    user_id,
+		Code:      code,
+		ExpiresAt: expires,
+	}
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user_id).Delete(&MagicLink{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(link).Error
+	})
+	return link, err
+}
+
+// GetMagicLink returns a usable magic link by ID, as given by its signed token, or nil if it doesn't exist,
+// has expired or was already used.
+func (d *Database) GetMagicLink(id string, user_id string) (*MagicLink, error) {
+	var link *MagicLink
+	err := d.DB.Where("id = ? AND user_id = ? AND used_at IS NULL AND expires_at > ?", id, user_id, time.Now()).First(&link).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// CheckMagicLinkCode returns the user's usable magic link if the code matches it, or nil otherwise.
+// Wrong codes count towards MAGIC_LINK_MAX_ATTEMPTS, after which the link is discarded.
+func (d *Database) CheckMagicLinkCode(user_id string, code string) (*MagicLink, error) {
+	var link *MagicLink
+	err := d.DB.Where("user_id = ? AND used_at IS NULL AND expires_at > ?", user_id, time.Now()).First(&link).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(link.Code), []byte(code)) != 1 {
+		if link.Attempts+1 >= MAGIC_LINK_MAX_ATTEMPTS {
+			return nil, d.DB.Delete(link).Error
+		}
+		return nil, d.DB.Model(link).Update("attempts", gorm.Expr("attempts + 1")).Error
+	}
+
+	return link, nil
+}
+
+// GetMagicLinks returns the user's magic links, used or not, until they are removed once expired. Only the latest
+// link sent is kept.
+func (d *Database) GetMagicLinks(user_id string) ([]*MagicLink, error) {
+	var links []*MagicLink
+	err := d.DB.Where("user_id = ?", user_id).Order("created_at").Find(&links).Error
+	return links, err
+}
+
+// UseMagicLink consumes a magic link. Returns false if it has expired or was already used.
+func (d *Database) UseMagicLink(link *MagicLink) (bool, error) {
+	result := d.DB.Model(&MagicLink{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", link.ID, time.Now()).
+		Update("used_at", time.Now())
+	return result.RowsAffected == 1, result.Error
+}
+
+// DeleteMagicLinks discards any magic links the user has not used yet.
+func (d *Database) DeleteMagicLinks(user_id string) error {
+	return d.DB.Where("user_id = ?", user_id).Delete(&MagicLink{}).Error
+}
@@ -0,0 +1,202 @@
+package database
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+)
+
+// Kinds of data removed by CollectGarbage, as keys of its result.
+const (
+	GARBAGE_SESSIONS         = "sessions"
+	GARBAGE_VERIFICATIONS    = "verifications"
+	GARBAGE_MAGIC_LINKS      = "magic_links"
+	GARBAGE_PENDING_TOTP     = "pending_totp"
+	GARBAGE_LOGIN_ALERTS     = "login_alerts"
+	GARBAGE_EXPORTS          = "exports"
+	GARBAGE_MAIL             = "mail"
+	GARBAGE_DELETED_ACCOUNTS = "deleted_accounts"
+)
+
+// FindUsers returns up to limit users whose ID, username or email address contains the query, ignoring case.
+func (d *Database) FindUsers(query string, limit int) ([]*types.User, error) {
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(query)) + "%"
+	var users []*types.User
+	err := d.DB.Where(`LOWER(id) LIKE ? ESCAPE '\' OR LOWER(username) LIKE ? ESCAPE '\' OR LOWER(email) LIKE ? ESCAPE '\'`, pattern, pattern, pattern).
+		Order("username").
+		Limit(limit).
+		Find(&users).Error
+	return users, err
+}
+
+// CollectGarbage deletes sessions, verification codes, magic links, TOTP enrollments, login alerts and data exports
+// that have expired, mail that has outlived its retention, and purges accounts whose deletion is due. Returns how
+// many were removed of each kind.
+func (d *Database) CollectGarbage() (map[string]int64, error) {
+	now := time.Now()
+	collected := make(map[string]int64)
+
+	for _, garbage := range []struct {
+		kind  string
+		model any
+		query string
+		args  []any
+	}{
+		{GARBAGE_SESSIONS, &types.UserSession{}, "expires_at < ?", []any{now}},
+		{GARBAGE_VERIFICATIONS, &types.Verification{}, "expires_at < ?", []any{now}},
+		{GARBAGE_MAGIC_LINKS, &MagicLink{}, "expires_at < ?", []any{now}},
+		{GARBAGE_PENDING_TOTP, &PendingTOTP{}, "expires_at < ?", []any{now}},
+		{GARBAGE_LOGIN_ALERTS, &LoginAlert{}, "expires_at < ?", []any{now}},
+		{GARBAGE_EXPORTS, &DataExport{}, "expires_at < ?", []any{now}},
+		{GARBAGE_MAIL, &OutboxMail{}, "(status = ? AND sent_at < ?) OR (status = ? AND created_at < ?)",
+			[]any{OUTBOX_SENT, now.Add(-SENT_MAIL_RETENTION), OUTBOX_DEAD, now.Add(-DEAD_MAIL_RETENTION)}},
+	} {
+		result := d.DB.Where(garbage.query, garbage.args...).Delete(garbage.model)
+		if result.Error != nil {
+			return collected, fmt.Errorf("failed to delete %s: %w", strings.ReplaceAll(garbage.kind, "_", " "), result.Error)
+		}
+		collected[garbage.kind] = result.RowsAffected
+	}
+
+	purged, err := d.PurgeDeletedAccounts()
+	collected[GARBAGE_DELETED_ACCOUNTS] = int64(purged)
+	return collected, err
+}
+
+// RotateServerSecret re-encrypts every user's secret with a new server secret, along with their TOTP secrets and
+// recovery codes, since the keys derived for them are salted with the server secret. Sessions are deleted instead,
+// as their cookies were signed with the old secret and can't be verified anymore. Everything happens in a single
+// transaction, so a failure (i.e. when the current server secret is wrong) leaves the database as it was.
+//
+// The caller is responsible for restarting every server with the new secret. Returns how many users were rotated.
+func (d *Database) RotateServerSecret(new_secret string) (int, error) {
+	if err := ValidateServerSecret(new_secret); err != nil {
+		return 0, fmt.Errorf("invalid new server secret: %w", err)
+	}
+
+	secrets := map[string]string{}
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		current := &Database{DB: tx, ServerSecret: d.ServerSecret, Cache: d.Cache}
+		next := &Database{DB: tx, ServerSecret: new_secret, Cache: d.Cache}
+
+		var users []*types.User
+		if err := tx.Where("secret <> ''").Find(&users).Error; err != nil {
+			return err
+		}
+		for _, user := range users {
+			secret, err := current.rotate_user(next, user)
+			if err != nil {
+				return fmt.Errorf("failed to rotate user %s: %w", user.ID, err)
+			}
+			secrets[user.ID] = secret
+		}
+
+		return tx.Where("1 = 1").Delete(&types.UserSession{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Refresh the cached copies of the users, now that the new secrets have been committed
+	for id, secret := range secrets {
+		if cached_user, ok := d.Cache.Get("user", id); ok {
+			cached_user.(*types.User).Secret = secret
+		}
+	}
+
+	// Log the event
+	common.LogEvent(d.DB, &types.SystemEvent{
+		EventID:    "server_secret_rotated",
+		Details:    fmt.Sprintf("Rotated %d user(s)", len(secrets)),
+		Successful: true,
+	})
+
+	return len(secrets), nil
+}
+
+// Decrypts everything belonging to the user with the current server secret, and encrypts it again with the next.
+// Decryption panics when the data wasn't encrypted with the current secret, so panics are returned as errors.
+// Returns the user's re-encrypted secret.
+func (d *Database) rotate_user(next *Database, user *types.User) (secret string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	current_key, err := base64.StdEncoding.DecodeString(d.ServerSecret)
+	if err != nil {
+		return "", err
+	}
+	next_key, err := base64.StdEncoding.DecodeString(next.ServerSecret)
+	if err != nil {
+		return "", err
+	}
+
+	// Read everything that is encrypted with the user's secret
+	var totp *types.UserTOTP
+	if err := d.DB.Where("user_id = ?", user.ID).Limit(1).Find(&totp).Error; err != nil {
+		return "", err
+	}
+	var pending *PendingTOTP
+	if err := d.DB.Where("user_id = ?", user.ID).Limit(1).Find(&pending).Error; err != nil {
+		return "", err
+	}
+	codes, err := d.GetRecoveryCodes(user)
+	if err != nil {
+		return "", err
+	}
+	has_totp := totp != nil && totp.UserID != ""
+	has_pending := pending != nil && pending.UserID != ""
+
+	// Anything that can't be decrypted would be left encrypted with the old key, so the whole rotation fails instead
+	var totp_secret, pending_secret string
+	if has_totp {
+		if totp_secret, err = d.Decrypt(user, totp.Secret); err != nil {
+			return "", fmt.Errorf("decrypt TOTP secret: %w", err)
+		}
+	}
+	if has_pending {
+		if pending_secret, err = d.Decrypt(user, pending.Secret); err != nil {
+			return "", fmt.Errorf("decrypt pending TOTP secret: %w", err)
+		}
+	}
+
+	// Re-encrypt the user's secret
+	rotated_user := *user
+	rotated_user.Secret = MustEncrypt(MustDecrypt(user.Secret, current_key), next_key)
+	if err := d.DB.Model(&types.User{}).Where("id = ?", user.ID).Update("secret", rotated_user.Secret).Error; err != nil {
+		return "", err
+	}
+
+	// Then everything that was encrypted with it
+	if has_totp {
+		encrypted, err := next.Encrypt(&rotated_user, totp_secret)
+		if err != nil {
+			return "", fmt.Errorf("encrypt TOTP secret: %w", err)
+		}
+		if err := d.DB.Model(&types.UserTOTP{}).Where("user_id = ?", user.ID).Update("secret", encrypted).Error; err != nil {
+			return "", err
+		}
+	}
+	if has_pending {
+		encrypted, err := next.Encrypt(&rotated_user, pending_secret)
+		if err != nil {
+			return "", fmt.Errorf("encrypt pending TOTP secret: %w", err)
+		}
+		if err := d.DB.Model(&PendingTOTP{}).Where("user_id = ?", user.ID).Update("secret", encrypted).Error; err != nil {
+			return "", err
+		}
+	}
+	if len(codes) > 0 {
+		if err := next.StoreRecoveryCodes(&rotated_user, codes); err != nil {
+			return "", err
+		}
+	}
+	return rotated_user.Secret, nil
+}
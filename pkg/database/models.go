@@ -0,0 +1,268 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/identity"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+	Models
+	These tables are owned by the Accounts service, in addition to the shared tables provided by the storage package.
+	They are created by Migrate.
+*/
+
+// UsernameKey reserves the skeleton (see identity.UsernameKey) of a username so that lookalike names cannot be registered.
+type UsernameKey struct {
+	Skeleton  string     `gorm:"primaryKey;size:64"`
+	UserID    string     `gorm:"index;size:26"`
+	ExpiresAt *time.Time // If set, the name is no longer in use and is only reserved until this time.
+	CreatedAt time.Time
+}
+
+// EmailKey holds the normalized form (see identity.EmailKey) of each user's email address. The users table is owned
+// by the storage package, so the key is kept alongside it, where it can be indexed and kept unique. This stops two
+// accounts being registered at once with addresses that only differ in case.
+type EmailKey struct {
+	Address   string `gorm:"primaryKey;size:254"`
+	UserID    string `gorm:"uniqueIndex;size:26"`
+	CreatedAt time.Time
+}
+
+// UsernameHistory records each username a user has had, so that changes can be audited and rate limited.
+type UsernameHistory struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    string `gorm:"index;size:26"`
+	OldName   string
+	NewName   string
+	CreatedAt time.Time
+}
+
+// AccountDeletion schedules a user's account to be purged. Logging in before ScheduledFor cancels the deletion.
+type AccountDeletion struct {
+	UserID       string    `gorm:"primaryKey;size:26"`
+	ScheduledFor time.Time `gorm:"index"`
+	CreatedAt    time.Time
+}
+
+// DataExport holds a personal data export while it is being built, and the finished archive until it expires.
+type DataExport struct {
+	ID          string `gorm:"primaryKey;size:26"`
+	UserID      string `gorm:"index;size:26"`
+	Format      string // Either "json" or "zip".
+	Locale      string // Language of the email sent once the export is ready.
+	Status      string // One of the EXPORT_* constants.
+	Error       string
+	Data        []byte
+	LeasedUntil time.Time `gorm:"index"` // A pending export is being built by a worker until then.
+	ExpiresAt   time.Time `gorm:"index"`
+	CreatedAt   time.Time
+}
+
+// Status values for DataExport.
+const (
+	EXPORT_PENDING = "pending"
+	EXPORT_READY   = "ready"
+	EXPORT_FAILED  = "failed"
+)
+
+// EmailChange tracks a request to change the email address of an account. The new address must be confirmed
+// using a code sent to it, after which the old address can revert the change using a link until RevertExpiresAt.
+type EmailChange struct {
+	ID              string `gorm:"primaryKey;size:26"`
+	UserID          string `gorm:"index;size:26"`
+	OldEmail        string
+	OldVerified     bool // Whether the old address had been verified, restored if the change is reverted.
+	NewEmail        string
+	Code            string
+	RevertToken     string `gorm:"index;size:64"` // SHA-256 hash of the token sent to the old address.
+	ExpiresAt       time.Time
+	ConfirmedAt     *time.Time
+	RevertExpiresAt *time.Time
+	RevertedAt      *time.Time
+	CreatedAt       time.Time
+}
+
+// MagicLink is a one-time login sent by email, usable either through its signed link or by entering its code.
+// Only the user's latest link is kept, and it can only be used once.
+type MagicLink struct {
+	ID        string `gorm:"primaryKey;size:26"`
+	UserID    string `gorm:"index;size:26"`
+	Code      string
+	Attempts  int // Wrong codes entered, the link is discarded after MAGIC_LINK_MAX_ATTEMPTS.
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// OutboxMail is an email waiting to be delivered by the outbox worker, kept for a while after it's sent, without its
+// body. Mail that keeps failing is dead-lettered, and is only sent again if an admin retries it.
+type OutboxMail struct {
+	ID            string `gorm:"primaryKey;size:26"`
+	Recipient     string `gorm:"index"`
+	FromAddress   string
+	FromName      string
+	Template      string
+	Subject       string
+	Text          string `gorm:"type:text"`
+	HTML          string `gorm:"type:text"`
+	Status        string `gorm:"index;size:16"`
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time `gorm:"index"`
+	SentAt        *time.Time
+	CreatedAt     time.Time
+}
+
+// Status values for OutboxMail.
+const (
+	OUTBOX_PENDING = "pending"
+	OUTBOX_SENT    = "sent"
+	OUTBOX_DEAD    = "dead"
+)
+
+// WebAuthnCredential is a passkey or security key registered to an account. Data holds the credential record as
+// returned by the WebAuthn library (public key, flags and authenticator details) encoded as JSON, while the
+// signature counter is kept in its own column so clones can be detected without decoding it.
+type WebAuthnCredential struct {
+	ID             string `gorm:"primaryKey;size:26"`
+	UserID         string `gorm:"index;size:26"`
+	CredentialHash string `gorm:"uniqueIndex;size:64"` // Hex-encoded SHA-256 of the credential ID, which can be up to 1023 bytes long.
+	Name           string
+	Data           []byte
+	SignCount      uint32
+	LastUsedAt     *time.Time
+	CreatedAt      time.Time
+}
+
+// PendingTOTP holds a new TOTP secret while it is being enrolled. It only replaces the active secret (if any) once
+// a code from it has been verified, so starting over with a new authenticator can't lock the user out.
+type PendingTOTP struct {
+	UserID    string `gorm:"primaryKey;size:26"`
+	Secret    string // Encrypted the same way as the active secret.
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// TOTPCounter records the time step of the last TOTP code accepted for a user, so that a code can't be used again
+// while it is still within the validity window. UserTOTP is owned by the storage module, so it is kept alongside it.
+type TOTPCounter struct {
+	UserID      string `gorm:"primaryKey;size:26"`
+	LastCounter int64
+	UpdatedAt   time.Time
+}
+
+// VerificationAttempts counts the wrong verification codes entered for a user since their last code was sent, so that
+// codes can't be guessed. Verification is owned by the storage module, so the count is kept alongside it.
+type VerificationAttempts struct {
+	UserID    string `gorm:"primaryKey;size:26"`
+	Attempts  int
+	UpdatedAt time.Time
+}
+
+// LoginAlert is created when a user logs in from a device or location that doesn't match their recent logins. The
+// token is sent to the user by email, so they can revoke the session if it wasn't them.
+type LoginAlert struct {
+	ID        string `gorm:"primaryKey;size:26"`
+	UserID    string `gorm:"index;size:26"`
+	SessionID string `gorm:"size:26"`
+	Token     string `gorm:"index;size:64"` // SHA-256 hash of the token sent to the user.
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// Migrate creates or updates the tables owned by the Accounts service and backfills any missing data.
+func (d *Database) Migrate() error {
+	if err := d.DB.AutoMigrate(
+		&UsernameKey{},
+		&EmailKey{},
+		&EmailChange{},
+		&UsernameHistory{},
+		&AccountDeletion{},
+		&DataExport{},
+		&OutboxMail{},
+		&MagicLink{},
+		&WebAuthnCredential{},
+		&PendingTOTP{},
+		&TOTPCounter{},
+		&VerificationAttempts{},
+		&LoginAlert{},
+	); err != nil {
+		return err
+	}
+
+	if err := d.rekey_username_keys(); err != nil {
+		return err
+	}
+	if err := d.backfill_username_keys(); err != nil {
+		return err
+	}
+	return d.backfill_email_keys()
+}
+
+// Updates username keys made before identity.UsernameKey folded "i" into "l". The rest of the key is unchanged, so
+// the new key is the old one with each "i" replaced.
+func (d *Database) rekey_username_keys() error {
+	var keys []*UsernameKey
+	if err := d.DB.Where("skeleton LIKE ?", "%i%").Find(&keys).Error; err != nil {
+		return err
+	}
+
+	// Names that only differed by i and l now share a key, which can't be resolved automatically, so only the first
+	// one keeps the reservation
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		for _, key := range keys {
+			if err := tx.Delete(key).Error; err != nil {
+				return err
+			}
+			key.Skeleton = strings.ReplaceAll(key.Skeleton, "i", "l")
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(key).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Creates username keys for users that were registered before keys were tracked.
+func (d *Database) backfill_username_keys() error {
+	var users []*types.User
+	if err := d.DB.Where("id NOT IN (?)", d.DB.Model(&UsernameKey{}).Select("user_id")).Find(&users).Error; err != nil {
+		return err
+	}
+
+	// Existing lookalike names can't be resolved automatically, so only the first one gets the reservation
+	for _, user := range users {
+		if err := d.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&UsernameKey{
+			Skeleton: identity.UsernameKey(user.Username),
+			UserID:   user.ID,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates email keys for users that were registered before keys were tracked.
+func (d *Database) backfill_email_keys() error {
+	var users []*types.User
+	if err := d.DB.Where("id NOT IN (?)", d.DB.Model(&EmailKey{}).Select("user_id")).Find(&users).Error; err != nil {
+		return err
+	}
+
+	// Addresses that were already registered twice can't be resolved automatically, so only the first one gets the key
+	for _, user := range users {
+		if err := d.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&EmailKey{
+			Address: identity.EmailKey(user.Email),
+			UserID:  user.ID,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// How long delivered and dead-lettered mail is kept in the outbox, for troubleshooting.
+const (
+	SENT_MAIL_RETENTION = 7 * 24 * time.Hour
+	DEAD_MAIL_RETENTION = 30 * 24 * time.Hour
+)
+
+// EnqueueMail stores mail in the outbox, to be sent as soon as the worker picks it up.
+func (d *Database) EnqueueMail(mail *OutboxMail) error {
+	mail.ID = ulid.Make().String()
+	mail.Status = OUTBOX_PENDING
+	mail.NextAttemptAt = time.Now()
+	return d.DB.Create(mail).Error
+}
+
+// GetDueMail returns up to limit pending mail that is due to be sent, oldest first.
+func (d *Database) GetDueMail(limit int) ([]*OutboxMail, error) {
+	var mail []*OutboxMail
+	err := d.DB.Where("status = ? AND next_attempt_at <= ?", OUTBOX_PENDING, time.Now()).
+		Order("next_attempt_at ASC").
+		Limit(limit).
+		Find(&mail).Error
+	return mail, err
+}
+
+// ClaimMail reserves pending mail for delivery by pushing its next attempt back by the lease, so other workers
+// skip it. Returns false if another worker claimed it first. If the worker dies mid-send, the mail is retried
+// once the lease runs out.
+func (d *Database) ClaimMail(mail *OutboxMail, lease time.Duration) (bool, error) {
+	result := d.DB.Model(&OutboxMail{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", mail.ID, OUTBOX_PENDING, mail.NextAttemptAt).
+		Update("next_attempt_at", time.Now().Add(lease))
+	return result.RowsAffected == 1, result.Error
+}
+
+// MarkMailSent records that mail was delivered. Its body is discarded, since it may hold codes and links that could
+// still be used, so only the recipient, template and subject are kept for troubleshooting.
+func (d *Database) MarkMailSent(id string) error {
+	return d.DB.Model(&OutboxMail{}).Where("id = ?", id).Updates(map[string]any{
+		"status":     OUTBOX_SENT,
+		"sent_at":    time.Now(),
+		"last_error": "",
+		"text":       "",
+		"html":       "",
+	}).Error
+}
+
+// MarkMailFailed records a failed delivery attempt. The mail is retried at next_attempt,
+// or dead-lettered if next_attempt is nil.
+func (d *Database) MarkMailFailed(id string, attempts int, send_err error, next_attempt *time.Time) error {
+	updates := map[string]any{
+		"attempts":   attempts,
+		"last_error": send_err.Error(),
+	}
+	if next_attempt != nil {
+		updates["next_attempt_at"] = *next_attempt
+	} else {
+		updates["status"] = OUTBOX_DEAD
+	}
+	return d.DB.Model(&OutboxMail{}).Where("id = ?", id).Updates(updates).Error
+}
+
+// GetDeadMail returns up to limit dead-lettered mail, newest first.
+func (d *Database) GetDeadMail(limit int) ([]*OutboxMail, error) {
+	var mail []*OutboxMail
+	err := d.DB.Where("status = ?", OUTBOX_DEAD).Order("created_at DESC").Limit(limit).Find(&mail).Error
+	return mail, err
+}
+
+// RetryMail puts dead-lettered mail back in the queue, with a fresh set of attempts.
+func (d *Database) RetryMail(id string) (bool, error) {
+	result := d.DB.Model(&OutboxMail{}).Where("id = ? AND status = ?", id, OUTBOX_DEAD).Updates(map[string]any{
+		"status":          OUTBOX_PENDING,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	return result.RowsAffected == 1, result.Error
+}
+
+// DeleteOldMail removes mail that was sent before sent_before, and dead-lettered mail created before dead_before.
+func (d *Database) DeleteOldMail(sent_before time.Time, dead_before time.Time) error {
+	return d.DB.Where("(status = ? AND sent_at < ?) OR (status = ? AND created_at < ?)",
+		OUTBOX_SENT, sent_before, OUTBOX_DEAD, dead_before).
+		Delete(&OutboxMail{}).Error
+}
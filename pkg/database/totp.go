@@ -1,10 +1,31 @@
 package database
 
 import (
+	"crypto/subtle"
+	"errors"
+	"time"
+
 	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
+// TOTP parameters shared by every authenticator. Codes from one time step either side of the current one are
+// accepted to allow for clock drift.
+const (
+	TOTP_PERIOD = 30
+	TOTP_SKEW   = 1
+)
+
+var TOTP_OPTIONS = totp.ValidateOpts{
+	Digits:    otp.DigitsSix,
+	Period:    TOTP_PERIOD,
+	Skew:      TOTP_SKEW,
+	Algorithm: otp.AlgorithmSHA512,
+}
+
 func (d *Database) store_secret(id string, secret string) error {
 	totp := types.UserTOTP{
 		UserID: id,
@@ -63,3 +84,119 @@ func (d *Database) GetTotpSecret(user *types.User) string {
 
 	return string(secret)
 }
+
+// StorePendingTotpSecret encrypts and stores a secret that is being enrolled, replacing any earlier attempt.
+// The active secret is left alone until ConfirmPendingTotpSecret is called.
+func (d *Database) StorePendingTotpSecret(user *types.User, key string, expires time.Time) error {
+	secret, err := d.Encrypt(user, key)
+	if err != nil {
+		return err
+	}
+	return d.DB.Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).Create(&PendingTOTP{
+		UserID:    user.ID,
+		Secret:    secret,
+		ExpiresAt: expires,
+	}).Error
+}
+
+// GetPendingTotpSecret returns the decrypted secret being enrolled, or an empty string if there is none or it has expired.
+func (d *Database) GetPendingTotpSecret(user *types.User) (string, error) {
+	var pending PendingTOTP
+	err := d.DB.Where("user_id = ? AND expires_at > ?", user.ID, time.Now()).First(&pending).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return d.Decrypt(user, pending.Secret)
+}
+
+// ConfirmPendingTotpSecret makes the pending secret the user's active one.
+func (d *Database) ConfirmPendingTotpSecret(user *types.User) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		var pending PendingTOTP
+		if err := tx.Where("user_id = ?", user.ID).First(&pending).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.OnConflict{
+			UpdateAll: true,
+		}).Create(&types.UserTOTP{
+			UserID: user.ID,
+			Secret: pending.Secret,
+		}).Error; err != nil {
+			return err
+		}
+
+		// Codes from the old secret can't be replayed against the new one, so start counting again
+		if err := tx.Where("user_id = ?", user.ID).Delete(&TOTPCounter{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&pending).Error
+	})
+}
+
+// DeleteTotp removes the user's TOTP secrets, including any pending enrollment, and their recovery codes.
+func (d *Database) DeleteTotp(user *types.User) error {
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{
+			&types.UserTOTP{},
+			&PendingTOTP{},
+			&TOTPCounter{},
+			&types.RecoveryCode{},
+		} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// VerifyTotp checks a code against the user's active TOTP secret. Each code can only be used once: a code from a
+// time step at or before the last accepted one is rejected, even if it's still within the validity window.
+func (d *Database) VerifyTotp(user *types.User, code string) (bool, error) {
+	secret, err := d.get_secret(user.ID)
+	if err != nil {
+		return false, err
+	}
+	if secret, err = d.Decrypt(user, secret); err != nil {
+		return false, err
+	}
+
+	// Find the time step the code belongs to
+	now := time.Now().UTC()
+	current := now.Unix() / TOTP_PERIOD
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*TOTP_PERIOD, 0).UTC(), TOTP_OPTIONS)
+		if err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return d.use_totp_counter(user.ID, step)
+		}
+	}
+	return false, nil
+}
+
+// Records the time step of an accepted code. Returns false if a code from the same or a later step was already used.
+func (d *Database) use_totp_counter(user_id string, counter int64) (bool, error) {
+	result := d.DB.Model(&TOTPCounter{}).
+		Where("user_id = ? AND last_counter < ?", user_id, counter).
+		Update("last_counter", counter)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return true, nil
+	}
+
+	// Either this is the user's first code, or it was already used
+	result = d.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&TOTPCounter{
+		UserID:      user_id,
+		LastCounter: counter,
+	})
+	return result.RowsAffected == 1, result.Error
+}
@@ -1,19 +1,35 @@
 package database
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2/log"
 
 	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/identity"
 	"github.com/cloudlink-omega/storage/pkg/bitfield"
+	"github.com/cloudlink-omega/storage/pkg/common"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	"gorm.io/gorm"
 )
 
+// ErrEmailInUse is returned when a user would get an email address that another user already has.
+var ErrEmailInUse = errors.New("email address is already in use")
+
+// ErrUserBlocked is returned when a session is created for a user that is blocked or banned (see UserBlocked).
+var ErrUserBlocked = errors.New("account has been disabled")
+
+// UserBlocked returns true if the user has been blocked (i.e. their account was deleted) or banned. They can't log
+// in, and their sessions can't be used.
+func UserBlocked(user *types.User) bool {
+	return user.State.Read(constants.USER_IS_BLOCKED) || user.State.Read(constants.USER_IS_BANNED)
+}
+
 func (d *Database) GetUsers() []*types.User {
 	var users []*types.User
 	d.DB.Find(&users)
@@ -38,13 +54,52 @@ func (d *Database) UpdateUserState(id string, state bitfield.Bitfield8) error {
 	return d.DB.Model(&types.User{}).Where("id = ?", id).Update("state", uint8(state)).Error
 }
 
+// UpdateUserEmail changes the user's email address along with its key. Returns ErrEmailInUse if another user has it.
+func (d *Database) UpdateUserEmail(id string, email string) error {
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		return update_user_email(tx, id, email)
+	})
+	if err != nil {
+		return d.email_key_error(email, err)
+	}
+	d.email_updated(id, email)
+	return nil
+}
+
+// Changes the user's email address and key within a transaction.
+func update_user_email(tx *gorm.DB, id string, email string) error {
+	if err := tx.Model(&types.User{}).Where("id = ?", id).Update("email", email).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ?", id).Delete(&EmailKey{}).Error; err != nil {
+		return err
+	}
+	return tx.Create(&EmailKey{Address: identity.EmailKey(email), UserID: id}).Error
+}
+
+// Refreshes the cached copy of the user once their email address has been changed.
+func (d *Database) email_updated(id string, email string) {
+	if cached_user, ok := d.Cache.Get("user", id); ok {
+		cached_user.(*types.User).Email = email
+	}
+}
+
 func (d *Database) UpdateUserPassword(id string, password string) error {
 	return d.DB.Model(&types.User{}).Where("id = ?", id).Update("password", password).Error
 }
 
+// DoesNameExist returns true if the username, or a lookalike of it, is in use or reserved.
 func (d *Database) DoesNameExist(name string) (bool, error) {
 	var count int64
-	err := d.DB.Model(&types.User{}).Where("username = ?", name).Count(&count).Error
+	err := d.DB.Model(&UsernameKey{}).
+		Where("skeleton = ? AND (expires_at IS NULL OR expires_at > ?)", identity.UsernameKey(name), time.Now()).
+		Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	// Fall back to the users table in case a key is missing
+	err = d.DB.Model(&types.User{}).Where("LOWER(username) = LOWER(?)", name).Count(&count).Error
 	return count > 0, err
 }
 
@@ -77,8 +132,95 @@ func (d *Database) GetUserFromProvider(id string, provider string) (*types.User,
 	return user, nil
 }
 
+// CreateUser stores a new user, and reserves their username and email address. All are rolled back if any fails.
+// Returns ErrEmailInUse if another user registered the email address first.
 func (d *Database) CreateUser(user *types.User) error {
-	return d.DB.Create(user).Error
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&EmailKey{Address: identity.EmailKey(user.Email), UserID: user.ID}).Error; err != nil {
+			return err
+		}
+		return d.reserve_username(tx, user.ID, user.Username)
+	})
+	if err != nil {
+		return d.email_key_error(user.Email, err)
+	}
+	return nil
+}
+
+// Turns an error from storing an email key into ErrEmailInUse if the key was taken. Not every driver reports
+// constraint violations the same way, so the key is looked up instead of inspecting the error.
+func (d *Database) email_key_error(email string, err error) error {
+	var count int64
+	if d.DB.Model(&EmailKey{}).Where("address = ?", identity.EmailKey(email)).Count(&count).Error == nil && count > 0 {
+		return ErrEmailInUse
+	}
+	return err
+}
+
+// Stores the skeleton of a username, replacing any reservation for it that has expired or is held by the same user.
+func (d *Database) reserve_username(tx *gorm.DB, user_id string, username string) error {
+	skeleton := identity.UsernameKey(username)
+	if err := tx.Where("skeleton = ? AND (expires_at < ? OR user_id = ?)", skeleton, time.Now(), user_id).Delete(&UsernameKey{}).Error; err != nil {
+		return err
+	}
+	return tx.Create(&UsernameKey{Skeleton: skeleton, UserID: user_id}).Error
+}
+
+// ChangeUsername renames a user and records the change in their history. The old name stays reserved for the
+// user until the grace period ends, so that nobody else can take it and impersonate them.
+func (d *Database) ChangeUsername(user *types.User, username string, grace time.Duration) error {
+	old_name := user.Username
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&types.User{}).Where("id = ?", user.ID).Update("username", username).Error; err != nil {
+			return err
+		}
+
+		// Only the display form changed (i.e. capitalization), so the reservation can stay as it is
+		if identity.UsernameKey(old_name) != identity.UsernameKey(username) {
+			if err := tx.Model(&UsernameKey{}).
+				Where("skeleton = ? AND user_id = ?", identity.UsernameKey(old_name), user.ID).
+				Update("expires_at", time.Now().Add(grace)).Error; err != nil {
+				return err
+			}
+			if err := d.reserve_username(tx, user.ID, username); err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&UsernameHistory{UserID: user.ID, OldName: old_name, NewName: username}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// Refresh the cached copy of the user
+	user.Username = username
+	if cached_user, ok := d.Cache.Get("user", user.ID); ok {
+		cached_user.(*types.User).Username = username
+	}
+	return nil
+}
+
+// GetUsernameHistory returns the user's previous usernames, most recent first.
+func (d *Database) GetUsernameHistory(user_id string) ([]*UsernameHistory, error) {
+	var history []*UsernameHistory
+	if err := d.DB.Where("user_id = ?", user_id).Order("created_at DESC").Find(&history).Error; err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// IsNameReservedBy returns true if the username (or a lookalike of it) is reserved by the given user, i.e. it is
+// their current name or one they have recently changed away from.
+func (d *Database) IsNameReservedBy(user_id string, name string) (bool, error) {
+	var count int64
+	err := d.DB.Model(&UsernameKey{}).
+		Where("skeleton = ? AND user_id = ? AND (expires_at IS NULL OR expires_at > ?)", identity.UsernameKey(name), user_id, time.Now()).
+		Count(&count).Error
+	return count > 0, err
 }
 
 func (d *Database) LinkUserToProvider(user string, provider_user string, provider string) error {
@@ -94,9 +236,39 @@ func (d *Database) LinkUserToProvider(user string, provider_user string, provide
 	}
 }
 
+// GetLinkedProviders returns the names of the OAuth providers linked to the user.
+func (d *Database) GetLinkedProviders(user_id string) ([]string, error) {
+	var providers []string
+	for provider, model := range map[string]any{
+		"google":  &types.UserGoogle{},
+		"discord": &types.UserDiscord{},
+		"github":  &types.UserGitHub{},
+	} {
+		var count int64
+		if err := d.DB.Model(model).Where("user_id = ?", user_id).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			providers = append(providers, provider)
+		}
+	}
+	sort.Strings(providers)
+	return providers, nil
+}
+
+// GetUserByEmail returns the user with the email address, compared case-insensitively, or nil if there is none.
 func (d *Database) GetUserByEmail(email string) (*types.User, error) {
 	var user *types.User
-	if err := d.DB.First(&user, "email = ?", email).Error; err != nil {
+	err := d.DB.Joins("JOIN email_keys ON users.id = email_keys.user_id").
+		Where("email_keys.address = ?", identity.EmailKey(email)).
+		First(&user).Error
+	if err == gorm.ErrRecordNotFound {
+
+		// Fall back to the users table in case a key is missing (i.e. migrations were skipped, or the address was
+		// registered twice before keys were tracked)
+		err = d.DB.Where("LOWER(email) = ?", identity.EmailKey(email)).Order("id").First(&user).Error
+	}
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, nil
 		}
@@ -105,10 +277,14 @@ func (d *Database) GetUserByEmail(email string) (*types.User, error) {
 	return user, nil
 }
 
+// GetSimilarUserByUsername returns the user whose username looks the same as the given one, if any.
 func (d *Database) GetSimilarUserByUsername(username string) (*types.User, error) {
 	var user *types.User
-	if err := d.DB.First(&user, "username LIKE ?", username).Error; err != nil {
-		if err.Error() == "record not found" {
+	err := d.DB.Joins("JOIN username_keys ON users.id = username_keys.user_id").
+		Where("username_keys.skeleton = ? AND username_keys.expires_at IS NULL", identity.UsernameKey(username)).
+		First(&user).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
 			return nil, nil
 		}
 		return nil, err
@@ -117,10 +293,27 @@ func (d *Database) GetSimilarUserByUsername(username string) (*types.User, error
 }
 
 func (d *Database) CreateSession(user *types.User, session_id string, origin string, user_agent string, ip string, expires time.Time) error {
+	if UserBlocked(user) {
+		return ErrUserBlocked
+	}
 
 	// Destroy expired sessions
 	d.AutoDestroyExpiredSessions(user.ID)
 
+	// Logging in during the grace period cancels a scheduled deletion
+	if cancelled, err := d.CancelDeletion(user.ID); err != nil {
+		return err
+	} else if cancelled {
+
+		// Log the event
+		common.LogEvent(d.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_deletion_cancelled",
+			Details:    "Cancelled by logging in",
+			Successful: true,
+		})
+	}
+
 	// Encrypt fields
 	user_agent, _ = d.Encrypt(user, user_agent)
 	origin, _ = d.Encrypt(user, origin)
@@ -227,3 +420,33 @@ func (d *Database) AutoDestroyExpiredSessions(user_id string) error {
 func (d *Database) DeleteSession(session_id string) error {
 	return d.DB.Where("id = ?", session_id).Delete(&types.UserSession{}).Error
 }
+
+// DeleteUserSession logs out one of the user's sessions. Returns false if it doesn't exist.
+func (d *Database) DeleteUserSession(user_id string, session_id string) (bool, error) {
+	result := d.DB.Where("id = ? AND user_id = ?", session_id, user_id).Delete(&types.UserSession{})
+	return result.RowsAffected == 1, result.Error
+}
+
+// DeleteAllSessions logs the user out everywhere, except for the sessions listed in keep.
+func (d *Database) DeleteAllSessions(user_id string, keep ...string) error {
+	query := d.DB.Where("user_id = ?", user_id)
+	if len(keep) > 0 {
+		query = query.Where("id NOT IN ?", keep)
+	}
+	return query.Delete(&types.UserSession{}).Error
+}
+
+// SessionExists returns true if the session has not expired, been logged out or been revoked, and its user hasn't been
+// blocked or banned since.
+func (d *Database) SessionExists(session_id string) bool {
+	var blocked bitfield.Bitfield8
+	blocked.Set(constants.USER_IS_BLOCKED)
+	blocked.Set(constants.USER_IS_BANNED)
+
+	var count int64
+	d.DB.Model(&types.UserSession{}).
+		Joins("JOIN users ON users.id = user_sessions.user_id").
+		Where("user_sessions.id = ? AND user_sessions.expires_at > ? AND (users.state & ?) = 0", session_id, time.Now(), uint8(blocked)).
+		Count(&count)
+	return count > 0
+}
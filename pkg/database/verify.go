@@ -1,41 +1,66 @@
 package database
 
 import (
-	"errors"
+	"crypto/subtle"
 	"time"
 
 	"github.com/cloudlink-omega/storage/pkg/types"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// Wrong codes that can be entered for a user's verification codes before they are discarded.
+const VERIFICATION_MAX_ATTEMPTS = 5
+
 func (d *Database) AddVerificationCode(user string, code string, expires time.Time) error {
 	vc := &types.Verification{
 		UserID:    user,
 		Code:      code,
 		ExpiresAt: expires,
 	}
-	return d.DB.Create(&vc).Error
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+
+		// A new code gets a fresh set of attempts
+		if err := tx.Where("user_id = ?", user).Delete(&VerificationAttempts{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&vc).Error
+	})
 }
 
+// VerifyCode returns true if the code matches one of the user's verification codes that hasn't expired. Wrong codes
+// count towards VERIFICATION_MAX_ATTEMPTS, after which all of the user's codes are discarded and a new one has to be
+// requested.
 func (d *Database) VerifyCode(user string, code string) (bool, error) {
-	var vc types.Verification
-	err := d.DB.
-		Where("user_id = ? AND code = ?", user, code).
-		First(&vc).Error
-
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return false, nil
-		}
+	var codes []*types.Verification
+	if err := d.DB.Where("user_id = ? AND expires_at > ?", user, time.Now()).Find(&codes).Error; err != nil {
 		return false, err
 	}
-
-	if vc.ExpiresAt.Before(time.Now()) {
-		d.DB.Where("user_id = ? AND code = ?", user, code).Delete(&types.Verification{})
+	if len(codes) == 0 {
 		return false, nil
 	}
 
-	return true, nil
+	for _, vc := range codes {
+		if subtle.ConstantTimeCompare([]byte(vc.Code), []byte(code)) == 1 {
+			return true, nil
+		}
+	}
+
+	// Count the wrong code
+	if err := d.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]any{"attempts": gorm.Expr("verification_attempts.attempts + 1"), "updated_at": time.Now()}),
+	}).Create(&VerificationAttempts{UserID: user, Attempts: 1}).Error; err != nil {
+		return false, err
+	}
+	var attempts VerificationAttempts
+	if err := d.DB.Where("user_id = ?", user).First(&attempts).Error; err != nil {
+		return false, err
+	}
+	if attempts.Attempts >= VERIFICATION_MAX_ATTEMPTS {
+		return false, d.DeleteVerificationCodes(user)
+	}
+	return false, nil
 }
 
 func (d *Database) GetVerificationCode(user string) (string, error) {
@@ -60,7 +85,10 @@ func (d *Database) GetVerificationCode(user string) (string, error) {
 }
 
 func (d *Database) DeleteVerificationCodes(user string) error {
-	return d.DB.
-		Where("user_id = ?", user).
-		Delete(&types.Verification{}).Error
+	return d.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user).Delete(&VerificationAttempts{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user).Delete(&types.Verification{}).Error
+	})
 }
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/gorm"
+)
+
+// WebAuthnCredentialHash returns the key used to look up a credential by its (raw) credential ID.
+func WebAuthnCredentialHash(credential_id []byte) string {
+	hash := sha256.Sum256(credential_id)
+	return hex.EncodeToString(hash[:])
+}
+
+// AddWebAuthnCredential stores a newly registered passkey or security key for the user.
+func (d *Database) AddWebAuthnCredential(user_id string, name string, credential_id []byte, data []byte, sign_count uint32) (*WebAuthnCredential, error) {
+	credential := &WebAuthnCredential{
+		ID:             ulid.Make().String(),
+		UserID:         user_id,
+		CredentialHash: WebAuthnCredentialHash(credential_id),
+		Name:           name,
+		Data:           data,
+		SignCount:      sign_count,
+	}
+	return credential, d.DB.Create(credential).Error
+}
+
+// GetWebAuthnCredentials returns all passkeys and security keys registered to the user, oldest first.
+func (d *Database) GetWebAuthnCredentials(user_id string) ([]*WebAuthnCredential, error) {
+	var credentials []*WebAuthnCredential
+	err := d.DB.Where("user_id = ?", user_id).Order("created_at ASC").Find(&credentials).Error
+	return credentials, err
+}
+
+// HasWebAuthnCredentials returns true if the user has at least one passkey or security key.
+func (d *Database) HasWebAuthnCredentials(user_id string) (bool, error) {
+	var count int64
+	err := d.DB.Model(&WebAuthnCredential{}).Where("user_id = ?", user_id).Count(&count).Error
+	return count > 0, err
+}
+
+// HasSecondFactor returns true if the user has TOTP enabled or a passkey or security key, so logging in requires more
+// than a password, magic link or OAuth provider.
+func (d *Database) HasSecondFactor(user *types.User) (bool, error) {
+	if user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		return true, nil
+	}
+	return d.HasWebAuthnCredentials(user.ID)
+}
+
+// GetWebAuthnCredential returns a credential by its credential ID, or nil if it isn't registered.
+func (d *Database) GetWebAuthnCredential(credential_id []byte) (*WebAuthnCredential, error) {
+	var credential *WebAuthnCredential
+	err := d.DB.Where("credential_hash = ?", WebAuthnCredentialHash(credential_id)).First(&credential).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// UpdateWebAuthnCredential records a successful assertion, storing the updated credential record and counter.
+func (d *Database) UpdateWebAuthnCredential(credential *WebAuthnCredential, data []byte, sign_count uint32) error {
+	now := time.Now()
+	return d.DB.Model(credential).Updates(map[string]any{
+		"data":         data,
+		"sign_count":   sign_count,
+		"last_used_at": &now,
+	}).Error
+}
+
+// DeleteWebAuthnCredential removes one of the user's credentials. Returns false if it doesn't exist.
+func (d *Database) DeleteWebAuthnCredential(user_id string, id string) (bool, error) {
+	result := d.DB.Where("id = ? AND user_id = ?", id, user_id).Delete(&WebAuthnCredential{})
+	return result.RowsAffected == 1, result.Error
+}
+
+// DeleteWebAuthnCredentials removes all of the user's credentials, and returns how many there were.
+func (d *Database) DeleteWebAuthnCredentials(user_id string) (int64, error) {
+	result := d.DB.Where("user_id = ?", user_id).Delete(&WebAuthnCredential{})
+	return result.RowsAffected, result.Error
+}
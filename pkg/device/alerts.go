@@ -0,0 +1,194 @@
+package device
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/proxy"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Defaults for login alerts.
+const (
+	DEFAULT_HISTORY_WINDOW = 90 * 24 * time.Hour // How far back logins are compared with when deciding if one is new.
+	LOGIN_ALERT_DAYS       = 7                   // How long the "this wasn't me" link in an alert can be used for.
+)
+
+// The event logged with the fingerprint of every login, which later logins are compared with.
+const EVENT_DEVICE_SEEN = "user_device_seen"
+
+// Alerts emails users when they log in from a device or location that doesn't match their recent logins, with a
+// link to revoke the session if it wasn't them. It is shared by every API version and the OAuth flow.
+type Alerts struct {
+	DB            *database.Database
+	Outbox        *email.Outbox
+	ServerURL     string
+	RouterPath    string
+	Nickname      string
+	HistoryWindow time.Duration
+	GeoIP         *GeoIP // Adds the location to alerts and logged devices. Off if nil.
+}
+
+// NewAlerts creates login alerts that send mail through the outbox, with links to the given server.
+func NewAlerts(db *database.Database, outbox *email.Outbox, server_url string, router_path string, nickname string) *Alerts {
+	return &Alerts{
+		DB:            db,
+		Outbox:        outbox,
+		ServerURL:     server_url,
+		RouterPath:    router_path,
+		Nickname:      nickname,
+		HistoryWindow: DEFAULT_HISTORY_WINDOW,
+	}
+}
+
+// CheckLogin compares a new session with the user's recent sessions and logins, and alerts the user if it came from
+// a device or location they haven't used lately. The login is then recorded for comparing later ones with. Failures
+// are logged rather than returned, since they shouldn't stop the user from logging in.
+func (a *Alerts) CheckLogin(c *fiber.Ctx, user *types.User, session_id string) {
+	if a == nil {
+		return
+	}
+
+	fingerprint := Identify(c.Get(fiber.HeaderUserAgent), proxy.ClientIP(c))
+	details := a.GeoIP.Describe(c.Get(fiber.HeaderUserAgent), proxy.ClientIP(c))
+	new_device, new_location, err := a.is_new(user, session_id, fingerprint)
+
+	// The location is only for the user to read, since networks are compared by prefix
+	seen := fingerprint.String()
+	if details.Location != nil {
+		seen += " in " + details.Location.String()
+	}
+
+	// Log the event
+	common.LogEvent(a.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    EVENT_DEVICE_SEEN,
+		Details:    seen,
+		Successful: true,
+	})
+
+	if err != nil {
+
+		// Log the event
+		common.LogEvent(a.DB.DB, &types.SystemEvent{
+			EventID:    "login_alert_error",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return
+	}
+
+	if !new_device && !new_location {
+		return
+	}
+	if !a.Outbox.Config.Enabled || user.State.Read(constants.USER_IS_EMAIL_DISABLED) {
+		return
+	}
+
+	if err := a.send(c, user, session_id, fingerprint, details, new_device, new_location); err != nil {
+
+		// Log the event
+		common.LogEvent(a.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_login_alert_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+	}
+}
+
+// Checks whether the browser family and network of a login were seen in the user's other sessions or recent logins.
+// A user without any history (i.e. on their first login) has nothing to compare with, so nothing is new.
+func (a *Alerts) is_new(user *types.User, session_id string, fingerprint *Fingerprint) (new_device bool, new_location bool, err error) {
+	var seen []*Fingerprint
+
+	sessions, err := a.DB.GetAllSessions(user.ID)
+	if err != nil {
+		return false, false, err
+	}
+	for _, session := range sessions {
+		if session.ID != session_id {
+			seen = append(seen, Identify(session.UserAgent, session.IP))
+		}
+	}
+
+	events, err := a.DB.GetUserEventsSince(user.ID, EVENT_DEVICE_SEEN, time.Now().Add(-a.HistoryWindow))
+	if err != nil {
+		return false, false, err
+	}
+	for _, event := range events {
+		if previous := ParseFingerprint(event.Details); previous != nil {
+			seen = append(seen, previous)
+		}
+	}
+
+	if len(seen) == 0 {
+		return false, false, nil
+	}
+
+	new_device = !slices.ContainsFunc(seen, func(f *Fingerprint) bool { return f.Family == fingerprint.Family })
+	new_location = !slices.ContainsFunc(seen, func(f *Fingerprint) bool { return f.Prefix == fingerprint.Prefix })
+	return new_device, new_location, nil
+}
+
+// Stores an alert for the session and emails the user a link to revoke it.
+func (a *Alerts) send(c *fiber.Ctx, user *types.User, session_id string, fingerprint *Fingerprint, details *Details, new_device bool, new_location bool) error {
+	token, err := random_token()
+	if err != nil {
+		return err
+	}
+	if err := a.DB.CreateLoginAlert(user.ID, session_id, token, time.Now().Add(LOGIN_ALERT_DAYS*24*time.Hour)); err != nil {
+		return err
+	}
+
+	var location string
+	if details.Location != nil {
+		location = details.Location.String()
+	}
+
+	if err := a.Outbox.Send(&structs.EmailArgs{
+		To:       user.Email,
+		Nickname: a.Nickname,
+		Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+	}, email.TEMPLATE_NEW_LOGIN, map[string]any{
+		"Username":    user.Username,
+		"Device":      details.Device(),
+		"Location":    location,
+		"NewDevice":   new_device,
+		"NewLocation": new_location,
+		"Date":        time.Now().UTC().Format("January 2, 2006 at 15:04 MST"),
+		"IP":          proxy.ClientIP(c),
+		"Days":        LOGIN_ALERT_DAYS,
+		"Link":        a.ServerURL + a.RouterPath + "/not-me?token=" + token,
+	}); err != nil {
+		return err
+	}
+
+	// Log the event
+	common.LogEvent(a.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_login_alert_sent",
+		Details:    fingerprint.String(),
+		Successful: true,
+	})
+
+	return nil
+}
+
+// Generates a token for the link in an alert.
+func random_token() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
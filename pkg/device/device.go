@@ -0,0 +1,165 @@
+// Package device tells logins apart by the browser and network they came from, so that logins from a new device or
+// location can be noticed.
+package device
+
+import (
+	"net"
+	"slices"
+	"strings"
+)
+
+// Prefix lengths used to group IP addresses into networks. Addresses within the same network usually belong to the
+// same ISP customer, so a login from a new address within it isn't treated as a new location.
+const (
+	IPV4_PREFIX_BITS = 24
+	IPV6_PREFIX_BITS = 48
+)
+
+// Kinds of device, as told by the user agent.
+const (
+	DEVICE_DESKTOP = "desktop"
+	DEVICE_MOBILE  = "mobile"
+	DEVICE_TABLET  = "tablet"
+	DEVICE_BOT     = "bot"
+	DEVICE_UNKNOWN = "unknown"
+)
+
+// UserAgent is what could be told about a browser from its user agent string.
+type UserAgent struct {
+	Browser    string
+	Version    string // Major version of the browser, if known.
+	OS         string
+	DeviceType string
+}
+
+// Fingerprint identifies the kind of device and the network a login came from. It is deliberately coarse, so that
+// browser updates and dynamic IP addresses don't make every login look new.
+type Fingerprint struct {
+	Family string // Browser and OS, i.e. "Firefox on Windows".
+	Prefix string // Network of the IP address, i.e. "203.0.113.0/24".
+}
+
+// Browsers and operating systems in the order they are matched. Order matters, since many user agents mention
+// several of them (i.e. Edge also claims to be Chrome and Safari, and Android claims to be Linux).
+var browsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"Edge/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+}
+
+var operating_systems = []struct{ token, name string }{
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// Tokens found in the user agents of crawlers and scripts, rather than people.
+var bot_tokens = []string{"bot", "crawler", "spider", "curl/", "wget/", "python-requests/", "go-http-client/"}
+
+// ParseUserAgent finds the browser, operating system and kind of device in a user agent string. The browser and OS
+// are "Unknown" if they can't be recognized.
+func ParseUserAgent(user_agent string) *UserAgent {
+	ua := &UserAgent{Browser: "Unknown", OS: "Unknown", DeviceType: device_type(user_agent)}
+	for _, browser := range browsers {
+		if _, after, found := strings.Cut(user_agent, browser.token); found {
+			ua.Browser = browser.name
+			ua.Version, _, _ = strings.Cut(after, ".")
+			break
+		}
+	}
+
+	// Safari's own token holds the WebKit build, while its version has a token of its own
+	if ua.Browser == "Safari" {
+		_, after, _ := strings.Cut(user_agent, "Version/")
+		ua.Version, _, _ = strings.Cut(after, ".")
+	}
+
+	for _, os := range operating_systems {
+		if strings.Contains(user_agent, os.token) {
+			ua.OS = os.name
+			break
+		}
+	}
+	return ua
+}
+
+// Family returns the browser and OS as a single label, i.e. "Firefox on Windows". It leaves out the version, so it
+// doesn't change when the browser is updated.
+func (u *UserAgent) Family() string {
+	return u.Browser + " on " + u.OS
+}
+
+// String describes the browser for showing to the user, i.e. "Firefox 128 on Windows".
+func (u *UserAgent) String() string {
+	if u.Version == "" {
+		return u.Family()
+	}
+	return u.Browser + " " + u.Version + " on " + u.OS
+}
+
+// Guesses the kind of device from a user agent string.
+func device_type(user_agent string) string {
+	lower := strings.ToLower(user_agent)
+	switch {
+	case user_agent == "":
+		return DEVICE_UNKNOWN
+	case slices.ContainsFunc(bot_tokens, func(token string) bool { return strings.Contains(lower, token) }):
+		return DEVICE_BOT
+	case strings.Contains(user_agent, "iPad") || strings.Contains(user_agent, "Tablet") ||
+		(strings.Contains(user_agent, "Android") && !strings.Contains(user_agent, "Mobile")):
+		return DEVICE_TABLET
+	case strings.Contains(user_agent, "Mobi") || strings.Contains(user_agent, "iPhone"):
+		return DEVICE_MOBILE
+	default:
+		return DEVICE_DESKTOP
+	}
+}
+
+// IPPrefix returns the network an IP address belongs to, in CIDR notation. Returns the input unchanged if it isn't
+// a valid IP address.
+func IPPrefix(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		mask := net.CIDRMask(IPV4_PREFIX_BITS, 32)
+		return (&net.IPNet{IP: v4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(IPV6_PREFIX_BITS, 128)
+	return (&net.IPNet{IP: addr.Mask(mask), Mask: mask}).String()
+}
+
+// Identify returns the fingerprint of a login from the given user agent and IP address.
+func Identify(user_agent string, ip string) *Fingerprint {
+	return &Fingerprint{
+		Family: ParseUserAgent(user_agent).Family(),
+		Prefix: IPPrefix(ip),
+	}
+}
+
+// String formats the fingerprint as it is stored in event logs, i.e. "Firefox on Windows from 203.0.113.0/24".
+func (f *Fingerprint) String() string {
+	return f.Family + " from " + f.Prefix
+}
+
+// ParseFingerprint reads a fingerprint formatted by Fingerprint.String, ignoring a location appended to it with
+// " in ". Returns nil if it isn't one.
+func ParseFingerprint(s string) *Fingerprint {
+	family, prefix, found := strings.Cut(s, " from ")
+	if !found {
+		return nil
+	}
+	prefix, _, _ = strings.Cut(prefix, " in ")
+	return &Fingerprint{Family: family, Prefix: prefix}
+}
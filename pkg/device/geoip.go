@@ -0,0 +1,122 @@
+package device
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP finds the location of IP addresses in a local MaxMind-format database, such as GeoLite2 City or DB-IP City
+// Lite, without making any network calls. Locations are personal data, so geolocation is off unless a database is
+// opened. A nil *GeoIP is valid, and never finds a location.
+type GeoIP struct {
+	reader *maxminddb.Reader
+}
+
+// Location is where an IP address is registered. Either field may be empty if the database doesn't know it.
+type Location struct {
+	City    string `json:"city,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// Details describes a session or login for showing to the user.
+type Details struct {
+	Browser    string    `json:"browser"`
+	Version    string    `json:"version,omitempty"`
+	OS         string    `json:"os"`
+	DeviceType string    `json:"device_type"`
+	Location   *Location `json:"location,omitempty"`
+}
+
+// The fields read from city databases. Country databases only have the country.
+type geoip_record struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+}
+
+// The language of the place names that are shown.
+const GEOIP_LANGUAGE = "en"
+
+// OpenGeoIP opens a MaxMind-format database file (.mmdb). It is kept in memory until Close is called.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{reader: reader}, nil
+}
+
+// Lookup returns the location of an IP address, or nil if geolocation is off or the address isn't in the database.
+func (g *GeoIP) Lookup(ip string) *Location {
+	if g == nil {
+		return nil
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+
+	var record geoip_record
+	if err := g.reader.Lookup(addr, &record); err != nil {
+		return nil
+	}
+	location := &Location{
+		City:    record.City.Names[GEOIP_LANGUAGE],
+		Country: record.Country.Names[GEOIP_LANGUAGE],
+	}
+	if location.City == "" && location.Country == "" {
+		return nil
+	}
+	return location
+}
+
+// Describe parses a user agent, and finds the location of the IP address if geolocation is on.
+func (g *GeoIP) Describe(user_agent string, ip string) *Details {
+	ua := ParseUserAgent(user_agent)
+	return &Details{
+		Browser:    ua.Browser,
+		Version:    ua.Version,
+		OS:         ua.OS,
+		DeviceType: ua.DeviceType,
+		Location:   g.Lookup(ip),
+	}
+}
+
+// Close releases the database.
+func (g *GeoIP) Close() error {
+	if g == nil {
+		return nil
+	}
+	return g.reader.Close()
+}
+
+// String formats the location for showing to the user, i.e. "Berlin, Germany".
+func (l *Location) String() string {
+	var parts []string
+	for _, part := range []string{l.City, l.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Device describes the browser for showing to the user, i.e. "Firefox 128 on Windows".
+func (d *Details) Device() string {
+	return (&UserAgent{Browser: d.Browser, Version: d.Version, OS: d.OS}).String()
+}
+
+// String describes the device and its location for showing to the user, i.e. "Firefox 128 on Windows in Berlin,
+// Germany".
+func (d *Details) String() string {
+	s := d.Device()
+	if d.Location != nil {
+		s += " in " + d.Location.String()
+	}
+	return s
+}
@@ -0,0 +1,169 @@
+package email
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/oklog/ulid/v2"
+
+	gomail "gopkg.in/mail.v2"
+)
+
+// Transports that can be selected with MailConfig.Transport.
+const (
+	TRANSPORT_SMTP   = "smtp"
+	TRANSPORT_LOG    = "log"
+	TRANSPORT_FILE   = "file"
+	TRANSPORT_MEMORY = "memory"
+)
+
+// Connection security options for MailConfig.Security.
+const (
+	SECURITY_OPPORTUNISTIC = ""
+	SECURITY_STARTTLS      = "starttls"
+	SECURITY_TLS           = "tls"
+	SECURITY_NONE          = "none"
+)
+
+// Mail is a single rendered email, addressed and ready to be delivered.
+type Mail struct {
+	FromAddress string
+	FromName    string
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+}
+
+// Mailer delivers mail. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(mail *Mail) error
+}
+
+// NewMailer creates the Mailer selected by the config's transport.
+func NewMailer(config *structs.MailConfig) (Mailer, error) {
+	switch config.Transport {
+	case "", TRANSPORT_SMTP:
+		return &SMTPMailer{Config: config}, nil
+	case TRANSPORT_LOG:
+		return &LogMailer{}, nil
+	case TRANSPORT_FILE:
+		if config.Directory == "" {
+			return nil, fmt.Errorf("the file mail transport requires a directory")
+		}
+		return &FileMailer{Directory: config.Directory}, nil
+	case TRANSPORT_MEMORY:
+		return &MemoryMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", config.Transport)
+	}
+}
+
+// Formats the mail as a multipart message, with HTML as the preferred alternative to plaintext.
+func (mail *Mail) message() *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetHeader("From", m.FormatAddress(mail.FromAddress, mail.FromName))
+	m.SetHeader("To", mail.To)
+	m.SetHeader("Subject", mail.Subject)
+	m.SetDateHeader("Date", time.Now())
+	m.SetBody("text/plain", mail.Text)
+	if mail.HTML != "" {
+		m.AddAlternative("text/html", mail.HTML)
+	}
+	return m
+}
+
+// SMTPMailer delivers mail through an SMTP server, verifying its certificate unless told otherwise.
+type SMTPMailer struct {
+	Config *structs.MailConfig
+}
+
+func (s *SMTPMailer) Send(mail *Mail) error {
+	d := gomail.NewDialer(
+		s.Config.Server,
+		s.Config.Port,
+		s.Config.Username,
+		s.Config.Password,
+	)
+	d.TLSConfig = &tls.Config{
+		ServerName:         s.Config.Server,
+		InsecureSkipVerify: s.Config.SkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	switch s.Config.Security {
+	case SECURITY_OPPORTUNISTIC:
+		d.StartTLSPolicy = gomail.OpportunisticStartTLS
+	case SECURITY_STARTTLS:
+		d.StartTLSPolicy = gomail.MandatoryStartTLS
+	case SECURITY_TLS:
+		d.SSL = true
+	case SECURITY_NONE:
+		d.StartTLSPolicy = gomail.NoStartTLS
+	default:
+		return fmt.Errorf("unknown mail security option %q", s.Config.Security)
+	}
+
+	return d.DialAndSend(mail.message())
+}
+
+// LogMailer writes mail to the server log instead of delivering it, for development.
+type LogMailer struct{}
+
+func (l *LogMailer) Send(mail *Mail) error {
+	log.Infof("Mail to %s: %s\n%s", mail.To, mail.Subject, mail.Text)
+	return nil
+}
+
+// FileMailer writes each mail to an .eml file in a directory instead of delivering it, for development.
+type FileMailer struct {
+	Directory string
+}
+
+func (f *FileMailer) Send(mail *Mail) error {
+	if err := os.MkdirAll(f.Directory, 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(filepath.Join(f.Directory, ulid.Make().String()+".eml"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = mail.message().WriteTo(file)
+	return err
+}
+
+// MemoryMailer keeps mail in memory instead of delivering it, so tests can inspect what was sent.
+type MemoryMailer struct {
+	mutex sync.Mutex
+	sent  []*Mail
+}
+
+func (m *MemoryMailer) Send(mail *Mail) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+// Sent returns the mail sent so far, oldest first.
+func (m *MemoryMailer) Sent() []*Mail {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]*Mail(nil), m.sent...)
+}
+
+// Reset forgets all mail sent so far.
+func (m *MemoryMailer) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sent = nil
+}
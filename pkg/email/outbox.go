@@ -0,0 +1,185 @@
+package email
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// Defaults for the outbox worker.
+const (
+	DEFAULT_MAX_ATTEMPTS    = 8                // Attempts before mail is dead-lettered.
+	DEFAULT_RETRY_DELAY     = 30 * time.Second // Delay after the first failed attempt, doubled after each one after that.
+	DEFAULT_MAX_RETRY_DELAY = 6 * time.Hour    // Upper bound for the delay between attempts.
+	DEFAULT_SEND_LEASE      = 5 * time.Minute  // How long a worker has to send mail it claimed before another may retry it.
+	OUTBOX_BATCH_SIZE       = 50               // Most mail sent per pass of the worker.
+)
+
+// The sender name used when the server has no nickname.
+const DEFAULT_SENDER_NAME = "CloudLink Omega"
+
+var ErrMailDisabled = errors.New("email is not enabled on this server")
+
+// Outbox renders mail into a persistent queue, which a background worker delivers using the Mailer,
+// retrying with exponential backoff and dead-lettering mail that keeps failing.
+type Outbox struct {
+	DB            *database.Database
+	Config        *structs.MailConfig
+	Mailer        Mailer
+	MaxAttempts   int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	wake          chan struct{}
+}
+
+// NewOutbox creates an outbox that delivers mail using the transport selected by the config.
+func NewOutbox(db *database.Database, config *structs.MailConfig) (*Outbox, error) {
+	mailer, err := NewMailer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Outbox{
+		DB:            db,
+		Config:        config,
+		Mailer:        mailer,
+		MaxAttempts:   DEFAULT_MAX_ATTEMPTS,
+		RetryDelay:    DEFAULT_RETRY_DELAY,
+		MaxRetryDelay: DEFAULT_MAX_RETRY_DELAY,
+		wake:          make(chan struct{}, 1),
+	}, nil
+}
+
+// Send renders a template in the recipient's locale and queues it for delivery.
+// The server's nickname is available to the template as ServerName.
+func (o *Outbox) Send(args *structs.EmailArgs, template string, data map[string]any) error {
+	if !o.Config.Enabled {
+		return ErrMailDisabled
+	}
+
+	if data == nil {
+		data = map[string]any{}
+	}
+	data["ServerName"] = sender_name(args)
+
+	message, err := Render(template, args.Locale, data)
+	if err != nil {
+		return err
+	}
+
+	from := o.Config.From
+	if from == "" {
+		from = o.Config.Username
+	}
+
+	if err := o.DB.EnqueueMail(&database.OutboxMail{
+		Recipient:   args.To,
+		FromAddress: from,
+		FromName:    sender_name(args),
+		Template:    template,
+		Subject:     message.Subject,
+		Text:        message.Text,
+		HTML:        message.HTML,
+	}); err != nil {
+		return err
+	}
+
+	// Let the worker know there's mail, rather than waiting for its next pass
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Flush makes a single pass over the outbox, attempting to deliver all mail that is due.
+func (o *Outbox) Flush() (sent int, err error) {
+	due, err := o.DB.GetDueMail(OUTBOX_BATCH_SIZE)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, mail := range due {
+
+		// Another worker may have picked it up already
+		if claimed, err := o.DB.ClaimMail(mail, DEFAULT_SEND_LEASE); err != nil {
+			return sent, err
+		} else if !claimed {
+			continue
+		}
+
+		send_err := o.Mailer.Send(&Mail{
+			FromAddress: mail.FromAddress,
+			FromName:    mail.FromName,
+			To:          mail.Recipient,
+			Subject:     mail.Subject,
+			Text:        mail.Text,
+			HTML:        mail.HTML,
+		})
+		if send_err == nil {
+			if err := o.DB.MarkMailSent(mail.ID); err != nil {
+				return sent, err
+			}
+			sent++
+			continue
+		}
+
+		// Back off exponentially, or give up once out of attempts
+		attempts := mail.Attempts + 1
+		var next_attempt *time.Time
+		if attempts < o.MaxAttempts {
+			next := time.Now().Add(o.retry_delay(attempts))
+			next_attempt = &next
+			log.Warn("Failed to send mail ", mail.ID, " (attempt ", attempts, "), retrying at ", next.Format(time.RFC3339), ": ", send_err)
+		} else {
+			log.Error("Failed to send mail ", mail.ID, " after ", attempts, " attempts, giving up: ", send_err)
+		}
+		if err := o.DB.MarkMailFailed(mail.ID, attempts, send_err, next_attempt); err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
+// The delay before the next attempt, after the given number of failed ones.
+func (o *Outbox) retry_delay(attempts int) time.Duration {
+	delay := o.RetryDelay
+	for i := 1; i < attempts && delay < o.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, o.MaxRetryDelay)
+}
+
+// Start delivers mail in the background every interval, or as soon as it is queued, until the returned function is called.
+func (o *Outbox) Start(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+			case <-o.wake:
+			case <-done:
+				ticker.Stop()
+				return
+			}
+			if _, err := o.Flush(); err != nil {
+				log.Error("Failed to process the mail outbox: ", err)
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func sender_name(args *structs.EmailArgs) string {
+	if args.Nickname == "" {
+		return DEFAULT_SENDER_NAME
+	}
+	return args.Nickname
+}
@@ -0,0 +1,132 @@
+package email
+
+import (
+	"bytes"
+	"embed"
+	html_template "html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	text_template "text/template"
+
+	"golang.org/x/text/language"
+)
+
+//go:embed templates
+var embedded_templates embed.FS
+
+// The locale used when a template has no variant for the requested one.
+const DEFAULT_LOCALE = "en"
+
+// Names of the available templates. Each locale has a <name>.txt file defining the "subject" and "text"
+// templates, and a <name>.html file defining the "html" template, which is wrapped by the locale's layout.html.
+const (
+	TEMPLATE_VERIFY              = "verify"
+	TEMPLATE_VERIFY_RESEND       = "verify_resend"
+	TEMPLATE_RECOVERY            = "recovery"
+	TEMPLATE_LINK_CODE           = "link_code"
+	TEMPLATE_EMAIL_CHANGE_CODE   = "email_change_code"
+	TEMPLATE_EMAIL_CHANGED       = "email_changed"
+	TEMPLATE_DELETION_SCHEDULED  = "deletion_scheduled"
+	TEMPLATE_EXPORT_READY        = "export_ready"
+	TEMPLATE_MAGIC_LINK          = "magic_link"
+	TEMPLATE_CREDENTIALS_CHANGED = "credentials_changed"
+	TEMPLATE_NEW_LOGIN           = "new_login"
+)
+
+// Message is a rendered email, ready to be sent.
+type Message struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Locales in the order given to the matcher, with the default first so that it is used when nothing matches.
+var matcher_locales = func() []string {
+	locales := []string{DEFAULT_LOCALE}
+	for _, locale := range Locales() {
+		if locale != DEFAULT_LOCALE {
+			locales = append(locales, locale)
+		}
+	}
+	return locales
+}()
+
+var locale_matcher = func() language.Matcher {
+	var tags []language.Tag
+	for _, locale := range matcher_locales {
+		tags = append(tags, language.Make(locale))
+	}
+	return language.NewMatcher(tags)
+}()
+
+// Locales returns the locales that templates are available in.
+func Locales() []string {
+	entries, _ := fs.ReadDir(embedded_templates, "templates")
+	var locales []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			locales = append(locales, entry.Name())
+		}
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Templates returns the names of the available templates.
+func Templates() []string {
+	entries, _ := fs.ReadDir(embedded_templates, path.Join("templates", DEFAULT_LOCALE))
+	var names []string
+	for _, entry := range entries {
+		if name, found := strings.CutSuffix(entry.Name(), ".txt"); found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MatchLocale returns the best available locale for an Accept-Language header (i.e. "es-MX,es;q=0.9,en;q=0.8").
+func MatchLocale(accept_language string) string {
+	tags, _, _ := language.ParseAcceptLanguage(accept_language)
+	_, index, _ := locale_matcher.Match(tags...)
+	return matcher_locales[index]
+}
+
+// Render executes a template in the given locale, falling back to DEFAULT_LOCALE if there is no variant for it.
+func Render(name string, locale string, data map[string]any) (*Message, error) {
+	if _, err := fs.Stat(embedded_templates, path.Join("templates", locale, name+".txt")); err != nil {
+		locale = DEFAULT_LOCALE
+	}
+	dir := path.Join("templates", locale)
+
+	text, err := text_template.ParseFS(embedded_templates, path.Join(dir, name+".txt"))
+	if err != nil {
+		return nil, err
+	}
+
+	html, err := html_template.ParseFS(embedded_templates, path.Join(dir, "layout.html"), path.Join(dir, name+".html"))
+	if err != nil {
+		return nil, err
+	}
+
+	message := &Message{}
+	var buf bytes.Buffer
+	for _, part := range []struct {
+		execute func() error
+		output  *string
+	}{
+		{func() error { return text.ExecuteTemplate(&buf, "subject", data) }, &message.Subject},
+		{func() error { return text.ExecuteTemplate(&buf, "text", data) }, &message.Text},
+		{func() error { return html.ExecuteTemplate(&buf, "layout", data) }, &message.HTML},
+	} {
+		buf.Reset()
+		if err := part.execute(); err != nil {
+			return nil, err
+		}
+		*part.output = strings.TrimSpace(buf.String())
+	}
+
+	return message, nil
+}
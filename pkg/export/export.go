@@ -0,0 +1,270 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/goccy/go-json"
+)
+
+// Supported archive formats.
+const (
+	FORMAT_JSON = "json"
+	FORMAT_ZIP  = "zip"
+)
+
+// UserData is everything the Accounts service stores about a user, in a form that is readable by the user.
+// Secrets (i.e. password hashes, TOTP secrets, recovery codes, and the codes and tokens sent by email) are
+// deliberately left out. The devices and locations that the user logged in from are recorded as events, so they are
+// exported with them.
+//
+// A few records are left out entirely, as they only protect the account and hold nothing about the user besides
+// their ID: verification codes and the count of wrong attempts at them, TOTP enrollments in progress and the time
+// step of the last TOTP code used. Mail isn't included either, since it is only linked to an address rather than an
+// account, and is only kept for a short while.
+type UserData struct {
+	GeneratedAt     time.Time         `json:"generated_at"`
+	Profile         *Profile          `json:"profile"`
+	Providers       []string          `json:"linked_providers"`
+	Sessions        []*Session        `json:"sessions"`
+	UsernameHistory []*UsernameChange `json:"username_history"`
+	EmailChanges    []*EmailChange    `json:"email_changes"`
+	Passkeys        []*Passkey        `json:"passkeys"`
+	LoginAlerts     []*LoginAlert     `json:"login_alerts"`
+	MagicLinks      []*MagicLink      `json:"magic_links"`
+	Events          []*Event          `json:"events"`
+}
+
+type Profile struct {
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Flags    []string `json:"flags"`
+}
+
+type Session struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	Origin    string    `json:"origin"`
+	IP        string    `json:"ip"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type UsernameChange struct {
+	OldName   string    `json:"old_name"`
+	NewName   string    `json:"new_name"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+type EmailChange struct {
+	OldEmail    string     `json:"old_email"`
+	NewEmail    string     `json:"new_email"`
+	RequestedAt time.Time  `json:"requested_at"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	RevertedAt  *time.Time `json:"reverted_at,omitempty"`
+}
+
+type Passkey struct {
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+type LoginAlert struct {
+	SessionID string     `json:"session_id"`
+	SentAt    time.Time  `json:"sent_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"` // When the session was revoked using the alert.
+}
+
+type MagicLink struct {
+	SentAt    time.Time  `json:"sent_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+type Event struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Action     string    `json:"action"`
+	Details    string    `json:"details,omitempty"`
+	Successful bool      `json:"successful"`
+}
+
+// Collect gathers all of the data stored about a user. Sessions are decrypted.
+func Collect(db *database.Database, user_id string) (*UserData, error) {
+	user, err := db.GetUser(user_id)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &UserData{
+		GeneratedAt: time.Now().UTC(),
+		Profile: &Profile{
+			ID:       user.ID,
+			Username: user.Username,
+			Email:    user.Email,
+			Flags:    []string{},
+		},
+		Sessions:        []*Session{},
+		UsernameHistory: []*UsernameChange{},
+		EmailChanges:    []*EmailChange{},
+		Passkeys:        []*Passkey{},
+		LoginAlerts:     []*LoginAlert{},
+		MagicLinks:      []*MagicLink{},
+		Events:          []*Event{},
+	}
+
+	// Decode the state flags to their names
+	for bit := uint(0); bit < 8; bit++ {
+		if name, ok := constants.USER_FLAG_NAMES[bit]; ok && user.State.Read(bit) {
+			data.Profile.Flags = append(data.Profile.Flags, name)
+		}
+	}
+
+	if data.Providers, err = db.GetLinkedProviders(user.ID); err != nil {
+		return nil, err
+	}
+
+	sessions, err := db.GetAllSessions(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, &Session{
+			ID:        session.ID,
+			UserAgent: session.UserAgent,
+			Origin:    session.Origin,
+			IP:        session.IP,
+			ExpiresAt: session.ExpiresAt,
+		})
+	}
+
+	history, err := db.GetUsernameHistory(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range history {
+		data.UsernameHistory = append(data.UsernameHistory, &UsernameChange{
+			OldName:   change.OldName,
+			NewName:   change.NewName,
+			ChangedAt: change.CreatedAt,
+		})
+	}
+
+	changes, err := db.GetEmailChanges(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		data.EmailChanges = append(data.EmailChanges, &EmailChange{
+			OldEmail:    change.OldEmail,
+			NewEmail:    change.NewEmail,
+			RequestedAt: change.CreatedAt,
+			ConfirmedAt: change.ConfirmedAt,
+			RevertedAt:  change.RevertedAt,
+		})
+	}
+
+	credentials, err := db.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, credential := range credentials {
+		data.Passkeys = append(data.Passkeys, &Passkey{
+			Name:       credential.Name,
+			CreatedAt:  credential.CreatedAt,
+			LastUsedAt: credential.LastUsedAt,
+		})
+	}
+
+	alerts, err := db.GetLoginAlerts(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, alert := range alerts {
+		data.LoginAlerts = append(data.LoginAlerts, &LoginAlert{
+			SessionID: alert.SessionID,
+			SentAt:    alert.CreatedAt,
+			ExpiresAt: alert.ExpiresAt,
+			UsedAt:    alert.UsedAt,
+		})
+	}
+
+	links, err := db.GetMagicLinks(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		data.MagicLinks = append(data.MagicLinks, &MagicLink{
+			SentAt:    link.CreatedAt,
+			ExpiresAt: link.ExpiresAt,
+			UsedAt:    link.UsedAt,
+		})
+	}
+
+	// Read every page of the event history
+	for page, pages := 0, 1; page < pages; page++ {
+		logs, total, err := db.GetUserLogs(user.ID, page)
+		if err != nil {
+			return nil, err
+		}
+		pages = int(total)
+		for _, entry := range logs {
+			data.Events = append(data.Events, &Event{
+				Timestamp:  entry.Timestamp,
+				Action:     entry.Action,
+				Details:    entry.Message,
+				Successful: entry.Success,
+			})
+		}
+	}
+
+	return data, nil
+}
+
+// Archive encodes the data in the requested format. JSON exports are a single document, while ZIP exports
+// contain one JSON file per section.
+func Archive(data *UserData, format string) ([]byte, error) {
+	switch format {
+	case FORMAT_JSON:
+		return json.MarshalIndent(data, "", "  ")
+
+	case FORMAT_ZIP:
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		for name, section := range map[string]any{
+			"profile.json":          data.Profile,
+			"linked_providers.json": data.Providers,
+			"sessions.json":         data.Sessions,
+			"username_history.json": data.UsernameHistory,
+			"email_changes.json":    data.EmailChanges,
+			"passkeys.json":         data.Passkeys,
+			"login_alerts.json":     data.LoginAlerts,
+			"magic_links.json":      data.MagicLinks,
+			"events.json":           data.Events,
+		} {
+			encoded, err := json.MarshalIndent(section, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: data.GeneratedAt})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := file.Write(encoded); err != nil {
+				return nil, err
+			}
+		}
+		if err := archive.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported export format: %s", format)
+	}
+}
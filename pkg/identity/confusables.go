@@ -0,0 +1,51 @@
+package identity
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Characters from other scripts that are visually indistinguishable (or nearly so) from an ASCII
+// character. This is a subset of the Unicode confusables data, limited to the characters most
+// often used to impersonate Latin usernames and email addresses.
+var confusables = map[rune]rune{
+
+	// Cyrillic
+	'а': 'a', 'А': 'A', 'в': 'B', 'В': 'B', 'е': 'e', 'Е': 'E', 'ё': 'e', 'Ё': 'E',
+	'і': 'i', 'І': 'I', 'ї': 'i', 'Ї': 'I', 'ј': 'j', 'Ј': 'J', 'к': 'k', 'К': 'K',
+	'м': 'M', 'М': 'M', 'н': 'H', 'Н': 'H', 'о': 'o', 'О': 'O', 'р': 'p', 'Р': 'P',
+	'с': 'c', 'С': 'C', 'т': 'T', 'Т': 'T', 'у': 'y', 'У': 'Y', 'х': 'x', 'Х': 'X',
+	'ѕ': 's', 'Ѕ': 'S', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'һ': 'h', 'Һ': 'H', 'ɡ': 'g',
+	'ь': 'b', 'ӏ': 'l', 'Ӏ': 'l',
+
+	// Greek
+	'α': 'a', 'Α': 'A', 'β': 'B', 'Β': 'B', 'ε': 'e', 'Ε': 'E', 'η': 'n', 'Η': 'H',
+	'ι': 'i', 'Ι': 'I', 'κ': 'k', 'Κ': 'K', 'Μ': 'M', 'ν': 'v', 'Ν': 'N', 'ο': 'o',
+	'Ο': 'O', 'ρ': 'p', 'Ρ': 'P', 'τ': 't', 'Τ': 'T', 'υ': 'u', 'Υ': 'Y', 'χ': 'x',
+	'Χ': 'X', 'Ζ': 'Z',
+
+	// Latin lookalikes and punctuation
+	'ı': 'i', 'ȷ': 'j', 'ℓ': 'l', 'ƚ': 'l', 'ǀ': 'l', 'ø': 'o', 'Ø': 'O', 'đ': 'd',
+	'Đ': 'D', 'ħ': 'h', 'ŀ': 'l', 'ł': 'l', 'Ł': 'L', 'ß': 's', 'æ': 'a', 'Æ': 'A',
+	'‐': '-', '‑': '-', '‒': '-', '–': '-', '—': '-', '―': '-', '−': '-', '﹣': '-',
+	'․': '.', '·': '.', '•': '.', '‧': '.', '＿': '_',
+}
+
+// FoldConfusables maps lookalike characters from other scripts onto their ASCII equivalents and
+// strips combining accents (i.e. "é" becomes "e"). Characters without a known ASCII lookalike are
+// left unchanged.
+func FoldConfusables(s string) string {
+	var folded strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if replacement, ok := confusables[r]; ok {
+			r = replacement
+		}
+		folded.WriteRune(r)
+	}
+	return norm.NFC.String(folded.String())
+}
@@ -0,0 +1,52 @@
+package identity
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+const EMAIL_MAX_LENGTH = 254
+
+var (
+	ErrEmailEmpty   = errors.New("email address is required")
+	ErrEmailInvalid = errors.New("email address is not valid")
+	ErrEmailLength  = errors.New("email address is too long")
+)
+
+// NormalizeEmail parses an email address according to RFC 5322 and returns it in canonical form.
+// Display names and comments are rejected (only a bare address is accepted), and the domain is
+// lowercased. Email addresses should always be compared case-insensitively using EmailKey.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", ErrEmailEmpty
+	}
+
+	if len(email) > EMAIL_MAX_LENGTH {
+		return "", ErrEmailLength
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || address.Address != email {
+		return "", ErrEmailInvalid
+	}
+
+	local, domain, found := strings.Cut(address.Address, "@")
+	if !found || local == "" || domain == "" {
+		return "", ErrEmailInvalid
+	}
+
+	// Require a dotted domain name, since local or bare hostnames cannot receive mail from us
+	domain = strings.ToLower(domain)
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", ErrEmailInvalid
+	}
+
+	return local + "@" + domain, nil
+}
+
+// EmailKey returns the form of an email address used for uniqueness checks.
+func EmailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,43 @@
+package identity
+
+import "testing"
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		email string
+		want  string
+		err   error
+	}{
+		{"user@example.com", "user@example.com", nil},
+		{"User@Example.COM", "User@example.com", nil},
+		{"  a@b.co ", "a@b.co", nil},
+		{"first.last+tag@sub.example.org", "first.last+tag@sub.example.org", nil},
+		{"", "", ErrEmailEmpty},
+		{"   ", "", ErrEmailEmpty},
+		{"a@b", "", ErrEmailInvalid},
+		{"@b.co", "", ErrEmailInvalid},
+		{"a@.b.co", "", ErrEmailInvalid},
+		{"a@b.co.", "", ErrEmailInvalid},
+		{"a@b..co", "", ErrEmailInvalid},
+		{"Name <a@b.co>", "", ErrEmailInvalid},
+		{"a(comment)@b.co", "", ErrEmailInvalid},
+		{"a@b.co, c@d.co", "", ErrEmailInvalid},
+		{"not an email", "", ErrEmailInvalid},
+		{string(make([]byte, EMAIL_MAX_LENGTH)) + "@b.co", "", ErrEmailLength},
+	}
+	for _, test := range cases {
+		got, err := NormalizeEmail(test.email)
+		if got != test.want || err != test.err {
+			t.Errorf("NormalizeEmail(%q) = %q, %v, want %q, %v", test.email, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestEmailKey(t *testing.T) {
+	if EmailKey("User@Example.COM") != EmailKey(" user@example.com ") {
+		t.Error("addresses that only differ in case got different keys")
+	}
+	if EmailKey("a@example.com") == EmailKey("b@example.com") {
+		t.Error("different addresses got the same key")
+	}
+}
@@ -0,0 +1,144 @@
+package identity
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	USERNAME_MIN_LENGTH = 3
+	USERNAME_MAX_LENGTH = 20
+)
+
+var (
+	ErrUsernameEmpty      = errors.New("username is required")
+	ErrUsernameLength     = errors.New("username must be between 3 and 20 characters long")
+	ErrUsernameCharacters = errors.New("username may only contain letters, numbers, underscores, periods and dashes")
+	ErrUsernameSeparator  = errors.New("username must start and end with a letter or number")
+	ErrUsernameReserved   = errors.New("username is reserved")
+)
+
+// Names that cannot be registered, since they could be used to impersonate the service or its staff.
+// Entries are compared using UsernameKey, so lookalikes (i.e. "Adm1n" or "ad.min") are caught as well.
+var reserved_usernames = []string{
+	"admin", "administrator", "root", "system", "sysop", "support", "help", "helpdesk",
+	"moderator", "mod", "staff", "official", "security", "abuse", "postmaster", "webmaster",
+	"noreply", "no-reply", "server", "service", "api", "oauth", "login", "logout", "register",
+	"account", "accounts", "everyone", "here", "null", "undefined", "nil", "anonymous",
+	"deleted", "unknown", "guest", "cloudlink", "omega", "clomega",
+}
+
+var reserved_keys = func() map[string]bool {
+	keys := make(map[string]bool)
+	for _, name := range reserved_usernames {
+		keys[UsernameKey(name)] = true
+	}
+	return keys
+}()
+
+// NormalizeUsername converts a requested username into its canonical display form, or returns an
+// error describing why it is not allowed. The input is NFKC normalized and confusable characters
+// are folded into their ASCII lookalikes, so the result only ever contains ASCII letters, digits,
+// underscores, periods and dashes. Letter case is preserved for display purposes.
+func NormalizeUsername(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ErrUsernameEmpty
+	}
+
+	// Compatibility normalization turns full-width and stylized forms (i.e. "ｈｅｌｌｏ", "𝐡𝐞𝐥𝐥𝐨") into plain ones
+	name = FoldConfusables(norm.NFKC.String(name))
+
+	if length := utf8.RuneCountInString(name); length < USERNAME_MIN_LENGTH || length > USERNAME_MAX_LENGTH {
+		return "", ErrUsernameLength
+	}
+
+	for _, r := range name {
+		if !is_username_rune(r) {
+			return "", ErrUsernameCharacters
+		}
+	}
+
+	if is_separator(rune(name[0])) || is_separator(rune(name[len(name)-1])) {
+		return "", ErrUsernameSeparator
+	}
+
+	if IsReservedUsername(name) {
+		return "", ErrUsernameReserved
+	}
+
+	return name, nil
+}
+
+// UsernameKey returns the skeleton of a username, used to detect names that look the same as an
+// existing one. The key is lowercase, has separators removed and maps commonly confused
+// characters (0/o, 1/i/l/I, rn/m, vv/w) to a single form. Two usernames with the same key are
+// considered to be the same name.
+func UsernameKey(name string) string {
+	name = FoldConfusables(norm.NFKC.String(strings.TrimSpace(name)))
+
+	// Capital I looks like a lowercase l in many fonts, so i is folded along with it, or "ADMIN" and "admin" would
+	// get different keys
+	name = strings.ToLower(name)
+
+	var key strings.Builder
+	for _, r := range name {
+		switch {
+		case is_separator(r):
+			continue
+		case r == '0':
+			key.WriteRune('o')
+		case r == '1' || r == '|' || r == 'i':
+			key.WriteRune('l')
+		default:
+			key.WriteRune(r)
+		}
+	}
+
+	return strings.NewReplacer("rn", "m", "vv", "w").Replace(key.String())
+}
+
+// IsReservedUsername returns true if the name (or a lookalike of it) is on the reserved list.
+func IsReservedUsername(name string) bool {
+	return reserved_keys[UsernameKey(name)]
+}
+
+// SuggestUsername turns an arbitrary display name (i.e. one provided by an OAuth provider) into
+// something that passes NormalizeUsername, by dropping unsupported characters and trimming it to
+// length. If nothing usable remains, "player" is returned.
+func SuggestUsername(name string) string {
+	name = FoldConfusables(norm.NFKC.String(strings.TrimSpace(name)))
+
+	var suggestion strings.Builder
+	for _, r := range name {
+		switch {
+		case r == ' ':
+			suggestion.WriteRune('_')
+		case is_username_rune(r):
+			suggestion.WriteRune(r)
+		}
+	}
+
+	result := strings.TrimFunc(suggestion.String(), is_separator)
+	if len(result) > USERNAME_MAX_LENGTH-4 {
+
+		// Leave room for a numeric suffix in case the name is taken
+		result = strings.TrimFunc(result[:USERNAME_MAX_LENGTH-4], is_separator)
+	}
+
+	if len(result) < USERNAME_MIN_LENGTH || IsReservedUsername(result) {
+		return "player"
+	}
+	return result
+}
+
+func is_username_rune(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || is_separator(r)
+}
+
+func is_separator(r rune) bool {
+	return r == '_' || r == '.' || r == '-'
+}
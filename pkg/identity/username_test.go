@@ -0,0 +1,88 @@
+package identity
+
+import "testing"
+
+func TestNormalizeUsername(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"Alice", "Alice", nil},
+		{"  bob_99 ", "bob_99", nil},
+		{"a.b-c", "a.b-c", nil},
+		{"ｈｅｌｌｏ", "hello", nil},
+		{"𝐡𝐞𝐥𝐥𝐨", "hello", nil},
+		{"Аlice", "Alice", nil}, // Cyrillic А
+		{"café", "cafe", nil},
+		{"x—y", "x-y", nil},
+		{"", "", ErrUsernameEmpty},
+		{"   ", "", ErrUsernameEmpty},
+		{"ab", "", ErrUsernameLength},
+		{"a_very_long_username_1", "", ErrUsernameLength},
+		{"bad name", "", ErrUsernameCharacters},
+		{"user@example", "", ErrUsernameCharacters},
+		{"Œuvre", "", ErrUsernameCharacters},
+		{"_lead", "", ErrUsernameSeparator},
+		{"trail.", "", ErrUsernameSeparator},
+		{"admin", "", ErrUsernameReserved},
+		{"ADMIN", "", ErrUsernameReserved},
+		{"Adm1n", "", ErrUsernameReserved},
+		{"ad.min", "", ErrUsernameReserved},
+		{"аdmin", "", ErrUsernameReserved}, // Cyrillic а
+		{"no-reply", "", ErrUsernameReserved},
+	}
+	for _, test := range cases {
+		got, err := NormalizeUsername(test.name)
+		if got != test.want || err != test.err {
+			t.Errorf("NormalizeUsername(%q) = %q, %v, want %q, %v", test.name, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestUsernameKey(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"alice", "allce"},
+		{"ALICE", "allce"},
+		{"AIice", "allce"},
+		{"al1ce", "allce"},
+		{"a.l-i_ce", "allce"},
+		{"Аlice", "allce"}, // Cyrillic А
+		{"ｈｅｌｌｏ", "hello"},
+		{"O0o", "ooo"},
+		{"modern", "modem"},
+		{"rnodern", "modem"},
+		{"vvave", "wave"},
+		{"wave", "wave"},
+	}
+	for _, test := range cases {
+		if got := UsernameKey(test.name); got != test.want {
+			t.Errorf("UsernameKey(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSuggestUsername(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"Jane Doe", "Jane_Doe"},
+		{"  ~~cool.guy~~ ", "cool.guy"},
+		{"a very long display name", "a_very_long_disp"},
+		{"李", "player"},
+		{"Admin", "player"},
+	}
+	for _, test := range cases {
+		got := SuggestUsername(test.name)
+		if got != test.want {
+			t.Errorf("SuggestUsername(%q) = %q, want %q", test.name, got, test.want)
+		}
+		if _, err := NormalizeUsername(got); err != nil {
+			t.Errorf("SuggestUsername(%q) = %q, which is invalid: %v", test.name, got, err)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package oauth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"time"
@@ -10,9 +12,13 @@ import (
 	"github.com/gofiber/fiber/v2/log"
 
 	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/identity"
 	"github.com/cloudlink-omega/accounts/pkg/sanitizer"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/cloudlink-omega/storage/pkg/bitfield"
+	"github.com/cloudlink-omega/storage/pkg/common"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	"github.com/gofiber/fiber/v2"
 	"github.com/oklog/ulid/v2"
@@ -98,33 +104,39 @@ func (s *OAuth) callback_oauth_flow(c *fiber.Ctx) error {
 		panic(err)
 	}
 
-	// Consult with the database
-	var provider_id string
-	switch api_user["id"].(type) {
-	case string:
-		provider_id = api_user["id"].(string)
-	default:
-		provider_id = fmt.Sprintf("%v", api_user["id"])
-	}
+	// Read the user's profile. Providers may omit or null out any of these fields.
+	profile := s.read_profile(c, provider, client, api_user)
 
 	// Try to find an existing user based on the provider
 	log.Debug("Trying to find user based on provider ", identity_provider)
-	user, err := s.DB.GetUserFromProvider(provider_id, identity_provider)
+	user, err := s.DB.GetUserFromProvider(profile.ID, identity_provider)
 	if err != nil {
 		panic(err)
 	}
 
 	// Try to find an existing user based on the email address
-	if user == nil {
+	if user == nil && profile.Email != "" {
 		log.Debug("Didn't find an existing user, trying to find by email")
-		user, err = s.DB.GetUserByEmail(api_user[provider.EmailKey].(string))
+		user, err = s.DB.GetUserByEmail(profile.Email)
 		if err != nil {
 			panic(err)
 		}
 
+		// Identities aren't linked to accounts that can't be logged into
+		if user != nil && database.UserBlocked(user) {
+			return c.Status(fiber.StatusForbidden).SendString("This account has been disabled.")
+		}
+
+		// Anyone can claim an address at a provider that doesn't verify it, or register an account with someone else's
+		// address before they do, so the owner of the account must confirm the link unless both sides verified it
+		if user != nil && (!profile.EmailVerified || !user.State.Read(constants.USER_IS_EMAIL_REGISTERED)) {
+			log.Debug("Found a match, but the email hasn't been verified on both sides. Asking the user to confirm the link")
+			return s.begin_link(c, user, identity_provider, profile, state_data.Redirect)
+		}
+
 		if user != nil {
 			log.Debug("Found a match, going to link user to provider")
-			if err := s.DB.LinkUserToProvider(user.ID, provider_id, identity_provider); err != nil {
+			if err := s.DB.LinkUserToProvider(user.ID, profile.ID, identity_provider); err != nil {
 				panic(fmt.Errorf("failed to link user: %w", err))
 			}
 		}
@@ -132,53 +144,398 @@ func (s *OAuth) callback_oauth_flow(c *fiber.Ctx) error {
 
 	// Create a new user if neither of the above worked
 	if user == nil {
-		log.Debug("Creating user")
-		user_id := ulid.Make()
-		var state bitfield.Bitfield8
-		state.Set(constants.USER_IS_EMAIL_REGISTERED)
-		state.Set(constants.USER_IS_ACTIVE)
-		state.Set(constants.USER_IS_OAUTH_ONLY)
 
-		// Create a 256-bit random secret key that's encrypted with the server's secret key.
-		userSecret, err := s.DB.CreateUserSecret()
-		if err != nil {
-			panic(fmt.Errorf("failed to create user secret: %w", err))
+		// Ask the user to fill in the blanks if the provider didn't give us an email, or the username can't be used
+		username, username_err := identity.NormalizeUsername(profile.Username)
+		taken := false
+		if username_err == nil {
+			if taken, err = s.DB.DoesNameExist(username); err != nil {
+				panic(err)
+			}
 		}
-
-		user = &types.User{
-			ID:       user_id.String(),
-			Username: api_user[provider.UsernameKey].(string),
-			Email:    api_user[provider.EmailKey].(string),
-			State:    state,
-			Secret:   userSecret,
+		if profile.Email == "" || username_err != nil || taken {
+			log.Debug("Missing details for a new user, beginning onboarding")
+			return s.begin_onboarding(c, identity_provider, profile, state_data.Redirect)
 		}
 
-		if err := s.DB.CreateUser(user); err != nil {
-			panic(fmt.Errorf("failed to create user: %w", err))
+		log.Debug("Creating user")
+		if user, err = s.create_user(identity_provider, profile.ID, username, profile.Email, profile.EmailVerified); err != nil {
+			panic(err)
 		}
+		log.Debug("User created")
 
-		if err := s.DB.LinkUserToProvider(user_id.String(), provider_id, identity_provider); err != nil {
-			panic(fmt.Errorf("failed to link user: %w", err))
+		// Addresses the provider didn't verify have to be verified like any other
+		if !profile.EmailVerified {
+			s.send_verification(c, user)
 		}
 
-		log.Debug("User created")
-
 	} else {
 		log.Debug("Found user")
 	}
 
+	next, err := s.finish_login(c, user, identity_provider, state_data.Redirect)
+	if errors.Is(err, database.ErrUserBlocked) {
+		return c.Status(fiber.StatusForbidden).SendString("This account has been disabled.")
+	} else if err != nil {
+		panic(err)
+	}
+
+	return c.Redirect(next, fiber.StatusSeeOther)
+}
+
+// Logs the user in after they've signed in with a provider, and returns the URL to send them to. If the account has
+// TOTP or a passkey, no session is created yet; the user is sent to the MFA page to provide their second factor.
+func (s *OAuth) finish_login(c *fiber.Ctx, user *types.User, identity_provider string, redirect string) (string, error) {
+
+	// Blocked and banned accounts can't be logged into
+	if database.UserBlocked(user) {
+		return "", database.ErrUserBlocked
+	}
+
+	has_mfa, err := s.DB.HasSecondFactor(user)
+	if err != nil {
+		return "", err
+	}
+
+	if has_mfa {
+		s.SetMFACookie(&structs.MFAPending{
+			UserID:   user.ID,
+			Provider: identity_provider,
+			Redirect: redirect,
+		}, time.Now().Add(MFA_PENDING_LIFETIME), c)
+		return fmt.Sprintf("%s%s/mfa", s.ServerURL, s.RouterPath), nil
+	}
+
 	// Create a new JWT for this user. Session expires in 24 hours.
 	if err := s.CreateSession(c, user, identity_provider, time.Now().Add(24*time.Hour)); err != nil {
-		panic(err)
+		return "", err
+	}
+
+	return s.redirect_url(redirect), nil
+}
+
+type OnboardingArgs struct {
+	Username string `json:"username" form:"username"`
+	Email    string `json:"email" form:"email"`
+}
+
+// Creates an account for an OAuth login that was missing details, using the details entered on the onboarding page.
+func (s *OAuth) finish_onboarding(c *fiber.Ctx) error {
+	onboarding, err := s.Auth.GetOnboarding(c)
+	if err != nil {
+		return api_result(c, fiber.StatusUnauthorized, "Your sign-in has expired. Please try again.", nil)
+	}
+
+	var args OnboardingArgs
+	if err := c.BodyParser(&args); err != nil {
+		return api_result(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	// The account may have been created already (i.e. the form was submitted twice)
+	user, err := s.DB.GetUserFromProvider(onboarding.ProviderID, onboarding.Provider)
+	if err != nil {
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	if user == nil {
+
+		// Check the requested username
+		username, err := identity.NormalizeUsername(args.Username)
+		if err != nil {
+			return api_result(c, fiber.StatusBadRequest, fmt.Sprintf("Invalid username: %s.", err), nil)
+		}
+		if exists, err := s.DB.DoesNameExist(username); err != nil {
+			return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+		} else if exists {
+			return api_result(c, fiber.StatusConflict, "That username is already taken. Try something else.", nil)
+		}
+
+		// Only accept an email address from the user if the provider didn't give us one
+		email_address := onboarding.Email
+		if email_address == "" {
+			if email_address, err = identity.NormalizeEmail(args.Email); err != nil {
+				return api_result(c, fiber.StatusBadRequest, fmt.Sprintf("Invalid email: %s.", err), nil)
+			}
+			if existing, err := s.DB.GetUserByEmail(email_address); err != nil {
+				return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+			} else if existing != nil {
+				return api_result(c, fiber.StatusConflict, "That email is already in use. Log in to that account instead.", nil)
+			}
+		}
+
+		// Emails entered by hand, or that the provider didn't verify, still need to be verified
+		verified := onboarding.Email != "" && onboarding.EmailVerified
+		if user, err = s.create_user(onboarding.Provider, onboarding.ProviderID, username, email_address, verified); errors.Is(err, database.ErrEmailInUse) {
+			return api_result(c, fiber.StatusConflict, "That email is already in use. Log in to that account instead.", nil)
+		} else if err != nil {
+			return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+		if !verified {
+			s.send_verification(c, user)
+		}
+	}
+
+	// Onboarding is over either way, so the cookie can't be used to get past the second factor of an existing account
+	s.ClearOnboardingCookie(c)
+
+	next, err := s.finish_login(c, user, onboarding.Provider, onboarding.Redirect)
+	if errors.Is(err, database.ErrUserBlocked) {
+		return api_result(c, fiber.StatusForbidden, "This account has been disabled.", nil)
+	} else if err != nil {
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	return api_result(c, fiber.StatusOK, "OK", next)
+}
+
+type profile struct {
+	ID            string
+	Username      string
+	Email         string
+	EmailVerified bool
+}
+
+// Reads the user's ID, username and email from the provider's account endpoint response. The email
+// is normalized, and left empty if the provider didn't return a usable one.
+func (s *OAuth) read_profile(c *fiber.Ctx, provider *structs.Provider, client *http.Client, api_user map[string]any) *profile {
+	p := &profile{}
+
+	switch id := api_user["id"].(type) {
+	case string:
+		p.ID = id
+	default:
+		p.ID = fmt.Sprintf("%v", id)
 	}
 
-	// Handle redirect
-	if state_data.Redirect != "" {
+	p.Username, _ = api_user[provider.UsernameKey].(string)
+	p.Email, _ = api_user[provider.EmailKey].(string)
+	if provider.VerifiedKey != "" {
+		p.EmailVerified, _ = api_user[provider.VerifiedKey].(bool)
+	}
+
+	// Some providers (i.e. GitHub) hide the email address unless it is public, so look it up separately
+	if provider.EmailsEndpoint != "" {
+		if email_address, verified, err := fetch_primary_email(client, provider.EmailsEndpoint); err != nil {
+			log.Warn("Failed to read email addresses from provider: ", err)
+		} else if email_address != "" {
+			p.Email, p.EmailVerified = email_address, verified
+		}
+	}
+
+	if normalized, err := identity.NormalizeEmail(p.Email); err == nil {
+		p.Email = normalized
+	} else {
+		p.Email = ""
+	}
+
+	return p
+}
+
+type provider_email struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+// Returns the primary email address from a GitHub-style email listing, preferring verified ones.
+func fetch_primary_email(client *http.Client, endpoint string) (string, bool, error) {
+	resp, err := client.Get(endpoint)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var emails []*provider_email
+	if err := json.NewDecoder(resp.Body).Decode(&emails); err != nil {
+		return "", false, err
+	}
+
+	var fallback *provider_email
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, true, nil
+		}
+		if e.Verified && fallback == nil {
+			fallback = e
+		}
+	}
+	if fallback != nil {
+		return fallback.Email, true, nil
+	}
+	return "", false, nil
+}
+
+// Stores the details of an incomplete OAuth login and sends the user to the onboarding page.
+func (s *OAuth) begin_onboarding(c *fiber.Ctx, identity_provider string, p *profile, redirect string) error {
+
+	// Suggest something close to the provider's username
+	suggestion, err := s.available_username(p.Username)
+	if err != nil {
+		suggestion = ""
+	}
+
+	// Onboarding expires in half an hour
+	s.SetOnboardingCookie(&structs.Onboarding{
+		Provider:      identity_provider,
+		ProviderID:    p.ID,
+		Email:         p.Email,
+		EmailVerified: p.EmailVerified,
+		Username:      suggestion,
+		Redirect:      redirect,
+	}, time.Now().Add(30*time.Minute), c)
+
+	return c.Redirect(fmt.Sprintf("%s%s/onboarding", s.ServerURL, s.RouterPath), fiber.StatusSeeOther)
+}
+
+// Creates a new OAuth-only user and links it to the provider.
+func (s *OAuth) create_user(identity_provider string, provider_id string, username string, email_address string, email_registered bool) (*types.User, error) {
+	user_id := ulid.Make()
+	var state bitfield.Bitfield8
+	if email_registered {
+		state.Set(constants.USER_IS_EMAIL_REGISTERED)
+	}
+	state.Set(constants.USER_IS_ACTIVE)
+	state.Set(constants.USER_IS_OAUTH_ONLY)
+
+	// Create a 256-bit random secret key that's encrypted with the server's secret key.
+	userSecret, err := s.DB.CreateUserSecret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user secret: %w", err)
+	}
+
+	user := &types.User{
+		ID:       user_id.String(),
+		Username: username,
+		Email:    email_address,
+		State:    state,
+		Secret:   userSecret,
+	}
+
+	if err := s.DB.CreateUser(user); err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	if err := s.DB.LinkUserToProvider(user.ID, provider_id, identity_provider); err != nil {
+		return nil, fmt.Errorf("failed to link user: %w", err)
+	}
+
+	// Log the event
+	common.LogEvent(s.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_created",
+		Details:    "Registered using " + identity_provider + " identity",
+		Successful: true,
+	})
+
+	return user, nil
+}
+
+// Sends the normal verification email to a new user whose address hasn't been verified. If email is disabled, the
+// address can't be verified, so it is accepted as is, like a local registration. Failures are logged rather than
+// returned, since the account exists either way and the user can ask for the email again.
+func (s *OAuth) send_verification(c *fiber.Ctx, user *types.User) {
+	if !s.MailConfig.Enabled {
+		user.State.Set(constants.USER_IS_EMAIL_REGISTERED)
+		if err := s.DB.UpdateUserState(user.ID, user.State); err != nil {
+			log.Warn("Failed to update user state: ", err)
+			return
+		}
+
+		// Log the event
+		common.LogEvent(s.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_verify_bypassed_disabled",
+			Details:    "",
+			Successful: true,
+		})
+		return
+	}
+
+	// Generate a random 6-digit verification code
+	code := fmt.Sprintf("%06d", rand.Intn(1000000))
+
+	// Store the verification code in the database, which will expire in 15 minutes.
+	err := s.DB.AddVerificationCode(user.ID, code, time.Now().Add(15*time.Minute))
+	if err == nil {
+
+		// Send the verification code to the user's email
+		err = s.Outbox.Send(&structs.EmailArgs{
+			To:       user.Email,
+			Nickname: s.ServerNickname,
+			Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+		}, email.TEMPLATE_VERIFY, map[string]any{
+			"Username": user.Username,
+			"Code":     code,
+		})
+	}
+	if err != nil {
+
+		// Log the event
+		common.LogEvent(s.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_verify_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+		return
+	}
+
+	// Log the event
+	common.LogEvent(s.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_verify_sent",
+		Details:    "",
+		Successful: true,
+	})
+}
+
+// Returns the URL to send the user to after logging in.
+func (s *OAuth) redirect_url(redirect string) string {
+	if redirect != "" {
 
 		// Return to the the root page with the redirect parameter so the user is aware of the successful login
-		return c.Redirect(fmt.Sprintf("%s%s?redirect=%s", s.ServerURL, s.RouterPath, state_data.Redirect), fiber.StatusSeeOther)
+		return fmt.Sprintf("%s%s?redirect=%s", s.ServerURL, s.RouterPath, redirect)
 	}
 
 	// Redirect to root
-	return c.Redirect(fmt.Sprintf("%s%s", s.ServerURL, s.RouterPath), fiber.StatusSeeOther)
+	return fmt.Sprintf("%s%s", s.ServerURL, s.RouterPath)
+}
+
+func api_result(c *fiber.Ctx, status int, result string, data any, event_id ...string) error {
+	if len(event_id) > 0 && event_id[0] != "" {
+		return c.Status(status).JSON(fiber.Map{"result": result, "data": data, "event_id": event_id[0]})
+	}
+	return c.Status(status).JSON(fiber.Map{"result": result, "data": data})
+}
+
+// Returns a valid, unused username based on the one provided by an identity provider. If the name is
+// invalid it is cleaned up, and if it is taken a random numeric suffix is added.
+func (s *OAuth) available_username(requested string) (string, error) {
+	base, err := identity.NormalizeUsername(requested)
+	if err != nil {
+		base = identity.SuggestUsername(requested)
+	}
+
+	candidate := base
+	for range 10 {
+		exists, err := s.DB.DoesNameExist(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+
+		// Leave room for the suffix
+		if len(base) > identity.USERNAME_MAX_LENGTH-4 {
+			base = base[:identity.USERNAME_MAX_LENGTH-4]
+		}
+		candidate = fmt.Sprintf("%s%04d", base, rand.Intn(10000))
+	}
+
+	return "", errors.New("no available username found")
 }
@@ -0,0 +1,215 @@
+package oauth
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	scrypt "github.com/elithrar/simple-scrypt"
+	"github.com/gofiber/fiber/v2"
+)
+
+type LinkArgs struct {
+	Password string `json:"password" form:"password"`
+	Code     string `json:"code" form:"code"`
+}
+
+// Stores an OAuth identity whose email matches an existing account, and sends the user to the link page so that
+// the owner of the account can confirm the link. This is required whenever the provider or the account hasn't verified
+// the email.
+func (s *OAuth) begin_link(c *fiber.Ctx, user *types.User, identity_provider string, p *profile, redirect string) error {
+
+	// Log the event
+	common.LogEvent(s.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_link_pending",
+		Details:    identity_provider + " identity requested to be linked",
+		Successful: true,
+	})
+
+	// Linking expires in half an hour
+	s.SetLinkCookie(&structs.LinkRequest{
+		UserID:     user.ID,
+		Provider:   identity_provider,
+		ProviderID: p.ID,
+		Password:   !user.State.Read(constants.USER_IS_OAUTH_ONLY) && user.Password != "",
+		Code:       s.MailConfig.Enabled && !user.State.Read(constants.USER_IS_EMAIL_DISABLED),
+		Redirect:   redirect,
+	}, time.Now().Add(30*time.Minute), c)
+
+	return c.Redirect(fmt.Sprintf("%s%s/link", s.ServerURL, s.RouterPath), fiber.StatusSeeOther)
+}
+
+// Emails a code to the address of the account being linked.
+func (s *OAuth) send_link_code(c *fiber.Ctx) error {
+	link, err := s.Auth.GetLinkRequest(c)
+	if err != nil {
+		return api_result(c, fiber.StatusUnauthorized, "Your sign-in has expired. Please try again.", nil)
+	}
+
+	if !link.Code {
+		return api_result(c, fiber.StatusBadRequest, "Email codes are not available for this account.", nil)
+	}
+
+	user, err := s.DB.GetUser(link.UserID)
+	if err != nil {
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Remove any previous codes so that only the latest one is valid
+	if err := s.DB.DeleteVerificationCodes(user.ID); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(s.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_link_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Generate a random 6-digit verification code
+	code := fmt.Sprintf("%06d", rand.Intn(1000000))
+
+	// Store the verification code in the database, with a 15 minute expiration
+	if err := s.DB.AddVerificationCode(user.ID, code, time.Now().Add(15*time.Minute)); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(s.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_link_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Send the verification code to the user's email
+	if err := s.Outbox.Send(&structs.EmailArgs{
+		To:       user.Email,
+		Nickname: s.ServerNickname,
+		Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+	}, email.TEMPLATE_LINK_CODE, map[string]any{
+		"Username": user.Username,
+		"Provider": link.Provider,
+		"Code":     code,
+	}); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(s.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_link_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	return api_result(c, fiber.StatusOK, "OK", nil)
+}
+
+// Links the pending OAuth identity to the account once the user has confirmed ownership of it, and logs them in.
+func (s *OAuth) confirm_link(c *fiber.Ctx) error {
+	link, err := s.Auth.GetLinkRequest(c)
+	if err != nil {
+		return api_result(c, fiber.StatusUnauthorized, "Your sign-in has expired. Please try again.", nil)
+	}
+
+	var args LinkArgs
+	if err := c.BodyParser(&args); err != nil {
+		return api_result(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	user, err := s.DB.GetUser(link.UserID)
+	if err != nil {
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Identities aren't linked to accounts that can't be logged into
+	if database.UserBlocked(user) {
+		return api_result(c, fiber.StatusForbidden, "This account has been disabled.", nil)
+	}
+
+	// Confirm ownership of the account using either the password or an emailed code
+	switch {
+	case args.Password != "" && link.Password:
+		if scrypt.CompareHashAndPassword([]byte(user.Password), []byte(args.Password)) != nil {
+
+			// Log the event
+			event_id := common.LogEvent(s.DB.DB, &types.UserEvent{
+				UserID:     user.ID,
+				EventID:    "user_link_failure",
+				Details:    "Invalid password",
+				Successful: false,
+			})
+
+			return api_result(c, fiber.StatusUnauthorized, "Invalid password.", nil, event_id)
+		}
+
+	case args.Code != "" && link.Code:
+		valid, err := s.DB.VerifyCode(user.ID, args.Code)
+		if err != nil {
+			return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+		if !valid {
+
+			// Log the event
+			event_id := common.LogEvent(s.DB.DB, &types.UserEvent{
+				UserID:     user.ID,
+				EventID:    "user_link_failure",
+				Details:    "Invalid verification code",
+				Successful: false,
+			})
+
+			return api_result(c, fiber.StatusUnauthorized, "Invalid verification code.", nil, event_id)
+		}
+		if err := s.DB.DeleteVerificationCodes(user.ID); err != nil {
+			return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+
+	default:
+		return api_result(c, fiber.StatusBadRequest, "Please enter your password or a verification code.", nil)
+	}
+
+	// The identity may have been linked already (i.e. the form was submitted twice)
+	existing, err := s.DB.GetUserFromProvider(link.ProviderID, link.Provider)
+	if err != nil {
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if existing == nil {
+		if err := s.DB.LinkUserToProvider(user.ID, link.ProviderID, link.Provider); err != nil {
+			return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+	} else if existing.ID != user.ID {
+		return api_result(c, fiber.StatusConflict, "This sign-in method is already linked to another account.", nil)
+	}
+
+	// Log the event
+	common.LogEvent(s.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_link_success",
+		Details:    "Linked " + link.Provider + " identity",
+		Successful: true,
+	})
+
+	next, err := s.finish_login(c, user, link.Provider, link.Redirect)
+	if errors.Is(err, database.ErrUserBlocked) {
+		return api_result(c, fiber.StatusForbidden, "This account has been disabled.", nil)
+	} else if err != nil {
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	s.ClearLinkCookie(c)
+
+	return api_result(c, fiber.StatusOK, "OK", next)
+}
@@ -5,41 +5,64 @@ import (
 
 	"github.com/cloudlink-omega/accounts/pkg/authorization"
 	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/device"
 	"github.com/cloudlink-omega/accounts/pkg/domain"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/proxy"
+	"github.com/cloudlink-omega/accounts/pkg/ratelimit"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/oklog/ulid/v2"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
+// How long a user has to provide their second factor after signing in with a provider.
+const MFA_PENDING_LIFETIME = 10 * time.Minute
+
 type OAuth struct {
-	RouterPath   string
-	APIDomain    string
-	EnforceHTTPS bool
-	Providers    map[string]*structs.Provider
-	ServerURL    string
-	Routes       func(fiber.Router)
-	Auth         *authorization.Auth
-	DB           *database.Database
+	RouterPath     string
+	APIDomain      string
+	EnforceHTTPS   bool
+	Providers      map[string]*structs.Provider
+	ServerURL      string
+	ServerNickname string
+	MailConfig     *structs.MailConfig
+	Outbox         *email.Outbox
+	Routes         func(fiber.Router)
+	Auth           *authorization.Auth
+	DB             *database.Database
+	LoginAlerts    *device.Alerts
+	RateLimiter    *ratelimit.Limiter // Shared with the API versions by accounts.New.
+	RateLimits     ratelimit.Policies // Rate limit of each route, relative to where OAuth is mounted.
 }
 
-func New(router_path string, server_url string, enforce_https bool, api_domain string, server_secret string, db *database.Database) *OAuth {
+func New(router_path string, server_url string, enforce_https bool, api_domain string, server_secret string, db *database.Database, mail_config *structs.MailConfig, outbox *email.Outbox, nickname string) *OAuth {
 
 	// Create new instance
 	s := &OAuth{
-		RouterPath:   router_path,
-		Providers:    make(map[string]*structs.Provider),
-		ServerURL:    server_url,
-		EnforceHTTPS: enforce_https,
-		APIDomain:    api_domain,
-		Auth:         authorization.New(server_url, server_secret, db),
-		DB:           db,
+		RouterPath:     router_path,
+		Providers:      make(map[string]*structs.Provider),
+		ServerURL:      server_url,
+		ServerNickname: nickname,
+		MailConfig:     mail_config,
+		Outbox:         outbox,
+		EnforceHTTPS:   enforce_https,
+		APIDomain:      api_domain,
+		Auth:           authorization.New(server_url, server_secret, db),
+		DB:             db,
+		RateLimiter:    ratelimit.New(nil),
+		RateLimits:     DefaultRateLimits(),
 	}
 
 	// Configure default handler for OAuth endpoints
 	s.Routes = func(router fiber.Router) {
+		router.Use(s.rate_limit)
+		router.Post("/onboarding", s.finish_onboarding)
+		router.Post("/link", s.confirm_link)
+		router.Post("/link/send-code", s.send_link_code)
 		router.Get("/:provider", s.begin_oauth_flow)
 		router.Get("/:provider/callback", s.callback_oauth_flow)
 	}
@@ -56,6 +79,8 @@ func (s *OAuth) SetCookie(user *types.User, session_id string, identity_provider
 		Username:         user.Username,
 		ULID:             user.ID,
 		IdentityProvider: identity_provider,
+		AuthTime:         jwt.NewNumericDate(time.Now()),
+		AMR:              []string{structs.AMR_FEDERATED},
 	}, expiration)
 	c.Cookie(&fiber.Cookie{
 		Name:     "clomega-authorization",
@@ -68,6 +93,67 @@ func (s *OAuth) SetCookie(user *types.User, session_id string, identity_provider
 	})
 }
 
+func (s *OAuth) SetMFACookie(pending *structs.MFAPending, expiration time.Time, c *fiber.Ctx) {
+	token := s.Auth.Create(pending, expiration)
+	c.Cookie(&fiber.Cookie{
+		Name:     "clomega-mfa",
+		Value:    token,
+		Path:     "/",
+		Expires:  expiration,
+		Secure:   s.EnforceHTTPS,
+		Domain:   domain.GetDomain(c.Hostname()),
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
+
+func (s *OAuth) SetOnboardingCookie(onboarding *structs.Onboarding, expiration time.Time, c *fiber.Ctx) {
+	token := s.Auth.Create(onboarding, expiration)
+	c.Cookie(&fiber.Cookie{
+		Name:     "clomega-onboarding",
+		Value:    token,
+		Path:     "/",
+		Expires:  expiration,
+		Secure:   s.EnforceHTTPS,
+		Domain:   domain.GetDomain(c.Hostname()),
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
+
+func (s *OAuth) ClearOnboardingCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "clomega-onboarding",
+		Path:     "/",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		Secure:   true,
+		Domain:   domain.GetDomain(c.Hostname()),
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
+
+func (s *OAuth) SetLinkCookie(link *structs.LinkRequest, expiration time.Time, c *fiber.Ctx) {
+	token := s.Auth.Create(link, expiration)
+	c.Cookie(&fiber.Cookie{
+		Name:     "clomega-link",
+		Value:    token,
+		Path:     "/",
+		Expires:  expiration,
+		Secure:   s.EnforceHTTPS,
+		Domain:   domain.GetDomain(c.Hostname()),
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
+
+func (s *OAuth) ClearLinkCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "clomega-link",
+		Path:     "/",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		Secure:   true,
+		Domain:   domain.GetDomain(c.Hostname()),
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
+
 func (s *OAuth) Discord(client_id string, client_secret string) {
 	s.create_oauth_provider(
 		"discord",
@@ -77,6 +163,7 @@ func (s *OAuth) Discord(client_id string, client_secret string) {
 		"https://discord.com/api/users/@me",
 		"username",
 		"email",
+		"verified",
 		oauth2.Endpoint{
 			AuthURL:  "https://discord.com/api/oauth2/authorize",
 			TokenURL: "https://discord.com/api/oauth2/token",
@@ -93,6 +180,7 @@ func (s *OAuth) Google(client_id string, client_secret string) {
 		"https://www.googleapis.com/oauth2/v1/userinfo",
 		"name",
 		"email",
+		"verified_email",
 		google.Endpoint,
 	)
 }
@@ -106,18 +194,23 @@ func (s *OAuth) GitHub(client_id string, client_secret string) {
 		"https://api.github.com/user",
 		"name",
 		"email",
+		"",
 		oauth2.Endpoint{
 			AuthURL:  "https://github.com/login/oauth/authorize",
 			TokenURL: "https://github.com/login/oauth/access_token",
 		},
 	)
+
+	// GitHub only returns the public email address (if any) from the user endpoint
+	s.Providers["github"].EmailsEndpoint = "https://api.github.com/user/emails"
 }
 
-func (s *OAuth) create_oauth_provider(provider string, client_id string, client_secret string, scopes []string, userapi string, usernamekey string, emailkey string, endpoint oauth2.Endpoint) {
+func (s *OAuth) create_oauth_provider(provider string, client_id string, client_secret string, scopes []string, userapi string, usernamekey string, emailkey string, verifiedkey string, endpoint oauth2.Endpoint) {
 	s.Providers[provider] = &structs.Provider{
 		AccountEndpoint: userapi,
 		UsernameKey:     usernamekey,
 		EmailKey:        emailkey,
+		VerifiedKey:     verifiedkey,
 		OAuthConfig: &oauth2.Config{
 			ClientID:     client_id,
 			ClientSecret: client_secret,
@@ -131,10 +224,11 @@ func (s *OAuth) CreateSession(c *fiber.Ctx, user *types.User, identity_provider
 	sessionID := ulid.Make()
 
 	// Store the session ID in the database
-	err := s.DB.CreateSession(user, sessionID.String(), string(c.Request().Header.Peek("Origin")), string(c.Request().Header.Peek("User-Agent")), c.IP(), session_expiry)
+	err := s.DB.CreateSession(user, sessionID.String(), string(c.Request().Header.Peek("Origin")), string(c.Request().Header.Peek("User-Agent")), proxy.ClientIP(c), session_expiry)
 	if err != nil {
 		return err
 	}
 	s.SetCookie(user, sessionID.String(), identity_provider, session_expiry, c)
+	s.LoginAlerts.CheckLogin(c, user, sessionID.String())
 	return nil
 }
@@ -0,0 +1,41 @@
+package oauth
+
+import (
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/ratelimit"
+	"github.com/gofiber/fiber/v2"
+)
+
+// DefaultRateLimits returns the rate limits used when none are configured. Linking takes a password or an emailed
+// code, so it is limited as tightly as logging in, and per account as well so that codes can't be guessed from many
+// addresses. Providers and their callbacks fall under the default route.
+func DefaultRateLimits() ratelimit.Policies {
+	return ratelimit.Policies{
+		ratelimit.DEFAULT_ROUTE: {Max: 30, Window: time.Minute, Key: ratelimit.KEY_IP},
+		"/onboarding":           {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_IP},
+		"/link":                 {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_BOTH},
+		"/link/send-code":       {Max: 5, Window: 10 * time.Minute, Key: ratelimit.KEY_BOTH},
+	}
+}
+
+// Applies the rate limit policy of the requested route.
+func (s *OAuth) rate_limit(c *fiber.Ctx) error {
+	allowed, err := s.RateLimiter.Allow(c, "oauth", s.RateLimits, s.rate_limit_account)
+	if err != nil {
+		return api_result(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if !allowed {
+		return api_result(c, fiber.StatusTooManyRequests, "You're going too damn fast! Please slow down your requests.", nil)
+	}
+	return c.Next()
+}
+
+// Identifies the account being linked for rate limits that are kept per account. Nobody is logged in yet during
+// the OAuth flow.
+func (s *OAuth) rate_limit_account(c *fiber.Ctx) string {
+	if link, err := s.Auth.GetLinkRequest(c); err == nil {
+		return link.UserID
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package pages
+
+import (
+	"slices"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/sanitizer"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Placeholder values for every field used by the email templates.
+func (p *Pages) email_preview_data() map[string]any {
+	return map[string]any{
+		"ServerName":  p.ServerName,
+		"Username":    "ExampleUser",
+		"Code":        "123456",
+		"Provider":    "github",
+		"NewEmail":    "new.address@example.com",
+		"Days":        7,
+		"Link":        p.ServerURL + p.RouterPath + "/",
+		"Date":        "January 2, 2006 at 15:04 UTC",
+		"Change":      "password",
+		"IP":          "203.0.113.7",
+		"UserAgent":   "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Firefox/128.0",
+		"Device":      "Firefox 128 on Windows",
+		"Location":    "Berlin, Germany",
+		"NewDevice":   true,
+		"NewLocation": true,
+	}
+}
+
+// Only server admins may preview emails. Returns the error to show if the user isn't one.
+func (p *Pages) require_admin(c *fiber.Ctx) *fiber.Error {
+	claims := p.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Please log in or register.",
+		}
+	}
+
+	user, err := p.DB.GetUser(claims.ULID)
+	if err != nil {
+		return &fiber.Error{
+			Code:    fiber.StatusInternalServerError,
+			Message: err.Error(),
+		}
+	}
+
+	if !user.State.Read(constants.USER_IS_ADMIN) {
+		return &fiber.Error{
+			Code:    fiber.StatusForbidden,
+			Message: "You do not have permission to view this page.",
+		}
+	}
+
+	return nil
+}
+
+func (p *Pages) EmailPreviewIndex(c *fiber.Ctx) error {
+	if err := p.require_admin(c); err != nil {
+		return p.ErrorPage(c, err)
+	}
+
+	data := map[string]any{
+		"BaseURL":        p.RouterPath,
+		"ServerName":     p.ServerName,
+		"PrimaryWebsite": p.PrimaryWebsite,
+		"Redirect":       sanitizer.Sanitized(c, c.Query("redirect")),
+		"Templates":      email.Templates(),
+		"Locales":        email.Locales(),
+	}
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.Render("views/email_preview", data, "views/layout")
+}
+
+func (p *Pages) EmailPreview(c *fiber.Ctx) error {
+	if err := p.require_admin(c); err != nil {
+		return p.ErrorPage(c, err)
+	}
+
+	name := c.Params("template")
+	if !slices.Contains(email.Templates(), name) {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusNotFound,
+			Message: "Unknown email template.",
+		})
+	}
+
+	locale := c.Query("locale", email.DEFAULT_LOCALE)
+	message, err := email.Render(name, locale, p.email_preview_data())
+	if err != nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	if c.Query("format") == "text" {
+		c.Context().SetContentType("text/plain; charset=utf-8")
+		return c.SendString("Subject: " + message.Subject + "\n\n" + message.Text)
+	}
+
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.SendString(message.HTML)
+}
@@ -0,0 +1,32 @@
+package pages
+
+import (
+	"github.com/cloudlink-omega/accounts/pkg/sanitizer"
+	"github.com/gofiber/fiber/v2"
+)
+
+func (p *Pages) Export(c *fiber.Ctx) error {
+
+	// Require a login
+	claims := p.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Please log in or register.",
+		})
+	}
+
+	// Sensitive changes require a recent login
+	if !p.Auth.RecentlyAuthenticated(claims) {
+		return p.reauth_redirect(c)
+	}
+
+	data := map[string]any{
+		"BaseURL":        p.RouterPath,
+		"ServerName":     p.ServerName,
+		"PrimaryWebsite": p.PrimaryWebsite,
+		"Redirect":       sanitizer.Sanitized(c, c.Query("redirect")),
+	}
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.Render("views/export", data, "views/layout")
+}
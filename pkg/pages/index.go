@@ -16,6 +16,7 @@ func (p *Pages) Index(c *fiber.Ctx) error {
 			"ServerName":     p.ServerName,
 			"PrimaryWebsite": p.PrimaryWebsite,
 			"OAuthOnly":      user.State.Read(constants.USER_IS_OAUTH_ONLY),
+			"TOTP":           user.State.Read(constants.USER_IS_TOTP_ENABLED),
 			"Profile":        "/assets/static/img/placeholder.png",
 			"User":           user.Username,
 			"VerifyRequired": !user.State.Read(constants.USER_IS_EMAIL_REGISTERED),
@@ -0,0 +1,37 @@
+package pages
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+func (p *Pages) Link(c *fiber.Ctx) error {
+
+	// Require an OAuth login waiting to be linked
+	link, err := p.Auth.GetLinkRequest(c)
+	if err != nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Your sign-in has expired. Please try signing in again.",
+		})
+	}
+
+	// Without a password or email, there's no way to prove ownership of the account
+	if !link.Password && !link.Code {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusForbidden,
+			Message: "An account with this email already exists, but we can't confirm that it belongs to you. Please log in using your existing sign-in method.",
+		})
+	}
+
+	data := map[string]any{
+		"BaseURL":        p.RouterPath,
+		"ServerName":     p.ServerName,
+		"PrimaryWebsite": p.PrimaryWebsite,
+		"Redirect":       link.Redirect,
+		"Provider":       provider_names[link.Provider],
+		"Password":       link.Password,
+		"Code":           link.Code,
+	}
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.Render("views/link", data, "views/layout")
+}
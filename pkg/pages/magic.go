@@ -0,0 +1,23 @@
+package pages
+
+import (
+	"github.com/cloudlink-omega/accounts/pkg/sanitizer"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Magic lets users request a sign-in link by email, and is where the link lands. The link is only used once the
+// user presses continue, since some mail clients open links in emails before the user does.
+func (p *Pages) Magic(c *fiber.Ctx) error {
+	if !p.Auth.ValidFromNormal(c) {
+		data := map[string]any{
+			"BaseURL":        p.RouterPath,
+			"ServerName":     p.ServerName,
+			"PrimaryWebsite": p.PrimaryWebsite,
+			"Redirect":       sanitizer.Sanitized(c, c.Query("redirect")),
+			"Token":          c.Query("token"),
+		}
+		c.Context().SetContentType("text/html; charset=utf-8")
+		return c.Render("views/magic", data, "views/layout")
+	}
+	return c.Redirect(p.RouterPath)
+}
@@ -0,0 +1,47 @@
+package pages
+
+import (
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/gofiber/fiber/v2"
+)
+
+// MFA asks for the second factor of an account after the user has signed in with an OAuth provider.
+func (p *Pages) MFA(c *fiber.Ctx) error {
+
+	// Require an OAuth login waiting for a second factor
+	pending, err := p.Auth.GetMFAPending(c)
+	if err != nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Your sign-in has expired. Please try signing in again.",
+		})
+	}
+
+	user, err := p.DB.GetUser(pending.UserID)
+	if err != nil || user == nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Your sign-in has expired. Please try signing in again.",
+		})
+	}
+
+	webauthn, err := p.DB.HasWebAuthnCredentials(user.ID)
+	if err != nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	data := map[string]any{
+		"BaseURL":        p.RouterPath,
+		"ServerName":     p.ServerName,
+		"PrimaryWebsite": p.PrimaryWebsite,
+		"Redirect":       pending.Redirect,
+		"Provider":       provider_names[pending.Provider],
+		"TOTP":           user.State.Read(constants.USER_IS_TOTP_ENABLED),
+		"WebAuthn":       webauthn,
+	}
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.Render("views/mfa", data, "views/layout")
+}
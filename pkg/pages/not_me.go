@@ -0,0 +1,23 @@
+package pages
+
+import "github.com/gofiber/fiber/v2"
+
+// NotMe lets a user log out a session from the link in a login alert, if it wasn't them who logged in.
+func (p *Pages) NotMe(c *fiber.Ctx) error {
+	if c.Query("token") == "" {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusBadRequest,
+			Message: "This link is invalid or has expired.",
+		})
+	}
+
+	data := map[string]any{
+		"BaseURL":        p.RouterPath,
+		"ServerName":     p.ServerName,
+		"PrimaryWebsite": p.PrimaryWebsite,
+		"Redirect":       "",
+		"Token":          c.Query("token"),
+	}
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.Render("views/not_me", data, "views/layout")
+}
@@ -0,0 +1,35 @@
+package pages
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+var provider_names = map[string]string{
+	"google":  "Google",
+	"github":  "GitHub",
+	"discord": "Discord",
+}
+
+func (p *Pages) Onboarding(c *fiber.Ctx) error {
+
+	// Require an OAuth login in progress
+	onboarding, err := p.Auth.GetOnboarding(c)
+	if err != nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Your sign-in has expired. Please try signing in again.",
+		})
+	}
+
+	data := map[string]any{
+		"BaseURL":        p.RouterPath,
+		"ServerName":     p.ServerName,
+		"PrimaryWebsite": p.PrimaryWebsite,
+		"Redirect":       onboarding.Redirect,
+		"Provider":       provider_names[onboarding.Provider],
+		"Username":       onboarding.Username,
+		"EmailRequired":  onboarding.Email == "",
+	}
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.Render("views/onboarding", data, "views/layout")
+}
@@ -3,6 +3,7 @@ package pages
 import (
 	"github.com/cloudlink-omega/accounts/pkg/authorization"
 	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/device"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/gofiber/fiber/v2"
 )
@@ -18,6 +19,7 @@ type Pages struct {
 	Auth           *authorization.Auth
 	DB             *database.Database
 	Providers      map[string]*structs.Provider
+	GeoIP          *device.GeoIP
 }
 
 func New(router_path string, server_url string, api_url string, server_name string, primary_website string, server_secret string, db *database.Database) *Pages {
@@ -36,12 +38,28 @@ func New(router_path string, server_url string, api_url string, server_name stri
 	// Configure routes
 	p.Routes = func(router fiber.Router) {
 		router.Get("/register", p.Register)
+		router.Get("/admin/email-preview", p.EmailPreviewIndex)
+		router.Get("/admin/email-preview/:template", p.EmailPreview)
 		router.Get("/login", p.Login)
+		router.Get("/change-email", p.ChangeEmail)
+		router.Get("/change-username", p.ChangeUsername)
+		router.Get("/delete-account", p.DeleteAccount)
+		router.Get("/export", p.Export)
+		router.Get("/link", p.Link)
 		router.Get("/logout", p.Logout)
+		router.Get("/magic", p.Magic)
+		router.Get("/mfa", p.MFA)
+		router.Get("/not-me", p.NotMe)
+		router.Get("/onboarding", p.Onboarding)
+		router.Get("/reauth", p.Reauth)
 		router.Get("/recovery", p.RecoveryLanding)
 		router.Get("/reset", p.ResetPassword)
+		router.Get("/revert-email", p.RevertEmail)
+		router.Get("/sessions", p.Sessions)
+		router.Get("/totp", p.ManageTOTP)
 		router.Get("/totp_enroll", p.EnrollTOTP)
 		router.Get("/verify", p.Verify)
+		router.Get("/webauthn", p.WebAuthn)
 		router.Get("/", p.Index)
 	}
 
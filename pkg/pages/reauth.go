@@ -0,0 +1,66 @@
+package pages
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Reauth asks the logged in user to confirm it's them before making sensitive changes, then sends them back to the
+// page they came from.
+func (p *Pages) Reauth(c *fiber.Ctx) error {
+
+	// Require a login
+	claims := p.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Please log in or register.",
+		})
+	}
+
+	user, err := p.DB.GetUser(claims.ULID)
+	if err != nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	webauthn, err := p.DB.HasWebAuthnCredentials(user.ID)
+	if err != nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	data := map[string]any{
+		"BaseURL":        p.RouterPath,
+		"ServerName":     p.ServerName,
+		"PrimaryWebsite": p.PrimaryWebsite,
+		"Redirect":       "",
+		"Return":         p.return_path(c.Query("return")),
+		"OAuthOnly":      user.State.Read(constants.USER_IS_OAUTH_ONLY),
+		"TOTP":           user.State.Read(constants.USER_IS_TOTP_ENABLED),
+		"WebAuthn":       webauthn,
+	}
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.Render("views/reauth", data, "views/layout")
+}
+
+// Sends the user to the re-authentication page if they haven't logged in or confirmed it's them recently, so they
+// can use the current page.
+func (p *Pages) reauth_redirect(c *fiber.Ctx) error {
+	return c.Redirect(p.RouterPath + "/reauth?return=" + url.QueryEscape(c.OriginalURL()))
+}
+
+// Only allows returning to a page on this server after re-authenticating.
+func (p *Pages) return_path(path string) string {
+	if !strings.HasPrefix(path, p.RouterPath+"/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return p.RouterPath + "/"
+	}
+	return path
+}
@@ -11,6 +11,8 @@ func (p *Pages) RecoveryLanding(c *fiber.Ctx) error {
 		"ServerName":     p.ServerName,
 		"PrimaryWebsite": p.PrimaryWebsite,
 		"Redirect":       sanitizer.Sanitized(c, c.Query("redirect")),
+		"Email":          c.Query("email"),
+		"CodeSent":       c.QueryBool("sent"),
 	}
 	c.Context().SetContentType("text/html; charset=utf-8")
 	return c.Render("views/recovery", data, "views/layout")
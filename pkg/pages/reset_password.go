@@ -23,6 +23,11 @@ func (p *Pages) ResetPassword(c *fiber.Ctx) error {
 	var user *types.User
 	if p.Auth.ValidFromNormal(c) {
 		claims = p.Auth.GetNormalClaims(c)
+
+		// Changing the password requires a recent login, unless recovering the account
+		if !p.Auth.RecentlyAuthenticated(claims) {
+			return p.reauth_redirect(c)
+		}
 	} else if p.Auth.ValidFromRecovery(c) {
 		claims = p.Auth.GetRecoveryClaims(c)
 	} else {
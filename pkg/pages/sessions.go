@@ -0,0 +1,68 @@
+package pages
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/device"
+	"github.com/cloudlink-omega/accounts/pkg/sanitizer"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+	"github.com/oklog/ulid/v2"
+)
+
+// A session as it is listed on the sessions page.
+type session_entry struct {
+	ID        string
+	Current   bool
+	Device    *device.Details
+	IP        string
+	CreatedAt time.Time
+}
+
+func (p *Pages) Sessions(c *fiber.Ctx) error {
+
+	// Require a login
+	claims := p.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Please log in or register to manage your sessions.",
+		})
+	}
+
+	records, err := p.DB.GetAllSessions(claims.ULID)
+	if err != nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	// Session IDs are ULIDs, so they sort by when the session was created
+	slices.SortFunc(records, func(a, b *types.UserSession) int { return strings.Compare(b.ID, a.ID) })
+
+	sessions := make([]*session_entry, len(records))
+	for i, record := range records {
+		sessions[i] = &session_entry{
+			ID:      record.ID,
+			Current: record.ID == claims.SessionID,
+			Device:  p.GeoIP.Describe(record.UserAgent, record.IP),
+			IP:      record.IP,
+		}
+		if id, err := ulid.Parse(record.ID); err == nil {
+			sessions[i].CreatedAt = ulid.Time(id.Time())
+		}
+	}
+
+	data := map[string]any{
+		"BaseURL":        p.RouterPath,
+		"ServerName":     p.ServerName,
+		"PrimaryWebsite": p.PrimaryWebsite,
+		"Redirect":       sanitizer.Sanitized(c, c.Query("redirect")),
+		"Sessions":       sessions,
+	}
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.Render("views/sessions", data, "views/layout")
+}
@@ -0,0 +1,48 @@
+package pages
+
+import (
+	"net/url"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/sanitizer"
+	"github.com/gofiber/fiber/v2"
+)
+
+func (p *Pages) ManageTOTP(c *fiber.Ctx) error {
+
+	// Require a login
+	claims := p.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusUnauthorized,
+			Message: "Please log in or register to manage TOTP.",
+		})
+	}
+
+	// Sensitive changes require a recent login
+	if !p.Auth.RecentlyAuthenticated(claims) {
+		return p.reauth_redirect(c)
+	}
+
+	user, err := p.DB.GetUser(claims.ULID)
+	if err != nil {
+		return p.ErrorPage(c, &fiber.Error{
+			Code:    fiber.StatusInternalServerError,
+			Message: err.Error(),
+		})
+	}
+
+	// Nothing to manage yet
+	if !user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		return c.Redirect(p.RouterPath + "/totp_enroll?redirect=" + url.QueryEscape(c.Query("redirect")))
+	}
+
+	data := map[string]any{
+		"BaseURL":        p.RouterPath,
+		"ServerName":     p.ServerName,
+		"PrimaryWebsite": p.PrimaryWebsite,
+		"Redirect":       sanitizer.Sanitized(c, c.Query("redirect")),
+	}
+	c.Context().SetContentType("text/html; charset=utf-8")
+	return c.Render("views/totp", data, "views/layout")
+}
@@ -30,20 +30,19 @@ func (p *Pages) EnrollTOTP(c *fiber.Ctx) error {
 		})
 	}
 
-	// Check if the user is using an OAuth provider
-	user, _ = p.DB.GetUser(claims.ULID)
-	if user.State.Read(constants.USER_IS_OAUTH_ONLY) {
-		return p.ErrorPage(c, &fiber.Error{
-			Code:    fiber.StatusBadRequest,
-			Message: "You are using an OAuth provider for your account. Please use your OAuth provider to enroll a TOTP device.",
-		})
+	// Sensitive changes require a recent login
+	if !p.Auth.RecentlyAuthenticated(claims) {
+		return p.reauth_redirect(c)
 	}
 
+	user, _ = p.DB.GetUser(claims.ULID)
+
 	data := map[string]any{
 		"BaseURL":        p.RouterPath,
 		"ServerName":     p.ServerName,
 		"PrimaryWebsite": p.PrimaryWebsite,
 		"Redirect":       sanitizer.Sanitized(c, c.Query("redirect")),
+		"TOTP":           user.State.Read(constants.USER_IS_TOTP_ENABLED),
 	}
 	c.Context().SetContentType("text/html; charset=utf-8")
 	return c.Render("views/totp_enroll", data, "views/layout")
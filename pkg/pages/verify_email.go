@@ -43,13 +43,6 @@ func (p *Pages) Verify(c *fiber.Ctx) error {
 		return c.Redirect(p.RouterPath)
 	}
 
-	if user.State.Read(constants.USER_IS_OAUTH_ONLY) {
-		return p.ErrorPage(c, &fiber.Error{
-			Code:    fiber.StatusBadRequest,
-			Message: "You are using an OAuth provider for your account. Verifying your email through Omega is not necessary.",
-		})
-	}
-
 	data := map[string]any{
 		"BaseURL":        p.RouterPath,
 		"ServerName":     p.ServerName,
@@ -0,0 +1,227 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// Length of the hash prefix that ranges are grouped by, the same as the Pwned Passwords range API.
+const RANGE_PREFIX_LENGTH = 5
+
+// BreachList looks up passwords in a corpus of breached password hashes on disk. Nothing is loaded into memory:
+// every lookup reads only the range of hashes that share the first five hex characters of the password's SHA-1
+// digest (the same k-anonymity scheme used by the Pwned Passwords range API), so it scales to a full download.
+//
+// The corpus is either a directory of range files, as written by the Pwned Passwords downloader, where each file is
+// named after its prefix (i.e. 00000.txt) and holds the remaining 35 characters of each hash:
+//
+//	0005AD76BD555C1D6D771DE417A4B87E4B4:10
+//
+// Or a single file of full hashes sorted by hash, i.e. the "ordered by hash" Pwned Passwords download, which is
+// binary searched:
+//
+//	000000005AD76BD555C1D6D771DE417A4B87E4B4:10
+//
+// Counts are optional in both. Blank lines and lines starting with # are ignored in range files, but can't be used
+// in a sorted file.
+type BreachList struct {
+	path string
+	dir  bool
+}
+
+// OpenBreachList opens a breached password directory or sorted file, see BreachList.
+func OpenBreachList(path string) (*BreachList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &BreachList{path: path, dir: info.IsDir()}, nil
+}
+
+// Range returns every suffix (and its occurrence count) stored under the given 5 character hash prefix.
+func (b *BreachList) Range(prefix string) (map[string]uint64, error) {
+	prefix = strings.ToUpper(prefix)
+	if len(prefix) != RANGE_PREFIX_LENGTH {
+		return nil, fmt.Errorf("expected a %d character hash prefix", RANGE_PREFIX_LENGTH)
+	}
+	if _, err := hex.DecodeString(prefix + "0"); err != nil {
+		return nil, fmt.Errorf("invalid hash prefix: %w", err)
+	}
+	if b.dir {
+		return b.read_range_file(prefix)
+	}
+	return b.search_sorted_file(prefix)
+}
+
+// Occurrences returns the number of times the password has been seen in a breach, or 0 if it is not in the list.
+func (b *BreachList) Occurrences(password string) (uint64, error) {
+	digest := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+	suffixes, err := b.Range(hash[:RANGE_PREFIX_LENGTH])
+	if err != nil {
+		return 0, err
+	}
+	return suffixes[hash[RANGE_PREFIX_LENGTH:]], nil
+}
+
+// Contains returns true if the password has been seen in a breach. A list that can't be read is logged, and treated
+// as not containing the password so that users aren't locked out of registering.
+func (b *BreachList) Contains(password string) bool {
+	count, err := b.Occurrences(password)
+	if err != nil {
+		log.Error("Failed to check breached passwords: ", err)
+		return false
+	}
+	return count > 0
+}
+
+// Reads the range file of a prefix from a directory. A missing file is an empty range.
+func (b *BreachList) read_range_file(prefix string) (map[string]uint64, error) {
+	suffixes := make(map[string]uint64)
+	file, err := os.Open(filepath.Join(b.path, prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return suffixes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		suffix, count, err := parse_line(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s.txt: %w", prefix, err)
+		}
+
+		// Tolerate full hashes as well
+		if len(suffix) == 40 {
+			suffix = suffix[RANGE_PREFIX_LENGTH:]
+		}
+		suffixes[suffix] += count
+	}
+	return suffixes, scanner.Err()
+}
+
+// Binary searches a sorted file for the first line at or after the prefix, then reads lines until the prefix ends.
+func (b *BreachList) search_sorted_file(prefix string) (map[string]uint64, error) {
+	file, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Offsets are mapped to the start of the first line beginning at or after them, so searching offsets finds
+	// the first line whose hash isn't below the prefix
+	low, high := int64(0), info.Size()
+	for low < high {
+		mid := low + (high-low)/2
+		start, err := line_start(file, mid)
+		if err != nil {
+			return nil, err
+		}
+		line, err := read_line(file, start, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || strings.ToUpper(line[:min(len(line), RANGE_PREFIX_LENGTH)]) >= prefix {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	start, err := line_start(file, low)
+	if err != nil {
+		return nil, err
+	}
+
+	suffixes := make(map[string]uint64)
+	reader := bufio.NewReader(io.NewSectionReader(file, start, info.Size()-start))
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			if !strings.HasPrefix(strings.ToUpper(line), prefix) {
+				break
+			}
+			hash, count, parse_err := parse_line(line)
+			if parse_err == nil && len(hash) != 40 {
+				parse_err = fmt.Errorf("expected a full SHA-1 hash, got %q", hash)
+			}
+			if parse_err != nil {
+				return nil, parse_err
+			}
+			suffixes[hash[RANGE_PREFIX_LENGTH:]] += count
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return suffixes, nil
+}
+
+// Returns where the first line beginning at or after offset starts.
+func line_start(file *os.File, offset int64) (int64, error) {
+	if offset == 0 {
+		return 0, nil
+	}
+
+	// The line begins at offset if the previous byte ends a line, otherwise it begins after the next newline
+	reader := bufio.NewReader(io.NewSectionReader(file, offset-1, 1<<62))
+	skipped, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return offset - 1 + int64(len(skipped)), nil
+}
+
+// Reads the line beginning at start, or an empty string at the end of the file.
+func read_line(file *os.File, start int64, size int64) (string, error) {
+	if start >= size {
+		return "", nil
+	}
+	line, err := bufio.NewReader(io.NewSectionReader(file, start, size-start)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// Parses a line of a hash and an optional count, separated by a colon.
+func parse_line(line string) (string, uint64, error) {
+	hash, count_str, _ := strings.Cut(line, ":")
+	if len(hash) != 40 && len(hash) != 40-RANGE_PREFIX_LENGTH {
+		return "", 0, fmt.Errorf("expected a SHA-1 hash or hash suffix, got %q", hash)
+	}
+	if strings.Trim(hash, "0123456789abcdefABCDEF") != "" {
+		return "", 0, fmt.Errorf("invalid hash %q", hash)
+	}
+
+	var count uint64 = 1
+	if count_str != "" {
+		if _, err := fmt.Sscan(count_str, &count); err != nil {
+			return "", 0, fmt.Errorf("invalid count: %w", err)
+		}
+	}
+	return strings.ToUpper(hash), count, nil
+}
@@ -0,0 +1,124 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rule identifiers returned in a Violation. These are stable and can be used by clients to
+// highlight which requirement failed.
+const (
+	RULE_MIN_LENGTH = "min_length"
+	RULE_MAX_LENGTH = "max_length"
+	RULE_USERNAME   = "contains_username"
+	RULE_EMAIL      = "contains_email"
+	RULE_STRENGTH   = "strength"
+	RULE_BREACHED   = "breached"
+)
+
+// Violation describes a single password policy rule that was not satisfied.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Result is the outcome of checking a password against a Policy.
+type Result struct {
+	Score      int          `json:"score"`
+	Violations []*Violation `json:"violations"`
+}
+
+// Policy is a configurable set of password requirements.
+type Policy struct {
+	MinLength      int         // Minimum number of characters (runes).
+	MaxLength      int         // Maximum number of characters (runes). Set to 0 to disable.
+	MinScore       int         // Minimum strength score, from 0 (weakest) to 4 (strongest).
+	RejectIdentity bool        // Reject passwords that contain the username or email address.
+	Breached       *BreachList // Optional list of breached password hashes. Set to nil to disable.
+}
+
+// DefaultPolicy returns the policy used when none is configured.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength:      8,
+		MaxLength:      128,
+		MinScore:       2,
+		RejectIdentity: true,
+	}
+}
+
+// Check evaluates the password against every rule in the policy and returns the strength score
+// along with all failed rules. A password is acceptable if no violations are returned.
+func (p *Policy) Check(password string, username string, email string) *Result {
+	result := &Result{
+		Score:      Score(password, username, email),
+		Violations: make([]*Violation, 0),
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		result.Violations = append(result.Violations, &Violation{
+			Rule:    RULE_MIN_LENGTH,
+			Message: fmt.Sprintf("Your password must be at least %d characters long.", p.MinLength),
+		})
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		result.Violations = append(result.Violations, &Violation{
+			Rule:    RULE_MAX_LENGTH,
+			Message: fmt.Sprintf("Your password must be no more than %d characters long.", p.MaxLength),
+		})
+	}
+
+	if p.RejectIdentity {
+		lowered := strings.ToLower(password)
+
+		if username != "" && len(username) >= 3 && strings.Contains(lowered, strings.ToLower(username)) {
+			result.Violations = append(result.Violations, &Violation{
+				Rule:    RULE_USERNAME,
+				Message: "Your password must not contain your username.",
+			})
+		}
+
+		if email != "" {
+			local, _, _ := strings.Cut(strings.ToLower(email), "@")
+			if strings.Contains(lowered, strings.ToLower(email)) || (len(local) >= 3 && strings.Contains(lowered, local)) {
+				result.Violations = append(result.Violations, &Violation{
+					Rule:    RULE_EMAIL,
+					Message: "Your password must not contain your email address.",
+				})
+			}
+		}
+	}
+
+	if result.Score < p.MinScore {
+		result.Violations = append(result.Violations, &Violation{
+			Rule:    RULE_STRENGTH,
+			Message: "Your password is too easy to guess. Try a longer password or an uncommon phrase.",
+		})
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		result.Violations = append(result.Violations, &Violation{
+			Rule:    RULE_BREACHED,
+			Message: "This password has appeared in a data breach. Please choose a different one.",
+		})
+	}
+
+	return result
+}
+
+// Valid returns true if the result has no violations.
+func (r *Result) Valid() bool {
+	return len(r.Violations) == 0
+}
+
+// Error joins all violation messages into a single string, one per line.
+func (r *Result) Error() string {
+	messages := make([]string, 0, len(r.Violations))
+	for _, v := range r.Violations {
+		messages = append(messages, v.Message)
+	}
+	return strings.Join(messages, "\n")
+}
@@ -0,0 +1,178 @@
+package password
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+	"unicode"
+)
+
+//go:embed common.txt
+var common_list string
+
+// Common passwords and words that are the first things an attacker will try.
+var common_words = func() map[string]bool {
+	words := make(map[string]bool)
+	for _, line := range strings.Split(common_list, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			words[line] = true
+		}
+	}
+	return words
+}()
+
+// Keyboard rows used to detect runs like "qwerty" or "asdf".
+var keyboard_rows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+// Common character substitutions, used to undo "leet speak" before dictionary matching.
+var leet_replacer = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "3", "e", "6", "g", "1", "i", "!", "i",
+	"0", "o", "5", "s", "$", "s", "7", "t", "+", "t", "2", "z",
+)
+
+// Score estimates how hard a password is to guess, in the style of zxcvbn. The result ranges
+// from 0 (trivially guessable) to 4 (very unguessable). The username and email are treated as
+// known words, since an attacker targeting an account will try them first.
+func Score(password string, username string, email string) int {
+	if password == "" {
+		return 0
+	}
+
+	lowered := strings.ToLower(password)
+	unleeted := leet_replacer.Replace(lowered)
+
+	// Whole-password dictionary matches are always the weakest
+	if common_words[lowered] || common_words[unleeted] {
+		return 0
+	}
+
+	bits := entropy(password)
+
+	// Discount any dictionary words, or personal information, contained in the password
+	known := []string{strings.ToLower(username)}
+	if local, _, found := strings.Cut(strings.ToLower(email), "@"); found {
+		known = append(known, local)
+	}
+	for word := range common_words {
+		if len(word) >= 4 {
+			known = append(known, word)
+		}
+	}
+
+	var discounted int
+	for _, word := range known {
+		if len(word) < 3 {
+			continue
+		}
+		if strings.Contains(lowered, word) || strings.Contains(unleeted, word) {
+			discounted = max(discounted, len([]rune(word)))
+		}
+	}
+
+	if discounted > 0 {
+
+		// Replace the per-character cost of the matched word with the cost of picking a word from the list
+		bits -= float64(discounted) * math.Log2(float64(cardinality(password)))
+		bits += math.Log2(float64(len(common_words)))
+		bits = max(bits, 0)
+	}
+
+	// Map estimated guesses onto the same thresholds used by zxcvbn (10^3, 10^6, 10^8, 10^10)
+	switch guesses := bits / math.Log2(10); {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// entropy estimates the number of bits needed to brute-force the password. Characters that
+// continue a repeat, a sequence (abc, 321) or a keyboard run (qwerty) add far less than a
+// freely chosen character would.
+func entropy(password string) float64 {
+	per_char := math.Log2(float64(cardinality(password)))
+	runes := []rune(strings.ToLower(password))
+
+	var bits float64
+	for i, r := range runes {
+		switch {
+		case i == 0:
+			bits += per_char
+		case r == runes[i-1]:
+			bits += 1
+		case i >= 2 && r-runes[i-1] == runes[i-1]-runes[i-2] && abs(r-runes[i-1]) == 1:
+			bits += 1
+		case adjacent_on_keyboard(runes[i-1], r):
+			bits += 2
+		default:
+			bits += per_char
+		}
+	}
+	return bits
+}
+
+// cardinality returns the size of the character pool the password appears to be drawn from.
+func cardinality(password string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	var size int
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	return max(size, 2)
+}
+
+func adjacent_on_keyboard(a rune, b rune) bool {
+	for _, row := range keyboard_rows {
+		i := strings.IndexRune(row, a)
+		j := strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && abs(rune(i-j)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func abs(r rune) rune {
+	if r < 0 {
+		return -r
+	}
+	return r
+}
@@ -0,0 +1,201 @@
+// Package proxy finds the address of the client behind trusted reverse proxies, using the X-Forwarded-For or
+// Forwarded header they add. Headers are only believed when they were added by a trusted proxy, so clients can't
+// spoof their address.
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The key the client's address is stored under in the request's locals.
+const LOCALS_CLIENT_IP = "client_ip"
+
+// The headers that trusted proxies can put the client's address in.
+const (
+	HEADER_X_FORWARDED_FOR = fiber.HeaderXForwardedFor
+	HEADER_FORWARDED       = fiber.HeaderForwarded
+)
+
+var ErrUnknownHeader = errors.New("forwarding header must be X-Forwarded-For or Forwarded")
+
+// Proxies is a list of networks whose forwarding header is trusted. An empty list trusts no one, so the address of
+// the peer is always used.
+type Proxies struct {
+	networks []*net.IPNet
+	header   string
+}
+
+// New parses a list of trusted proxies, given as CIDR ranges ("10.0.0.0/8") or single addresses ("192.0.2.1").
+func New(trusted ...string) (*Proxies, error) {
+	p := &Proxies{}
+	if err := p.Set(trusted...); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Set replaces the list of trusted proxies. It is left unchanged if any entry can't be parsed.
+func (p *Proxies) Set(trusted ...string) error {
+	var networks []*net.IPNet
+	for _, entry := range trusted {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return &net.ParseError{Type: "IP address", Text: entry}
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, network)
+	}
+	p.networks = networks
+	return nil
+}
+
+// SetHeader sets which header the trusted proxies put the client's address in, HEADER_X_FORWARDED_FOR (the default)
+// or HEADER_FORWARDED. Only that header is read. Proxies usually pass on any other forwarding header the client
+// sent, so reading it would let clients spoof their address.
+func (p *Proxies) SetHeader(header string) error {
+	switch {
+	case header == "" || strings.EqualFold(header, HEADER_X_FORWARDED_FOR):
+		p.header = HEADER_X_FORWARDED_FOR
+	case strings.EqualFold(header, HEADER_FORWARDED):
+		p.header = HEADER_FORWARDED
+	default:
+		return ErrUnknownHeader
+	}
+	return nil
+}
+
+// Trusted reports whether an address belongs to a trusted proxy.
+func (p *Proxies) Trusted(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve finds the address of the client that made a request. Starting from the peer, it walks the chain in the
+// configured forwarding header from the nearest hop outwards, and stops at the first address that isn't a trusted proxy. Anything before
+// that address was written by the client itself, so it is ignored.
+func (p *Proxies) Resolve(c *fiber.Ctx) string {
+	peer := c.Context().RemoteIP()
+	if !p.Trusted(peer) {
+		return peer.String()
+	}
+
+	var chain []string
+	if p.header == HEADER_FORWARDED {
+		chain = parse_forwarded(header_values(c, HEADER_FORWARDED))
+	} else {
+		chain = parse_x_forwarded_for(header_values(c, HEADER_X_FORWARDED_FOR))
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parse_node(chain[i])
+		if ip == nil {
+
+			// The trusted proxy forwarded something that isn't an address (i.e. "unknown"), so it is as far as we know
+			break
+		}
+		client = ip
+		if !p.Trusted(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// Handler returns a middleware that stores the address of the client in the request's locals, for ClientIP.
+func (p *Proxies) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals(LOCALS_CLIENT_IP, p.Resolve(c))
+		return c.Next()
+	}
+}
+
+// ClientIP returns the address of the client, as found by the middleware. Without the middleware, it falls back to
+// Fiber's own c.IP(), so an app that configures its own proxy settings keeps them.
+func ClientIP(c *fiber.Ctx) string {
+	if ip, ok := c.Locals(LOCALS_CLIENT_IP).(string); ok && ip != "" {
+		return ip
+	}
+	return c.IP()
+}
+
+// Reads every line of a header, joined by commas. Proxies may append their own line instead of extending the last one,
+// and c.Get would only see the first, which was written by the client.
+func header_values(c *fiber.Ctx, name string) string {
+	var values []string
+	for _, value := range c.Request().Header.PeekAll(name) {
+		values = append(values, string(value))
+	}
+	return strings.Join(values, ",")
+}
+
+// Splits an X-Forwarded-For header into its addresses, from the client to the nearest proxy. Several headers are
+// joined by commas, which gives the same list.
+func parse_x_forwarded_for(header string) []string {
+	if header == "" {
+		return nil
+	}
+	nodes := strings.Split(header, ",")
+	for i, node := range nodes {
+		nodes[i] = strings.TrimSpace(node)
+	}
+	return nodes
+}
+
+// Reads the "for" parameter from each element of a Forwarded header (RFC 7239), i.e.
+// `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`. An element without one is kept as an empty node, so
+// the chain isn't shortened.
+func parse_forwarded(header string) []string {
+	if header == "" {
+		return nil
+	}
+	var nodes []string
+	for _, element := range strings.Split(header, ",") {
+		node := ""
+		for _, pair := range strings.Split(element, ";") {
+			key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(strings.TrimSpace(key), "for") {
+				node = strings.Trim(strings.TrimSpace(value), `"`)
+				break
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Parses a node from either header, which may have a port and IPv6 brackets. Returns nil for obfuscated identifiers
+// ("_hidden"), "unknown", and anything else that isn't an address.
+func parse_node(node string) net.IP {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	return net.ParseIP(node)
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// Resolves the client of a request from peer, with each header line given in order.
+func resolve(t *testing.T, p *Proxies, peer string, headers ...[2]string) string {
+	t.Helper()
+	request := &fasthttp.Request{}
+	for _, header := range headers {
+		request.Header.Add(header[0], header[1])
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(request, &net.TCPAddr{IP: net.ParseIP(peer), Port: 50000}, nil)
+
+	app := fiber.New()
+	c := app.AcquireCtx(ctx)
+	defer app.ReleaseCtx(c)
+	return p.Resolve(c)
+}
+
+func new_proxies(t *testing.T, trusted ...string) *Proxies {
+	t.Helper()
+	p, err := New(trusted...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// Creates proxies that put the client's address in the Forwarded header.
+func new_forwarded_proxies(t *testing.T, trusted ...string) *Proxies {
+	t.Helper()
+	p := new_proxies(t, trusted...)
+	if err := p.SetHeader(HEADER_FORWARDED); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestUntrustedPeer(t *testing.T) {
+	cases := []struct {
+		proxies *Proxies
+		header  [2]string
+	}{
+		{new_proxies(t, "10.0.0.0/8"), [2]string{fiber.HeaderXForwardedFor, "198.51.100.7"}},
+		{new_forwarded_proxies(t, "10.0.0.0/8"), [2]string{fiber.HeaderForwarded, "for=198.51.100.7"}},
+	}
+	for _, test := range cases {
+		if ip := resolve(t, test.proxies, "203.0.113.5", test.header); ip != "203.0.113.5" {
+			t.Errorf("%s from an untrusted peer: got %s, want the peer", test.header[0], ip)
+		}
+	}
+
+	// Trusting no one always gives the peer
+	if ip := resolve(t, new_proxies(t), "10.0.0.1", [2]string{fiber.HeaderXForwardedFor, "198.51.100.7"}); ip != "10.0.0.1" {
+		t.Errorf("no trusted proxies: got %s, want the peer", ip)
+	}
+}
+
+func TestTrustedChain(t *testing.T) {
+	p := new_proxies(t, "10.0.0.0/8", "192.0.2.1")
+
+	// The client prepended its own address, which must be skipped in favour of the one our proxies saw
+	header := [2]string{fiber.HeaderXForwardedFor, "1.2.3.4, 203.0.113.5, 192.0.2.1"}
+	if ip := resolve(t, p, "10.0.0.1", header); ip != "203.0.113.5" {
+		t.Errorf("X-Forwarded-For: got %s, want 203.0.113.5", ip)
+	}
+
+	header = [2]string{fiber.HeaderForwarded, `for=1.2.3.4, for=203.0.113.5;proto=https, for=192.0.2.1`}
+	if ip := resolve(t, new_forwarded_proxies(t, "10.0.0.0/8", "192.0.2.1"), "10.0.0.1", header); ip != "203.0.113.5" {
+		t.Errorf("Forwarded: got %s, want 203.0.113.5", ip)
+	}
+
+	// Proxies that add their own header line instead of extending the client's
+	ip := resolve(t, p, "10.0.0.1",
+		[2]string{fiber.HeaderXForwardedFor, "1.2.3.4"},
+		[2]string{fiber.HeaderXForwardedFor, "203.0.113.5, 192.0.2.1"},
+	)
+	if ip != "203.0.113.5" {
+		t.Errorf("several X-Forwarded-For lines: got %s, want 203.0.113.5", ip)
+	}
+
+	// Every hop is trusted, so the furthest one is the client
+	if ip := resolve(t, p, "10.0.0.1", [2]string{fiber.HeaderXForwardedFor, "10.1.1.1, 192.0.2.1"}); ip != "10.1.1.1" {
+		t.Errorf("all trusted: got %s, want 10.1.1.1", ip)
+	}
+}
+
+func TestOtherHeaderIgnored(t *testing.T) {
+
+	// The proxy appends to X-Forwarded-For, and passes on the Forwarded header the client made up
+	p := new_proxies(t, "10.0.0.0/8")
+	ip := resolve(t, p, "10.0.0.1",
+		[2]string{fiber.HeaderForwarded, "for=1.2.3.4"},
+		[2]string{fiber.HeaderXForwardedFor, "203.0.113.5"},
+	)
+	if ip != "203.0.113.5" {
+		t.Errorf("client sent Forwarded: got %s, want 203.0.113.5", ip)
+	}
+
+	// And the other way around
+	ip = resolve(t, new_forwarded_proxies(t, "10.0.0.0/8"), "10.0.0.1",
+		[2]string{fiber.HeaderXForwardedFor, "1.2.3.4"},
+		[2]string{fiber.HeaderForwarded, "for=203.0.113.5"},
+	)
+	if ip != "203.0.113.5" {
+		t.Errorf("client sent X-Forwarded-For: got %s, want 203.0.113.5", ip)
+	}
+
+	// Only the configured header is read, even if it is missing
+	if ip := resolve(t, p, "10.0.0.1", [2]string{fiber.HeaderForwarded, "for=1.2.3.4"}); ip != "10.0.0.1" {
+		t.Errorf("only Forwarded: got %s, want the peer", ip)
+	}
+
+	if err := p.SetHeader("X-Real-IP"); err != ErrUnknownHeader {
+		t.Errorf("SetHeader accepted an unknown header: %v", err)
+	}
+}
+
+func TestForwardedIPv6(t *testing.T) {
+	header := [2]string{fiber.HeaderForwarded, `for="[2001:db8:cafe::17]:4711"`}
+	if ip := resolve(t, new_forwarded_proxies(t, "10.0.0.0/8"), "10.0.0.1", header); ip != "2001:db8:cafe::17" {
+		t.Errorf("got %s, want 2001:db8:cafe::17", ip)
+	}
+
+	header = [2]string{fiber.HeaderXForwardedFor, "2001:db8::1"}
+	if ip := resolve(t, new_proxies(t, "10.0.0.0/8"), "10.0.0.1", header); ip != "2001:db8::1" {
+		t.Errorf("X-Forwarded-For: got %s, want 2001:db8::1", ip)
+	}
+}
+
+func TestUnknownNode(t *testing.T) {
+	p := new_forwarded_proxies(t, "10.0.0.0/8")
+
+	// The proxy didn't know who it was talking to, so it is the furthest we can trust
+	header := [2]string{fiber.HeaderForwarded, "for=203.0.113.5, for=unknown, for=10.0.0.2"}
+	if ip := resolve(t, p, "10.0.0.1", header); ip != "10.0.0.2" {
+		t.Errorf("Forwarded: got %s, want 10.0.0.2", ip)
+	}
+
+	header = [2]string{fiber.HeaderForwarded, "for=_hidden"}
+	if ip := resolve(t, p, "10.0.0.1", header); ip != "10.0.0.1" {
+		t.Errorf("obfuscated: got %s, want the peer", ip)
+	}
+
+	header = [2]string{fiber.HeaderXForwardedFor, "203.0.113.5, unknown"}
+	if ip := resolve(t, new_proxies(t, "10.0.0.0/8"), "10.0.0.1", header); ip != "10.0.0.1" {
+		t.Errorf("X-Forwarded-For: got %s, want the peer", ip)
+	}
+}
@@ -0,0 +1,281 @@
+// Package ratelimit limits how often clients can call each route, with a table of policies per route or group of
+// routes. Counters are kept in a fiber.Storage, so several instances of the server can share them.
+//
+// Within an instance, each counter is read and updated under its own lock, so limits are exact. fiber.Storage has no
+// atomic increment though, so instances sharing a store can overwrite each other's counts, and a few more requests
+// than the limit may get through when a client spreads its requests across them. Counts across instances are
+// approximate.
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/proxy"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+)
+
+// What requests are counted together under a policy.
+const (
+	KEY_IP      = "ip"      // Requests from the same client address.
+	KEY_ACCOUNT = "account" // Requests from the same logged in user. Requests without a login are counted by address.
+	KEY_BOTH    = "both"    // Both of the above. A request has to be within both limits.
+)
+
+// The route that a policy applies to when no other policy matches.
+const DEFAULT_ROUTE = ""
+
+// Policy is how many requests may be made in a window of time.
+type Policy struct {
+	Max    int           // Requests allowed per window.
+	Window time.Duration // Length of the sliding window.
+	Key    string        // KEY_IP, KEY_ACCOUNT or KEY_BOTH. Defaults to KEY_IP.
+}
+
+// Policies maps routes to the policy that limits them. A route (i.e. "/login") applies to itself and everything
+// below it (i.e. "/login/..."), and the longest matching route wins. DEFAULT_ROUTE applies to every other route.
+type Policies map[string]*Policy
+
+// Limiter counts requests against policies. It is shared by every API version, so that exemptions and the store are
+// configured in one place.
+type Limiter struct {
+	Store fiber.Storage // Where counters are kept. Defaults to memory, which isn't shared between instances.
+
+	mu              sync.Mutex
+	exempt_networks []*net.IPNet
+	exempt_accounts []string
+
+	locks_mu sync.Mutex
+	locks    map[string]*bucket_lock
+}
+
+// Serializes updates to one bucket's counter. It is removed once nobody holds or waits for it.
+type bucket_lock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// A counter for one bucket, using the previous and current fixed windows to approximate a sliding one.
+type counter struct {
+	Start    int64 `json:"start"`    // Start of the current window, in Unix nanoseconds.
+	Current  int   `json:"current"`  // Requests in the current window.
+	Previous int   `json:"previous"` // Requests in the window before it.
+}
+
+// The outcome of counting a request against one bucket.
+type usage struct {
+	allowed   bool
+	remaining int
+	reset     time.Duration
+}
+
+// New creates a limiter that keeps its counters in the given store, or in memory if it is nil.
+func New(store fiber.Storage) *Limiter {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return &Limiter{Store: store}
+}
+
+// Exempt lets clients skip rate limits entirely. Entries are client addresses, as CIDR ranges ("10.0.0.0/8") or
+// single addresses, or the IDs of user accounts. It replaces any previous exemptions.
+func (l *Limiter) Exempt(entries ...string) error {
+	var networks []*net.IPNet
+	var accounts []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return err
+			}
+			networks = append(networks, network)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			accounts = append(accounts, entry)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.exempt_networks = networks
+	l.exempt_accounts = accounts
+	return nil
+}
+
+// Match returns the route and policy that apply to a path, or nil if there is none. Like Fiber's router, it ignores
+// case, so "/LOGIN" is limited as "/login".
+func (p Policies) Match(path string) (string, *Policy) {
+	path = strings.ToLower(path)
+	route, policy := DEFAULT_ROUTE, p[DEFAULT_ROUTE]
+	for candidate, candidate_policy := range p {
+		if candidate == DEFAULT_ROUTE || len(candidate) <= len(route) {
+			continue
+		}
+		if lower := strings.ToLower(candidate); path == lower || strings.HasPrefix(path, lower+"/") {
+			route, policy = candidate, candidate_policy
+		}
+	}
+	return route, policy
+}
+
+// Allow counts a request against the policy for its route, and sets the RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset and RateLimit-Policy headers. Returns false if the limit has been reached, after setting the
+// Retry-After header. The route is the path below where the middleware was mounted, and scope keeps the counters of
+// different API versions apart. The account is only looked up if the policy needs it, and may return "" for requests
+// without a login.
+func (l *Limiter) Allow(c *fiber.Ctx, scope string, policies Policies, account func(c *fiber.Ctx) string) (bool, error) {
+	mount := strings.ToLower(strings.TrimSuffix(c.Route().Path, "/"))
+	route, policy := policies.Match(strings.TrimPrefix(strings.ToLower(c.Path()), mount))
+	if policy == nil || policy.Max <= 0 || policy.Window <= 0 {
+		return true, nil
+	}
+
+	ip := proxy.ClientIP(c)
+	user := ""
+	if policy.Key == KEY_ACCOUNT || policy.Key == KEY_BOTH {
+		user = account(c)
+	}
+	if l.exempted(ip, user) {
+		return true, nil
+	}
+
+	// Work out which buckets the request counts against
+	prefix := "ratelimit:" + scope + ":" + route + ":"
+	var buckets []string
+	switch {
+	case policy.Key == KEY_ACCOUNT && user != "":
+		buckets = append(buckets, prefix+"account:"+user)
+	case policy.Key == KEY_BOTH && user != "":
+		buckets = append(buckets, prefix+"ip:"+ip, prefix+"account:"+user)
+	default:
+		buckets = append(buckets, prefix+"ip:"+ip)
+	}
+
+	// Report whichever bucket is closest to its limit
+	var result *usage
+	for _, bucket := range buckets {
+		u, err := l.take(bucket, policy)
+		if err != nil {
+			return false, err
+		}
+		if result == nil || !u.allowed || (result.allowed && u.remaining < result.remaining) {
+			result = u
+		}
+	}
+
+	reset := strconv.Itoa(int(math.Ceil(result.reset.Seconds())))
+	c.Set("RateLimit-Limit", strconv.Itoa(policy.Max))
+	c.Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	c.Set("RateLimit-Reset", reset)
+	c.Set("RateLimit-Policy", strconv.Itoa(policy.Max)+";w="+strconv.Itoa(int(policy.Window.Seconds())))
+	if !result.allowed {
+		c.Set(fiber.HeaderRetryAfter, reset)
+	}
+	return result.allowed, nil
+}
+
+// Checks whether the client address or account is exempt from rate limits.
+func (l *Limiter) exempted(ip string, user string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if user != "" && slices.Contains(l.exempt_accounts, user) {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	return addr != nil && slices.ContainsFunc(l.exempt_networks, func(network *net.IPNet) bool { return network.Contains(addr) })
+}
+
+// Locks a bucket, so its counter can be read and written back without losing concurrent requests. Other buckets
+// aren't held up while the store is slow. Returns the function that unlocks it.
+func (l *Limiter) lock(bucket string) func() {
+	l.locks_mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*bucket_lock{}
+	}
+	lock, ok := l.locks[bucket]
+	if !ok {
+		lock = &bucket_lock{}
+		l.locks[bucket] = lock
+	}
+	lock.refs++
+	l.locks_mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		l.locks_mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, bucket)
+		}
+		l.locks_mu.Unlock()
+	}
+}
+
+// Counts a request against a bucket, unless it is already at its limit. The previous window's requests are weighted
+// by how much of it still overlaps the sliding window.
+func (l *Limiter) take(bucket string, policy *Policy) (*usage, error) {
+	defer l.lock(bucket)()
+
+	now := time.Now()
+	start := now.Truncate(policy.Window)
+
+	var count counter
+	raw, err := l.Store.Get(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &count); err != nil {
+			count = counter{}
+		}
+	}
+
+	// Move on to a new window if this one is over
+	if count.Start != start.UnixNano() {
+		if count.Start == start.Add(-policy.Window).UnixNano() {
+			count.Previous = count.Current
+		} else {
+			count.Previous = 0
+		}
+		count.Current = 0
+		count.Start = start.UnixNano()
+	}
+
+	elapsed := now.Sub(start)
+	weight := float64(policy.Window-elapsed) / float64(policy.Window)
+	used := int(float64(count.Previous)*weight) + count.Current
+	result := &usage{reset: policy.Window - elapsed}
+	if used >= policy.Max {
+		return result, nil
+	}
+
+	count.Current++
+	raw, err = json.Marshal(&count)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.Store.Set(bucket, raw, 2*policy.Window); err != nil {
+		return nil, err
+	}
+
+	result.allowed = true
+	result.remaining = policy.Max - used - 1
+	return result, nil
+}
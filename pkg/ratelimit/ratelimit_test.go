@@ -0,0 +1,221 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/proxy"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestPoliciesMatch(t *testing.T) {
+	login := &Policy{Max: 10, Window: time.Minute}
+	confirm := &Policy{Max: 5, Window: time.Minute}
+	fallback := &Policy{Max: 60, Window: time.Minute}
+	policies := Policies{
+		DEFAULT_ROUTE:         fallback,
+		"/login":              login,
+		"/magic-link/confirm": confirm,
+	}
+
+	cases := []struct {
+		path   string
+		route  string
+		policy *Policy
+	}{
+		{"/login", "/login", login},
+		{"/login/", "/login", login},
+		{"/login/totp", "/login", login},
+		{"/LOGIN", "/login", login},
+		{"/Login/TOTP", "/login", login},
+		{"/loginx", DEFAULT_ROUTE, fallback},
+		{"/magic-link", DEFAULT_ROUTE, fallback},
+		{"/magic-link/confirm", "/magic-link/confirm", confirm},
+		{"/Magic-Link/Confirm", "/magic-link/confirm", confirm},
+		{"/", DEFAULT_ROUTE, fallback},
+	}
+	for _, test := range cases {
+		route, policy := policies.Match(test.path)
+		if route != test.route || policy != test.policy {
+			t.Errorf("Match(%q) = %q, want %q", test.path, route, test.route)
+		}
+	}
+
+	if _, policy := (Policies{"/login": login}).Match("/other"); policy != nil {
+		t.Error("a path without a policy or default was limited")
+	}
+}
+
+// Reads a bucket's counter straight from the store.
+func read_counter(t *testing.T, l *Limiter, bucket string) counter {
+	t.Helper()
+	raw, err := l.Store.Get(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count counter
+	if err := json.Unmarshal(raw, &count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func write_counter(t *testing.T, l *Limiter, bucket string, count counter) {
+	t.Helper()
+	raw, err := json.Marshal(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Store.Set(bucket, raw, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWindowRollover(t *testing.T) {
+
+	// A day long window, so the test can't cross into the next one
+	policy := &Policy{Max: 10, Window: 24 * time.Hour}
+	start := time.Now().Truncate(policy.Window)
+	l := New(nil)
+
+	// A full current window refuses requests
+	write_counter(t, l, "full", counter{Start: start.UnixNano(), Current: 10})
+	if u, err := l.take("full", policy); err != nil || u.allowed {
+		t.Fatalf("full window: allowed = %v, err = %v", u.allowed, err)
+	}
+	if count := read_counter(t, l, "full"); count.Current != 10 {
+		t.Errorf("a refused request was counted: %d", count.Current)
+	}
+
+	// The previous window's requests carry over, weighted by how much of it still overlaps
+	write_counter(t, l, "previous", counter{Start: start.Add(-policy.Window).UnixNano(), Current: 10})
+	u, err := l.take("previous", policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := read_counter(t, l, "previous")
+	if count.Start != start.UnixNano() || count.Previous != 10 || count.Current != 1 {
+		t.Errorf("rolled over into %+v, want previous 10 and current 1", count)
+	}
+	weight := float64(u.reset) / float64(policy.Window)
+	if want := policy.Max - int(10*weight) - 1; !u.allowed || u.remaining != want {
+		t.Errorf("allowed = %v, remaining = %d, want %d", u.allowed, u.remaining, want)
+	}
+
+	// Anything older than that is forgotten
+	write_counter(t, l, "stale", counter{Start: start.Add(-2 * policy.Window).UnixNano(), Current: 10})
+	if u, err := l.take("stale", policy); err != nil || !u.allowed || u.remaining != policy.Max-1 {
+		t.Errorf("stale window: allowed = %v, remaining = %d, err = %v", u.allowed, u.remaining, err)
+	}
+	if count := read_counter(t, l, "stale"); count.Previous != 0 || count.Current != 1 {
+		t.Errorf("stale window rolled over into %+v", count)
+	}
+}
+
+// Creates an app whose "/api" routes are limited by policies. The client's address and account are taken from the
+// X-Test-IP and X-Test-Account headers.
+func new_test_app(l *Limiter, policies Policies) *fiber.App {
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(proxy.LOCALS_CLIENT_IP, c.Get("X-Test-IP"))
+		return c.Next()
+	})
+	api := app.Group("/api")
+	api.Use(func(c *fiber.Ctx) error {
+		allowed, err := l.Allow(c, "test", policies, func(c *fiber.Ctx) string { return c.Get("X-Test-Account") })
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return c.SendStatus(fiber.StatusTooManyRequests)
+		}
+		return c.Next()
+	})
+	api.Get("/*", func(c *fiber.Ctx) error { return c.SendString("OK") })
+	return app
+}
+
+// Makes a request and returns its status and RateLimit-Remaining header.
+func request(t *testing.T, app *fiber.App, path string, ip string, account string) (int, int) {
+	t.Helper()
+	req := httptest.NewRequest(fiber.MethodGet, path, nil)
+	req.Header.Set("X-Test-IP", ip)
+	if account != "" {
+		req.Header.Set("X-Test-Account", account)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining, _ := strconv.Atoi(resp.Header.Get("RateLimit-Remaining"))
+	if resp.StatusCode == fiber.StatusTooManyRequests && resp.Header.Get(fiber.HeaderRetryAfter) == "" {
+		t.Errorf("%s: refused without Retry-After", path)
+	}
+	return resp.StatusCode, remaining
+}
+
+func TestBuckets(t *testing.T) {
+	l := New(nil)
+	app := new_test_app(l, Policies{
+		"/ip":      {Max: 2, Window: time.Hour, Key: KEY_IP},
+		"/account": {Max: 2, Window: time.Hour, Key: KEY_ACCOUNT},
+		"/both":    {Max: 2, Window: time.Hour, Key: KEY_BOTH},
+	})
+
+	cases := []struct {
+		name      string
+		path      string
+		ip        string
+		account   string
+		status    int
+		remaining int
+	}{
+		{"ip", "/api/ip", "192.0.2.1", "a", fiber.StatusOK, 1},
+		{"same ip, other account", "/api/ip", "192.0.2.1", "b", fiber.StatusOK, 0},
+		{"ip full", "/api/ip", "192.0.2.1", "", fiber.StatusTooManyRequests, 0},
+		{"other ip", "/api/ip", "192.0.2.2", "a", fiber.StatusOK, 1},
+		{"case ignored", "/API/IP", "192.0.2.2", "", fiber.StatusOK, 0},
+
+		{"account", "/api/account", "192.0.2.1", "a", fiber.StatusOK, 1},
+		{"same account, other ip", "/api/account", "192.0.2.2", "a", fiber.StatusOK, 0},
+		{"account full", "/api/account", "192.0.2.3", "a", fiber.StatusTooManyRequests, 0},
+		{"other account", "/api/account", "192.0.2.1", "b", fiber.StatusOK, 1},
+		{"logged out counts by ip", "/api/account", "192.0.2.1", "", fiber.StatusOK, 1},
+
+		{"both", "/api/both", "192.0.2.1", "a", fiber.StatusOK, 1},
+		{"both, other ip", "/api/both", "192.0.2.2", "a", fiber.StatusOK, 0},
+		{"both, account full", "/api/both", "192.0.2.3", "a", fiber.StatusTooManyRequests, 0},
+		{"both, ip not full", "/api/both", "192.0.2.1", "b", fiber.StatusOK, 0},
+		{"both, ip full", "/api/both", "192.0.2.1", "c", fiber.StatusTooManyRequests, 0},
+	}
+	for _, test := range cases {
+		status, remaining := request(t, app, test.path, test.ip, test.account)
+		if status != test.status || remaining != test.remaining {
+			t.Errorf("%s: got %d with %d remaining, want %d with %d remaining", test.name, status, remaining, test.status, test.remaining)
+		}
+	}
+}
+
+func TestExempt(t *testing.T) {
+	l := New(nil)
+	if err := l.Exempt("10.0.0.0/8", "192.0.2.9", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	app := new_test_app(l, Policies{DEFAULT_ROUTE: {Max: 1, Window: time.Hour, Key: KEY_BOTH}})
+	for range 3 {
+		for _, client := range [][2]string{{"10.1.2.3", ""}, {"192.0.2.9", ""}, {"192.0.2.1", "admin"}} {
+			if status, _ := request(t, app, "/api/anything", client[0], client[1]); status != fiber.StatusOK {
+				t.Errorf("exempt client %v was limited", client)
+			}
+		}
+	}
+	if status, _ := request(t, app, "/api/anything", "192.0.2.1", "user"); status != fiber.StatusOK {
+		t.Error("first request was limited")
+	}
+	if status, _ := request(t, app, "/api/anything", "192.0.2.1", "user"); status != fiber.StatusTooManyRequests {
+		t.Error("second request wasn't limited")
+	}
+}
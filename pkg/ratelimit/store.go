@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// How often expired counters are removed from a MemoryStore.
+const MEMORY_GC_INTERVAL = time.Minute
+
+// MemoryStore keeps counters in memory. It is the default store, and only works for a single instance. To share
+// counters between instances, use any fiber.Storage that they share and that expires keys, i.e. Redis.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memory_entry
+	last_gc time.Time
+}
+
+type memory_entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]*memory_entry{}, last_gc: time.Now()}
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+		return nil, nil
+	}
+	return entry.value, nil
+}
+
+func (s *MemoryStore) Set(key string, value []byte, exp time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Clean up expired counters now and then, so clients that went away don't use memory forever
+	now := time.Now()
+	if now.Sub(s.last_gc) > MEMORY_GC_INTERVAL {
+		for k, entry := range s.entries {
+			if !entry.expires.IsZero() && now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.last_gc = now
+	}
+
+	entry := &memory_entry{value: value}
+	if exp > 0 {
+		entry.expires = now.Add(exp)
+	}
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = map[string]*memory_entry{}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
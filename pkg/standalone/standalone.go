@@ -0,0 +1,96 @@
+// Package standalone has the setup shared by the commands that run outside of another server: reading .env files
+// and opening the database. It is kept apart from the rest of the module so that embedding apps don't pull in the
+// database drivers.
+package standalone
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Database drivers that can be selected with DB_DRIVER.
+const (
+	DRIVER_SQLITE   = "sqlite"
+	DRIVER_POSTGRES = "postgres"
+)
+
+// Defaults used when DB_DRIVER and DB_DSN aren't set, which keep everything in a local file.
+const (
+	DEFAULT_DRIVER = DRIVER_SQLITE
+	DEFAULT_DSN    = "accounts.db"
+)
+
+// LoadEnvFile reads KEY=VALUE lines from a .env file into the environment. Blank lines and lines starting with # are
+// skipped, and values may be quoted. Variables that are already set are left alone, so the real environment wins.
+func LoadEnvFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line_number := 1; scanner.Scan(); line_number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !found {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, line_number)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, value)
+		}
+	}
+	return scanner.Err()
+}
+
+// OpenDatabase connects to a database with GORM. The driver is DRIVER_SQLITE or DRIVER_POSTGRES, and the DSN is a
+// file path for SQLite or a connection string for Postgres. Empty values fall back to DEFAULT_DRIVER and DEFAULT_DSN.
+func OpenDatabase(driver string, dsn string) (*gorm.DB, error) {
+	if driver == "" {
+		driver = DEFAULT_DRIVER
+	}
+	if dsn == "" {
+		if driver != DRIVER_SQLITE {
+			return nil, fmt.Errorf("DB_DSN is required for the %s driver", driver)
+		}
+		dsn = DEFAULT_DSN
+	}
+
+	// Lookups that find nothing are expected (i.e. a username that isn't taken), so they aren't logged
+	config := &gorm.Config{Logger: logger.New(log.New(os.Stderr, "", log.LstdFlags), logger.Config{
+		SlowThreshold:             200 * time.Millisecond,
+		LogLevel:                  logger.Warn,
+		IgnoreRecordNotFoundError: true,
+		Colorful:                  true,
+	})}
+	switch driver {
+	case DRIVER_SQLITE:
+		return gorm.Open(sqlite.Open(dsn), config)
+	case DRIVER_POSTGRES:
+		return gorm.Open(postgres.Open(dsn), config)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, expected %q or %q", driver, DRIVER_SQLITE, DRIVER_POSTGRES)
+	}
+}
+
+// DatabaseFromEnv opens the database selected by the DB_DRIVER and DB_DSN environment variables.
+func DatabaseFromEnv() (*gorm.DB, error) {
+	return OpenDatabase(os.Getenv("DB_DRIVER"), os.Getenv("DB_DSN"))
+}
@@ -1,6 +1,7 @@
 package structs
 
 import (
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/oauth2"
@@ -12,12 +13,19 @@ type MailConfig struct {
 	Server   string
 	Username string
 	Password string
+
+	From       string // Address to send from. Defaults to Username.
+	Transport  string // How mail is delivered: "smtp" (default), "log", "file" or "memory".
+	Security   string // SMTP connection security: "starttls" to require STARTTLS, "tls" for implicit TLS (usually port 465), "none", or empty to use STARTTLS when available.
+	SkipVerify bool   // Don't verify the SMTP server's certificate. Only use this for development.
+	Directory  string // Directory that the "file" transport writes .eml files to.
 }
 
 type EmailArgs struct {
 	Subject  string // Subject of email
 	To       string // Email address of recipient (to user)
 	Nickname string // Nickname of sender (i.e. this server)
+	Locale   string // Preferred locale of recipient, see email.MatchLocale
 }
 
 type Pages struct {
@@ -44,25 +52,152 @@ type APIv0 struct {
 	Auth         *Auth
 }
 
-// Claims are custom claims extending default ones
+// Authentication methods recorded in the amr claim. These follow RFC 8176, except for email, which is a magic link
+// or code sent to the user's address.
+const (
+	AMR_PASSWORD     = "pwd"
+	AMR_OTP          = "otp"
+	AMR_HARDWARE_KEY = "hwk"
+	AMR_MFA          = "mfa"
+	AMR_FEDERATED    = "fed"
+	AMR_EMAIL        = "email"
+)
+
+// Audiences of each kind of token the server signs. Every token is signed with the same key, so the audience is what
+// tells them apart; it's checked whenever a token is read, so that one kind can't be passed off as another.
+const (
+	AUDIENCE_SESSION    = "session"
+	AUDIENCE_RECOVERY   = "recovery"
+	AUDIENCE_STATE      = "oauth-state"
+	AUDIENCE_ONBOARDING = "onboarding"
+	AUDIENCE_LINK       = "link"
+	AUDIENCE_MFA        = "mfa"
+	AUDIENCE_EXPORT     = "export"
+	AUDIENCE_MAGIC_LINK = "magic-link"
+	AUDIENCE_WEBAUTHN   = "webauthn"
+)
+
+// Token is implemented by the claims of every kind of token the server signs.
+type Token interface {
+	jwt.Claims
+	TokenAudience() string             // The audience marking this kind of token.
+	Registered() *jwt.RegisteredClaims // The standard claims, which are filled in when the token is signed.
+}
+
+// Claims are custom claims extending default ones. AuthTime is when the user last proved who they are, by logging in
+// or re-authenticating, and AMR lists the methods they used to do so.
 type Claims struct {
-	ClaimType        uint8  `json:"claim_type"`
-	SessionID        string `json:"session_id,omitempty"`
-	Email            string `json:"email,omitempty"`
-	Username         string `json:"username,omitempty"`
-	ULID             string `json:"ulid,omitempty"`
-	IdentityProvider string `json:"identity_provider,omitempty"`
+	ClaimType        uint8            `json:"claim_type"`
+	SessionID        string           `json:"session_id,omitempty"`
+	Email            string           `json:"email,omitempty"`
+	Username         string           `json:"username,omitempty"`
+	ULID             string           `json:"ulid,omitempty"`
+	IdentityProvider string           `json:"identity_provider,omitempty"`
+	AuthTime         *jwt.NumericDate `json:"auth_time,omitempty"`
+	AMR              []string         `json:"amr,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Recovery tokens (with a ClaimType of 1) let a user reset their password without a session, so they can't be used as one.
+func (c *Claims) TokenAudience() string {
+	if c.ClaimType == 1 {
+		return AUDIENCE_RECOVERY
+	}
+	return AUDIENCE_SESSION
+}
+
 type State struct {
 	Redirect string `json:"redirect,omitempty"`
 	jwt.RegisteredClaims
 }
 
+func (t *State) TokenAudience() string { return AUDIENCE_STATE }
+
+// Onboarding holds an OAuth login that needs more information (i.e. a missing email or taken username) before an account can be created.
+type Onboarding struct {
+	Provider      string `json:"provider"`
+	ProviderID    string `json:"provider_id"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Redirect      string `json:"redirect,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (t *Onboarding) TokenAudience() string { return AUDIENCE_ONBOARDING }
+
+// LinkRequest holds an OAuth identity waiting to be linked to an existing account, once the owner of that account confirms it.
+type LinkRequest struct {
+	UserID     string `json:"user_id"`
+	Provider   string `json:"provider"`
+	ProviderID string `json:"provider_id"`
+	Password   bool   `json:"password"` // The account has a local password that can be used to confirm the link.
+	Code       bool   `json:"code"`     // A code can be emailed to the account's address to confirm the link.
+	Redirect   string `json:"redirect,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (t *LinkRequest) TokenAudience() string { return AUDIENCE_LINK }
+
+// MFAPending holds a login for an account with a second factor, after the user has given their password or signed
+// in with an OAuth provider, until the user has provided it.
+type MFAPending struct {
+	UserID   string `json:"user_id"`
+	Provider string `json:"provider"`
+	Redirect string `json:"redirect,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (t *MFAPending) TokenAudience() string { return AUDIENCE_MFA }
+
+// ExportToken authorizes downloading a personal data export, without requiring the user to be logged in.
+type ExportToken struct {
+	ExportID string `json:"export_id"`
+	UserID   string `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+func (t *ExportToken) TokenAudience() string { return AUDIENCE_EXPORT }
+
+// MagicLinkToken is the signed part of an emailed login link. The link it refers to can only be used once.
+type MagicLinkToken struct {
+	LinkID string `json:"link_id"`
+	UserID string `json:"user_id"`
+	jwt.RegisteredClaims
+}
+
+func (t *MagicLinkToken) TokenAudience() string { return AUDIENCE_MAGIC_LINK }
+
+// WebAuthnCeremony keeps the state of a passkey registration or assertion between its begin and finish requests.
+// Purpose is one of "register", "login" (passwordless) or "mfa" (after a password or magic link). UserID is empty
+// for passwordless logins, as the user is only known once their authenticator responds. MagicLinkID is set when the
+// first factor was a magic link, which is only used up once the assertion succeeds, and Provider when it was an OAuth
+// provider, so the session records it.
+type WebAuthnCeremony struct {
+	Purpose     string               `json:"purpose"`
+	UserID      string               `json:"user_id,omitempty"`
+	MagicLinkID string               `json:"magic_link_id,omitempty"`
+	Provider    string               `json:"provider,omitempty"`
+	Session     webauthn.SessionData `json:"session"`
+	jwt.RegisteredClaims
+}
+
+func (t *WebAuthnCeremony) TokenAudience() string { return AUDIENCE_WEBAUTHN }
+
+func (c *Claims) Registered() *jwt.RegisteredClaims           { return &c.RegisteredClaims }
+func (t *State) Registered() *jwt.RegisteredClaims            { return &t.RegisteredClaims }
+func (t *Onboarding) Registered() *jwt.RegisteredClaims       { return &t.RegisteredClaims }
+func (t *LinkRequest) Registered() *jwt.RegisteredClaims      { return &t.RegisteredClaims }
+func (t *MFAPending) Registered() *jwt.RegisteredClaims       { return &t.RegisteredClaims }
+func (t *ExportToken) Registered() *jwt.RegisteredClaims      { return &t.RegisteredClaims }
+func (t *MagicLinkToken) Registered() *jwt.RegisteredClaims   { return &t.RegisteredClaims }
+func (t *WebAuthnCeremony) Registered() *jwt.RegisteredClaims { return &t.RegisteredClaims }
+
 type Provider struct {
 	AccountEndpoint string
+	EmailsEndpoint  string // Optional endpoint listing all of the user's email addresses, used when the account endpoint hides them.
 	UsernameKey     string
 	EmailKey        string
+	VerifiedKey     string // Key of the boolean claim indicating the provider has verified the email address.
 	OAuthConfig     *oauth2.Config
 }
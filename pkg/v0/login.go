@@ -7,12 +7,11 @@ import (
 	"time"
 
 	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
 	"github.com/cloudlink-omega/storage/pkg/common"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	scrypt "github.com/elithrar/simple-scrypt"
 	"github.com/gofiber/fiber/v2"
-	"github.com/pquerna/otp"
-	"github.com/pquerna/otp/totp"
 )
 
 func (v *API) LoginEndpoint(c *fiber.Ctx) error {
@@ -72,6 +71,18 @@ func (v *API) LoginEndpoint(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).SendString("Invalid password.")
 	}
 
+	// Blocked and banned accounts can't be logged into
+	if database.UserBlocked(user) {
+		return c.Status(fiber.StatusForbidden).SendString("This account has been disabled.")
+	}
+
+	// Security keys can't be used with this API, so accounts without TOTP as an alternative have to log in using v1
+	if has_webauthn, err := v.DB.HasWebAuthnCredentials(user.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	} else if has_webauthn && !user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		return c.Status(fiber.StatusUnauthorized).SendString("Security key required! Please log in using the website.")
+	}
+
 	// Check if TOTP is required
 	if user.State.Read(constants.USER_IS_TOTP_ENABLED) {
 		if creds.TOTP == "" && creds.BackupCode == "" {
@@ -79,20 +90,8 @@ func (v *API) LoginEndpoint(c *fiber.Ctx) error {
 
 		} else if creds.TOTP != "" {
 
-			// Get secret
-			secret := v.DB.GetTotpSecret(user)
-
-			// Verify the TOTP
-			success, err := totp.ValidateCustom(
-				creds.TOTP,
-				secret,
-				time.Now().UTC(),
-				totp.ValidateOpts{
-					Digits:    otp.DigitsSix,
-					Period:    30,
-					Skew:      1,
-					Algorithm: otp.AlgorithmSHA512,
-				})
+			// Verify the TOTP. Each code can only be used once.
+			success, err := v.DB.VerifyTotp(user, creds.TOTP)
 			if err != nil {
 
 				// Log the event
@@ -14,12 +14,13 @@ func (v *API) LogoutEndpoint(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Missing token.")
 	}
 
-	if !v.Auth.ValidFromToken(creds.Token) {
+	claims := v.Auth.GetClaimsFromToken(creds.Token)
+	if claims == nil {
 		return c.Status(fiber.StatusCreated).SendString("Already logged out.")
 	}
 
 	// Find and delete the session from the database
-	err := v.DB.DeleteSession(v.Auth.GetClaimsFromToken(creds.Token).SessionID)
+	err := v.DB.DeleteSession(claims.SessionID)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
 	}
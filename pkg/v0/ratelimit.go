@@ -0,0 +1,32 @@
+package v0
+
+import (
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/ratelimit"
+	"github.com/gofiber/fiber/v2"
+)
+
+// DefaultRateLimits returns the rate limits used when none are configured.
+func DefaultRateLimits() ratelimit.Policies {
+	return ratelimit.Policies{
+		ratelimit.DEFAULT_ROUTE: {Max: 60, Window: time.Minute, Key: ratelimit.KEY_IP},
+		"/login":                {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_IP},
+		"/register":             {Max: 5, Window: 10 * time.Minute, Key: ratelimit.KEY_IP},
+		"/resend-verify":        {Max: 5, Window: 10 * time.Minute, Key: ratelimit.KEY_IP},
+		"/validate":             {Max: 120, Window: time.Minute, Key: ratelimit.KEY_IP},
+	}
+}
+
+// Applies the rate limit policy of the requested route. The legacy API passes tokens in request bodies rather than
+// cookies, so requests are always counted by address.
+func (v *API) rate_limit(c *fiber.Ctx) error {
+	allowed, err := v.RateLimiter.Allow(c, "v0", v.RateLimits, func(c *fiber.Ctx) string { return "" })
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+	if !allowed {
+		return c.Status(fiber.StatusTooManyRequests).SendString("You're going too damn fast! Please slow down your requests.")
+	}
+	return c.Next()
+}
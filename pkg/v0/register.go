@@ -1,12 +1,15 @@
 package v0
 
 import (
+	"errors"
 	"fmt"
 	math_rand "math/rand"
 	"time"
 
 	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
 	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/identity"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/cloudlink-omega/storage/pkg/common"
 	"github.com/cloudlink-omega/storage/pkg/types"
@@ -29,6 +32,17 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Already logged in!")
 	}
 
+	// Normalize the requested username and email address
+	username, err := identity.NormalizeUsername(creds.Username)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid username: %s.", err))
+	}
+	email_address, err := identity.NormalizeEmail(creds.Email)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("Invalid email: %s.", err))
+	}
+	creds.Username, creds.Email = username, email_address
+
 	// Check if the email provided already exists.
 	if user, err := v.DB.GetUserByEmail(creds.Email); err == nil && user != nil {
 		return c.Status(fiber.StatusConflict).SendString("Email already in use!")
@@ -61,6 +75,11 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).SendString(err.Error() + "\nevent_id: " + event_id)
 	}
 
+	// Enforce the password policy
+	if result := v.PasswordPolicy.Check(creds.Password, creds.Username, creds.Email); !result.Valid() {
+		return c.Status(fiber.StatusBadRequest).SendString(result.Error())
+	}
+
 	// Hash the password using scrypt
 	hash, err := scrypt.GenerateFromPassword([]byte(creds.Password), scrypt.DefaultParams)
 	if err != nil {
@@ -98,7 +117,10 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 		Secret:   userSecret,
 	}
 
-	if err := v.DB.CreateUser(user); err != nil {
+	if err := v.DB.CreateUser(user); errors.Is(err, database.ErrEmailInUse) {
+		return c.Status(fiber.StatusConflict).SendString("Email already in use!")
+
+	} else if err != nil {
 
 		// Log the event
 		event_id := common.LogEvent(v.DB.DB, &types.SystemEvent{
@@ -150,22 +172,25 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 		}
 
 		// Send the verification code to the user's email
-		email.SendPlainEmail(v.MailConfig, &structs.EmailArgs{
-			Subject:  "Verify your account",
+		if err := v.Outbox.Send(&structs.EmailArgs{
 			To:       user.Email,
 			Nickname: v.ServerNickname,
-		}, fmt.Sprintf(
-			`Hello %s, You are receiving this email because you recently created a CloudLink Omega account on server %s.
+			Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+		}, email.TEMPLATE_VERIFY, map[string]any{
+			"Username": user.Username,
+			"Code":     code,
+		}); err != nil {
 
-			To verify your account, please use the following verification code: %s.
-
-			This code will expire in 15 minutes.
-
-			If you did not create this account, you can safely ignore this email.
+			// Log the event
+			event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+				UserID:     user.ID,
+				EventID:    "user_verify_failure",
+				Details:    err.Error(),
+				Successful: false,
+			})
 
-			Regards,
-			- %s.`, user.Username, v.ServerNickname, code, v.ServerNickname),
-		)
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error() + "\nevent_id: " + event_id)
+		}
 
 		// Log the event
 		common.LogEvent(v.DB.DB, &types.UserEvent{
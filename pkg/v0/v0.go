@@ -4,16 +4,23 @@ import (
 	"time"
 
 	"github.com/cloudlink-omega/accounts/pkg/authorization"
+	"github.com/cloudlink-omega/accounts/pkg/constants"
 	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/device"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/password"
+	"github.com/cloudlink-omega/accounts/pkg/proxy"
+	"github.com/cloudlink-omega/accounts/pkg/ratelimit"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/oklog/ulid/v2"
 )
 
 type API struct {
 	MailConfig              *structs.MailConfig
+	Outbox                  *email.Outbox
 	ServerNickname          string
 	RouterPath              string
 	EnforceHTTPS            bool
@@ -22,6 +29,10 @@ type API struct {
 	Auth                    *authorization.Auth
 	DB                      *database.Database
 	BypassEmailRegistration bool
+	PasswordPolicy          *password.Policy
+	LoginAlerts             *device.Alerts
+	RateLimiter             *ratelimit.Limiter
+	RateLimits              ratelimit.Policies
 }
 
 type Credentials struct {
@@ -39,7 +50,7 @@ type ValidationData struct {
 	*structs.Claims
 }
 
-func New(router_path string, enforce_https bool, api_domain string, server_url string, server_secret string, db *database.Database, mail_config *structs.MailConfig, nickname string, bypass_email bool) *API {
+func New(router_path string, enforce_https bool, api_domain string, server_url string, server_secret string, db *database.Database, mail_config *structs.MailConfig, outbox *email.Outbox, nickname string, bypass_email bool) *API {
 
 	// Create new instance
 	v := &API{
@@ -48,22 +59,19 @@ func New(router_path string, enforce_https bool, api_domain string, server_url s
 		Auth:                    authorization.New(server_url, server_secret, db),
 		DB:                      db,
 		MailConfig:              mail_config,
+		Outbox:                  outbox,
 		ServerNickname:          nickname,
 		BypassEmailRegistration: bypass_email,
+		PasswordPolicy:          password.DefaultPolicy(),
+		RateLimiter:             ratelimit.New(nil),
+		RateLimits:              DefaultRateLimits(),
 	}
 
 	// Configure default handler for endpoints
 	v.Routes = func(router fiber.Router) {
 
-		// Configure rate limits. Default to 10 request per 30 seconds with a sliding window.
-		router.Use(limiter.New(limiter.Config{
-			Max:               10,
-			Expiration:        30 * time.Second,
-			LimiterMiddleware: limiter.SlidingWindow{},
-			LimitReached: func(c *fiber.Ctx) error {
-				return c.Status(fiber.StatusTooManyRequests).SendString("You're going too damn fast! Please slow down your requests.")
-			},
-		}))
+		// Configure rate limits for each route
+		router.Use(v.rate_limit)
 
 		// General
 		router.Post("/login", v.LoginEndpoint)
@@ -91,10 +99,17 @@ func (v *API) CreateSessionToken(c *fiber.Ctx, user *types.User, session_expiry
 	sessionID := ulid.Make().String()
 
 	// Store the session ID in the database
-	err := v.DB.CreateSession(user, sessionID, string(c.Request().Header.Peek("Origin")), string(c.Request().Header.Peek("User-Agent")), c.IP(), session_expiry)
+	err := v.DB.CreateSession(user, sessionID, string(c.Request().Header.Peek("Origin")), string(c.Request().Header.Peek("User-Agent")), proxy.ClientIP(c), session_expiry)
 	if err != nil {
 		return "", err
 	}
+	v.LoginAlerts.CheckLogin(c, user, sessionID)
+
+	// v0 logins always use the password, and TOTP if the user has it
+	amr := []string{structs.AMR_PASSWORD}
+	if user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		amr = append(amr, structs.AMR_OTP, structs.AMR_MFA)
+	}
 
 	token := v.Auth.Create(&structs.Claims{
 		ClaimType:        0,
@@ -103,6 +118,8 @@ func (v *API) CreateSessionToken(c *fiber.Ctx, user *types.User, session_expiry
 		Username:         user.Username,
 		ULID:             user.ID,
 		IdentityProvider: "local",
+		AuthTime:         jwt.NewNumericDate(time.Now()),
+		AMR:              amr,
 	}, session_expiry)
 
 	// set session token
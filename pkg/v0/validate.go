@@ -23,6 +23,11 @@ func (v *API) ValidateEndpoint(c *fiber.Ctx) error {
 
 	// Read user flags
 	user, _ := v.DB.GetUser(claims.ULID)
+
+	// Report the current username and email, since they may have changed since the token was issued
+	claims.Username = user.Username
+	claims.Email = user.Email
+
 	output := &ValidationData{
 		Claims:        claims,
 		VerifiedEmail: user.State.Read(constants.USER_IS_EMAIL_REGISTERED),
@@ -1,8 +1,6 @@
 package v0
 
 import (
-	"fmt"
-
 	"github.com/cloudlink-omega/accounts/pkg/constants"
 	"github.com/cloudlink-omega/accounts/pkg/email"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
@@ -51,18 +49,25 @@ func (v *API) ResendVerificationEmail(c *fiber.Ctx) error {
 	}
 
 	// Send the verification code to the user's email
-	email.SendPlainEmail(v.MailConfig, &structs.EmailArgs{
-		Subject:  "Verify your account",
+	if err := v.Outbox.Send(&structs.EmailArgs{
 		To:       claims.Email,
 		Nickname: v.ServerNickname,
-	}, fmt.Sprintf(`Hello %s, You are receiving this email because you recently requested another verification code for your CloudLink Omega account on server %s.
-
-		To verify your account, please use the following verification code: %s.
+		Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+	}, email.TEMPLATE_VERIFY_RESEND, map[string]any{
+		"Username": claims.Username,
+		"Code":     code,
+	}); err != nil {
 
-		If you did not create this account, you can safely ignore this email.
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_verify_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
 
-		Regards,
-		- %s.`, claims.Username, v.ServerNickname, code, v.ServerNickname))
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error() + "\nevent_id: " + event_id)
+	}
 
 	// Log the event
 	common.LogEvent(v.DB.DB, &types.UserEvent{
@@ -0,0 +1,60 @@
+package v1
+
+import (
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+)
+
+type ReportLoginArgs struct {
+	Token string `json:"token" form:"token"`
+}
+
+// ReportLoginEndpoint handles the "this wasn't me" link in a login alert. The reported session is logged out, and a
+// recovery code is sent to the user so they can change their password. OAuth-only accounts can't be recovered here,
+// so they are only logged out.
+func (v *API) ReportLoginEndpoint(c *fiber.Ctx) error {
+	var args ReportLoginArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	alert, err := v.DB.UseLoginAlert(args.Token)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if alert == nil {
+		return APIResult(c, fiber.StatusBadRequest, "This link is invalid or has expired.", nil)
+	}
+
+	user, err := v.DB.GetUser(alert.UserID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	if err := v.DB.DeleteSession(alert.SessionID); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_login_reported",
+		Details:    "Session logged out from a login alert",
+		Successful: true,
+	})
+
+	if !v.MailConfig.Enabled || user.State.Read(constants.USER_IS_OAUTH_ONLY) {
+		return APIResult(c, fiber.StatusOK, "OK", fiber.Map{"recovery": false})
+	}
+
+	if event_id, err := v.send_recovery_code(c, user); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	return APIResult(c, fiber.StatusOK, "OK", fiber.Map{
+		"recovery": true,
+		"email":    user.Email,
+	})
+}
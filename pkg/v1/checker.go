@@ -1,6 +1,9 @@
 package v1
 
 import (
+	"fmt"
+
+	"github.com/cloudlink-omega/accounts/pkg/identity"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -20,17 +23,43 @@ func (v *API) UsernameChecker(c *fiber.Ctx) error {
 		return APIResult(c, fiber.StatusBadRequest, "Missing username parameter.", nil)
 	}
 
-	// Require username to be less than 20 characters
-	if len(args.Username) > 20 {
-		return APIResult(c, fiber.StatusBadRequest, "Username too long.", nil)
+	// Require the username to follow the naming rules
+	username, err := identity.NormalizeUsername(args.Username)
+	if err == identity.ErrUsernameReserved {
+		return APIResult(c, fiber.StatusConflict, "Username unavailable.", nil)
+	} else if err != nil {
+		return APIResult(c, fiber.StatusBadRequest, fmt.Sprintf("Invalid username: %s.", err), nil)
 	}
 
-	// Ask the database if the username is available
-	if exists, err := v.DB.DoesNameExist(args.Username); err != nil {
+	// Ask the database if the username (or a lookalike of it) is available
+	if exists, err := v.DB.DoesNameExist(username); err != nil {
 		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
 	} else if exists {
 		return APIResult(c, fiber.StatusConflict, "Username unavailable.", nil)
 	}
 
-	return APIResult(c, fiber.StatusOK, "Username available.", nil)
+	// Return the normalized username, since it may differ from what was requested
+	return APIResult(c, fiber.StatusOK, "Username available.", username)
+}
+
+type PasswordCheckArgs struct {
+	Username string `json:"username" form:"username"`
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+func (v *API) PasswordChecker(c *fiber.Ctx) error {
+
+	var args PasswordCheckArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	// Check the password against every rule, so the client can show which ones still fail
+	result := v.PasswordPolicy.Check(args.Password, args.Username, args.Email)
+	if !result.Valid() {
+		return APIResult(c, fiber.StatusBadRequest, "Password does not meet the requirements.", result)
+	}
+
+	return APIResult(c, fiber.StatusOK, "Password acceptable.", result)
 }
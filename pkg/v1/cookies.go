@@ -7,16 +7,47 @@ import (
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 )
 
-func (v *API) SetCookie(user *types.User, session_id string, expiration time.Time, c *fiber.Ctx) {
+func (v *API) SetCookie(user *types.User, session_id string, identity_provider string, amr []string, expiration time.Time, c *fiber.Ctx) {
 	token := v.Auth.Create(&structs.Claims{
 		ClaimType:        0,
 		SessionID:        session_id,
 		Email:            user.Email,
 		Username:         user.Username,
 		ULID:             user.ID,
-		IdentityProvider: "local",
+		IdentityProvider: identity_provider,
+		AuthTime:         jwt.NewNumericDate(time.Now()),
+		AMR:              amr,
+	}, expiration)
+	c.Cookie(&fiber.Cookie{
+		Name:     "clomega-authorization",
+		Value:    token,
+		Path:     "/",
+		Expires:  expiration,
+		Secure:   v.EnforceHTTPS,
+		Domain:   domain.GetDomain(c.Hostname()),
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
+
+// RefreshCookie replaces the session cookie with one containing the user's current details, keeping the same session.
+// The authentication time and methods are taken from the claims, so re-authenticating can update them.
+func (v *API) RefreshCookie(user *types.User, claims *structs.Claims, c *fiber.Ctx) {
+	expiration := time.Now().Add(24 * time.Hour)
+	if claims.ExpiresAt != nil {
+		expiration = claims.ExpiresAt.Time
+	}
+	token := v.Auth.Create(&structs.Claims{
+		ClaimType:        0,
+		SessionID:        claims.SessionID,
+		Email:            user.Email,
+		Username:         user.Username,
+		ULID:             user.ID,
+		IdentityProvider: claims.IdentityProvider,
+		AuthTime:         claims.AuthTime,
+		AMR:              claims.AMR,
 	}, expiration)
 	c.Cookie(&fiber.Cookie{
 		Name:     "clomega-authorization",
@@ -69,3 +100,14 @@ func (v *API) ClearRecoveryCookie(c *fiber.Ctx) {
 		SameSite: fiber.CookieSameSiteNoneMode,
 	})
 }
+
+func (v *API) ClearMFACookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "clomega-mfa",
+		Path:     "/",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		Secure:   true,
+		Domain:   domain.GetDomain(c.Hostname()),
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
@@ -0,0 +1,76 @@
+package v1
+
+import (
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/proxy"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Kinds of credential changes passed to credentials_changed, and shown in the email sent to the user.
+const (
+	CREDENTIAL_PASSWORD = "password"
+	CREDENTIAL_RECOVERY = "recovery"
+	CREDENTIAL_TOTP     = "totp"
+	CREDENTIAL_EMAIL    = "email"
+)
+
+// Runs after the user's password, email address or TOTP changes, or their account is recovered. Whoever else may have
+// been in the account loses access: every session other than keep_session is logged out, and outstanding verification
+// codes and magic links are discarded. The user is then told about the change by email, in case it wasn't them.
+func (v *API) credentials_changed(c *fiber.Ctx, user *types.User, change string, keep_session string) error {
+	var keep []string
+	if keep_session != "" {
+		keep = append(keep, keep_session)
+	}
+	if err := v.DB.DeleteAllSessions(user.ID, keep...); err != nil {
+		return err
+	}
+	if err := v.DB.DeleteVerificationCodes(user.ID); err != nil {
+		return err
+	}
+	if err := v.DB.DeleteMagicLinks(user.ID); err != nil {
+		return err
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_credentials_changed",
+		Details:    "Changed " + change + ", other sessions logged out",
+		Successful: true,
+	})
+
+	if !v.MailConfig.Enabled || user.State.Read(constants.USER_IS_EMAIL_DISABLED) {
+		return nil
+	}
+
+	if err := v.Outbox.Send(&structs.EmailArgs{
+		To:       user.Email,
+		Nickname: v.ServerNickname,
+		Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+	}, email.TEMPLATE_CREDENTIALS_CHANGED, map[string]any{
+		"Username":  user.Username,
+		"Change":    change,
+		"Date":      time.Now().UTC().Format("January 2, 2006 at 15:04 MST"),
+		"IP":        proxy.ClientIP(c),
+		"UserAgent": c.Get(fiber.HeaderUserAgent),
+		"Link":      v.ServerURL + v.RouterPath + "/recovery",
+	}); err != nil {
+
+		// Log the event
+		common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_credentials_changed_email_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package v1
+
+import (
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Default for DeletionGracePeriod.
+const DEFAULT_DELETION_GRACE_PERIOD = 30 * 24 * time.Hour
+
+func (v *API) DeleteAccountEndpoint(c *fiber.Ctx) error {
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	scheduled_for := time.Now().Add(v.DeletionGracePeriod)
+	if err := v.DB.ScheduleDeletion(user.ID, scheduled_for); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_deletion_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Log out everywhere, since logging in again cancels the deletion
+	if err := v.DB.DeleteAllSessions(user.ID); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	v.ClearCookie(c)
+
+	// Confirm the deletion by email
+	if v.MailConfig.Enabled {
+		if err := v.Outbox.Send(&structs.EmailArgs{
+			To:       user.Email,
+			Nickname: v.ServerNickname,
+			Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+		}, email.TEMPLATE_DELETION_SCHEDULED, map[string]any{
+			"Username": user.Username,
+			"Date":     scheduled_for.UTC().Format("January 2, 2006 at 15:04 MST"),
+		}); err != nil {
+
+			// Log the event
+			common.LogEvent(v.DB.DB, &types.UserEvent{
+				UserID:     user.ID,
+				EventID:    "user_deletion_failure",
+				Details:    err.Error(),
+				Successful: false,
+			})
+		}
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_deletion_scheduled",
+		Details:    "Scheduled for " + scheduled_for.UTC().Format(time.RFC3339),
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", scheduled_for)
+}
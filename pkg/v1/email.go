@@ -0,0 +1,313 @@
+package v1
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	math_rand "math/rand"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/identity"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+)
+
+// How long the old address can revert an email change for.
+const EMAIL_REVERT_DAYS = 7
+
+type ChangeEmailArgs struct {
+	Email string `json:"email" form:"email"`
+}
+
+type ConfirmEmailChangeArgs struct {
+	Code string `json:"code" form:"code"`
+}
+
+type RevertEmailChangeArgs struct {
+	Token string `json:"token" form:"token"`
+}
+
+func (v *API) ChangeEmailEndpoint(c *fiber.Ctx) error {
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	var args ChangeEmailArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	if !v.MailConfig.Enabled {
+		return APIResult(c, fiber.StatusBadRequest, "Email is disabled on this server. Please contact an administrator to change your email.", nil)
+	}
+
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Check the new address
+	new_email, err := identity.NormalizeEmail(args.Email)
+	if err != nil {
+		return APIResult(c, fiber.StatusBadRequest, fmt.Sprintf("Invalid email: %s.", err), nil)
+	}
+	if identity.EmailKey(new_email) == identity.EmailKey(user.Email) {
+		return APIResult(c, fiber.StatusBadRequest, "That's already your email address.", nil)
+	}
+	if existing, err := v.DB.GetUserByEmail(new_email); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if existing != nil {
+		return APIResult(c, fiber.StatusConflict, "That email is already in use.", nil)
+	}
+
+	// Generate a random 6-digit verification code
+	code := fmt.Sprintf("%06d", math_rand.Intn(1000000))
+
+	// Store the request, with a 15 minute expiration
+	if err := v.DB.CreateEmailChange(&database.EmailChange{
+		UserID:      user.ID,
+		OldEmail:    user.Email,
+		OldVerified: user.State.Read(constants.USER_IS_EMAIL_REGISTERED),
+		NewEmail:    new_email,
+		Code:        code,
+		ExpiresAt:   time.Now().Add(15 * time.Minute),
+	}); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_email_change_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Send the verification code to the new address
+	if err := v.Outbox.Send(&structs.EmailArgs{
+		To:       new_email,
+		Nickname: v.ServerNickname,
+		Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+	}, email.TEMPLATE_EMAIL_CHANGE_CODE, map[string]any{
+		"Username": user.Username,
+		"Code":     code,
+	}); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_email_change_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_email_change_requested",
+		Details:    "",
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
+
+func (v *API) ConfirmEmailChangeEndpoint(c *fiber.Ctx) error {
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	var args ConfirmEmailChangeArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	change, err := v.DB.GetPendingEmailChange(user.ID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if change == nil {
+		return APIResult(c, fiber.StatusBadRequest, "No email change is pending. Please start over.", nil)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(change.Code), []byte(args.Code)) != 1 {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_email_change_failure",
+			Details:    "Invalid verification code",
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusUnauthorized, "Invalid verification code!", nil, event_id)
+	}
+
+	// The address may have been taken while the change was pending
+	if existing, err := v.DB.GetUserByEmail(change.NewEmail); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if existing != nil {
+		return APIResult(c, fiber.StatusConflict, "That email is already in use.", nil)
+	}
+
+	// Generate a token for the old address to revert the change with
+	revert_token, err := random_token()
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Switch to the new address. The change is only used up if this succeeds, so it can be retried otherwise.
+	if err := v.DB.ConfirmEmailChange(change, revert_token, EMAIL_REVERT_DAYS*24*time.Hour); errors.Is(err, database.ErrEmailInUse) {
+		return APIResult(c, fiber.StatusConflict, "That email is already in use.", nil)
+
+	} else if errors.Is(err, database.ErrEmailChangeUsed) {
+		return APIResult(c, fiber.StatusBadRequest, "No email change is pending. Please start over.", nil)
+
+	} else if err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_email_change_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// The new address has been verified by the code, so it can receive email again
+	user.Email = change.NewEmail
+	user.State.Set(constants.USER_IS_EMAIL_REGISTERED)
+	user.State.Set(constants.USER_IS_ACTIVE)
+	user.State.Clear(constants.USER_IS_EMAIL_DISABLED)
+	if err := v.DB.UpdateUserState(user.ID, user.State); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Log out everywhere else
+	if err := v.credentials_changed(c, user, CREDENTIAL_EMAIL, claims.SessionID); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Update the email stored in the session cookie
+	v.RefreshCookie(user, claims, c)
+
+	// Let the old address know, and give it a way to undo the change
+	if err := v.Outbox.Send(&structs.EmailArgs{
+		To:       change.OldEmail,
+		Nickname: v.ServerNickname,
+		Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+	}, email.TEMPLATE_EMAIL_CHANGED, map[string]any{
+		"Username": user.Username,
+		"NewEmail": change.NewEmail,
+		"Days":     EMAIL_REVERT_DAYS,
+		"Link":     v.ServerURL + v.RouterPath + "/revert-email?token=" + revert_token,
+	}); err != nil {
+
+		// Log the event
+		common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_email_change_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_email_changed",
+		Details:    "",
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
+
+func (v *API) RevertEmailChangeEndpoint(c *fiber.Ctx) error {
+	var args RevertEmailChangeArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	change, err := v.DB.GetRevertableEmailChange(args.Token)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if change == nil {
+		return APIResult(c, fiber.StatusBadRequest, "This link is invalid or has expired.", nil)
+	}
+
+	user, err := v.DB.GetUser(change.UserID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// The old address may have been registered to another account since
+	if existing, err := v.DB.GetUserByEmail(change.OldEmail); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if existing != nil && existing.ID != user.ID {
+		return APIResult(c, fiber.StatusConflict, "Your old email address is now in use by another account. Please contact an administrator.", nil)
+	}
+
+	// Restore the old address. The link is only used up if this succeeds.
+	if err := v.DB.RevertEmailChange(change); errors.Is(err, database.ErrEmailInUse) {
+		return APIResult(c, fiber.StatusConflict, "Your old email address is now in use by another account. Please contact an administrator.", nil)
+
+	} else if errors.Is(err, database.ErrEmailChangeUsed) {
+		return APIResult(c, fiber.StatusBadRequest, "This link is invalid or has expired.", nil)
+
+	} else if err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_email_revert_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+	user.Email = change.OldEmail
+	if change.OldVerified {
+		user.State.Set(constants.USER_IS_EMAIL_REGISTERED)
+	} else {
+		user.State.Clear(constants.USER_IS_EMAIL_REGISTERED)
+	}
+	if err := v.DB.UpdateUserState(user.ID, user.State); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Whoever changed the address may still be logged in
+	if err := v.credentials_changed(c, user, CREDENTIAL_EMAIL, ""); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_email_reverted",
+		Details:    "Reverted change to " + change.NewEmail,
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
@@ -0,0 +1,289 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/export"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// How long a finished export can be downloaded for.
+const EXPORT_LIFETIME = 24 * time.Hour
+
+// Minimum time between export requests, since building one is expensive.
+const EXPORT_COOLDOWN = time.Hour
+
+// Defaults for the export worker.
+const (
+	EXPORT_LEASE      = 10 * time.Minute // How long a worker has to build an export it claimed before another may retry it.
+	EXPORT_BATCH_SIZE = 10               // Most exports built per pass of the worker.
+)
+
+type ExportArgs struct {
+	Format string `json:"format" form:"format"`
+}
+
+type ExportStatus struct {
+	Status      string    `json:"status"`
+	Format      string    `json:"format"`
+	Error       string    `json:"error,omitempty"`
+	DownloadURL string    `json:"download_url,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func (v *API) RequestExportEndpoint(c *fiber.Ctx) error {
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	var args ExportArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+	if args.Format == "" {
+		args.Format = export.FORMAT_ZIP
+	}
+	if args.Format != export.FORMAT_JSON && args.Format != export.FORMAT_ZIP {
+		return APIResult(c, fiber.StatusBadRequest, "Format must be either \"json\" or \"zip\".", nil)
+	}
+
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Only allow one export at a time
+	latest, err := v.DB.GetLatestExport(user.ID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if latest != nil && latest.Status != database.EXPORT_FAILED && time.Since(latest.CreatedAt) < EXPORT_COOLDOWN {
+		return APIResult(c, fiber.StatusTooManyRequests, "You've already requested an export recently. Please wait for it to finish, or try again later.", v.export_status(latest))
+	}
+
+	record, err := v.DB.CreateExport(user.ID, args.Format, email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)), time.Now().Add(EXPORT_LIFETIME))
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Let the worker build the archive, since it may take a while for users with a long history
+	select {
+	case v.export_wake <- struct{}{}:
+	default:
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_export_requested",
+		Details:    "Format: " + args.Format,
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusAccepted, "OK", v.export_status(record))
+}
+
+func (v *API) ExportStatusEndpoint(c *fiber.Ctx) error {
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	latest, err := v.DB.GetLatestExport(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if latest == nil {
+		return APIResult(c, fiber.StatusNotFound, "No export has been requested.", nil)
+	}
+
+	return APIResult(c, fiber.StatusOK, "OK", v.export_status(latest))
+}
+
+func (v *API) DownloadExportEndpoint(c *fiber.Ctx) error {
+	token, err := v.Auth.GetExportToken(c.Query("token"))
+	if err != nil {
+		return APIResult(c, fiber.StatusUnauthorized, "This download link is invalid or has expired.", nil)
+	}
+
+	record, err := v.DB.GetExport(token.ExportID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if record == nil || record.UserID != token.UserID || record.Status != database.EXPORT_READY {
+		return APIResult(c, fiber.StatusNotFound, "This download link is invalid or has expired.", nil)
+	}
+
+	// Only load the archive once the link is known to be good
+	data, err := v.DB.GetExportData(record.ID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if data == nil {
+		return APIResult(c, fiber.StatusNotFound, "This download link is invalid or has expired.", nil)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     record.UserID,
+		EventID:    "user_export_downloaded",
+		Details:    "",
+		Successful: true,
+	})
+
+	content_type := "application/zip"
+	if record.Format == export.FORMAT_JSON {
+		content_type = "application/json"
+	}
+	c.Set(fiber.HeaderContentType, content_type)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="clomega-export-%s.%s"`, record.CreatedAt.UTC().Format("2006-01-02"), record.Format))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Status(fiber.StatusOK).Send(data)
+}
+
+// BuildExports makes a single pass over the pending data exports, building each one that no other worker is.
+func (v *API) BuildExports() (built int, err error) {
+	due, err := v.DB.GetDueExports(EXPORT_BATCH_SIZE)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, record := range due {
+
+		// Another worker may have picked it up already
+		if claimed, err := v.DB.ClaimExport(record, EXPORT_LEASE); err != nil {
+			return built, err
+		} else if !claimed {
+			continue
+		}
+
+		if err := v.build_export(record); err != nil {
+			return built, err
+		}
+		built++
+	}
+
+	return built, nil
+}
+
+// StartExports builds data exports in the background every interval, or as soon as they are requested, until the
+// returned function is called. Stopping waits for the export being built to be stored; exports that haven't been
+// started are left pending for the next time the worker runs.
+func (v *API) StartExports(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+			case <-v.export_wake:
+			case <-done:
+				ticker.Stop()
+				return
+			}
+			if _, err := v.BuildExports(); err != nil {
+				log.Error("Failed to build data exports: ", err)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Collects and archives the user's data, then lets them know it's ready to download.
+// Only returns an error if the result couldn't be stored.
+func (v *API) build_export(record *database.DataExport) error {
+	var archive []byte
+	var err error
+
+	user, err := v.DB.GetUser(record.UserID)
+	if err == nil && user == nil {
+		err = errors.New("account no longer exists")
+	}
+
+	// Decryption panics on failure, so make sure it doesn't take the server down with it
+	if err == nil {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%v", r)
+				}
+			}()
+			var data *export.UserData
+			if data, err = export.Collect(v.DB, user.ID); err == nil {
+				archive, err = export.Archive(data, record.Format)
+			}
+		}()
+	}
+
+	stored, store_err := v.DB.FinishExport(record.ID, archive, err)
+	if store_err != nil {
+		return store_err
+	}
+
+	if err != nil {
+
+		// Log the event
+		common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     record.UserID,
+			EventID:    "user_export_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+		return nil
+	}
+
+	// Send the download link by email
+	if v.MailConfig.Enabled {
+		if err := v.Outbox.Send(&structs.EmailArgs{
+			To:       user.Email,
+			Nickname: v.ServerNickname,
+			Locale:   stored.Locale,
+		}, email.TEMPLATE_EXPORT_READY, map[string]any{
+			"Username": user.Username,
+			"Link":     v.export_status(stored).DownloadURL,
+			"Date":     stored.ExpiresAt.UTC().Format("January 2, 2006 at 15:04 MST"),
+		}); err != nil {
+
+			// Log the event
+			common.LogEvent(v.DB.DB, &types.UserEvent{
+				UserID:     user.ID,
+				EventID:    "user_export_failure",
+				Details:    err.Error(),
+				Successful: false,
+			})
+		}
+	}
+
+	return nil
+}
+
+// Describes an export, including a signed download link if it's ready.
+func (v *API) export_status(record *database.DataExport) *ExportStatus {
+	status := &ExportStatus{
+		Status:    record.Status,
+		Format:    record.Format,
+		Error:     record.Error,
+		ExpiresAt: record.ExpiresAt,
+	}
+	if record.Status == database.EXPORT_READY {
+		token := v.Auth.Create(&structs.ExportToken{ExportID: record.ID, UserID: record.UserID}, record.ExpiresAt)
+		status.DownloadURL = fmt.Sprintf("%s%s/api/v1/export/download?token=%s", v.ServerURL, v.RouterPath, token)
+	}
+	return status
+}
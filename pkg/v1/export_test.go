@@ -0,0 +1,90 @@
+package v1
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Reads the status of the client's latest export.
+func (c *test_client) export_status() *ExportStatus {
+	c.t.Helper()
+	var status ExportStatus
+	if err := json.Unmarshal(c.do(fiber.MethodGet, "/api/v1/export/status", nil).expect(c.t, fiber.StatusOK).Data, &status); err != nil {
+		c.t.Fatal(err)
+	}
+	return &status
+}
+
+func TestExport(t *testing.T) {
+	api, app := new_test_api(t)
+	api.MailConfig = &structs.MailConfig{}
+	user := new_test_user(t, api)
+	client := new_test_client(t, app)
+	client.login(user)
+
+	// Exports are left for the worker to build
+	client.do(fiber.MethodPost, "/api/v1/export", fiber.Map{"format": "json"}).expect(t, fiber.StatusAccepted)
+	if status := client.export_status(); status.Status != database.EXPORT_PENDING || status.DownloadURL != "" {
+		t.Fatalf("export was %s before the worker ran", status.Status)
+	}
+
+	// Only one worker gets to build it
+	due, err := api.DB.GetDueExports(EXPORT_BATCH_SIZE)
+	if err != nil || len(due) != 1 {
+		t.Fatalf("%d exports due: %v", len(due), err)
+	}
+	record := due[0]
+	if claimed, err := api.DB.ClaimExport(record, EXPORT_LEASE); err != nil || !claimed {
+		t.Fatalf("claimed = %v, err = %v", claimed, err)
+	}
+	if claimed, err := api.DB.ClaimExport(record, EXPORT_LEASE); err != nil || claimed {
+		t.Fatalf("claimed twice: %v", err)
+	}
+	if due, err := api.DB.GetDueExports(EXPORT_BATCH_SIZE); err != nil || len(due) != 0 {
+		t.Fatalf("%d exports due while leased: %v", len(due), err)
+	}
+
+	// The stored export is returned without the archive
+	archive := []byte(`{"profile":{}}`)
+	stored, err := api.DB.FinishExport(record.ID, archive, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != database.EXPORT_READY || stored.Data != nil || stored.Locale != record.Locale {
+		t.Fatalf("stored %+v", stored)
+	}
+	status := client.export_status()
+	if status.Status != database.EXPORT_READY || status.DownloadURL == "" {
+		t.Fatalf("export was %s once stored", status.Status)
+	}
+	link, err := url.Parse(status.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The link downloads the archive, without needing a session
+	anonymous := new_test_client(t, app)
+	anonymous.do(fiber.MethodGet, "/api/v1/export/download?token="+url.QueryEscape(link.Query().Get("token")), nil).expect(t, fiber.StatusOK)
+
+	// But only for the user it was made for
+	other := new_test_user(t, api)
+	forged := api.Auth.Create(&structs.ExportToken{ExportID: record.ID, UserID: other.ID}, time.Now().Add(time.Hour))
+	anonymous.do(fiber.MethodGet, "/api/v1/export/download?token="+url.QueryEscape(forged), nil).expect(t, fiber.StatusNotFound)
+	anonymous.do(fiber.MethodGet, "/api/v1/export/download?token=invalid", nil).expect(t, fiber.StatusUnauthorized)
+
+	// Failed exports can't be downloaded, and can be requested again right away
+	if stored, err := api.DB.FinishExport(record.ID, nil, errors.New("failed")); err != nil || stored.Status != database.EXPORT_FAILED {
+		t.Fatalf("stored %+v: %v", stored, err)
+	}
+	if data, err := api.DB.GetExportData(record.ID); err != nil || data != nil {
+		t.Fatalf("failed export has data: %v", err)
+	}
+	client.do(fiber.MethodPost, "/api/v1/export", fiber.Map{"format": "zip"}).expect(t, fiber.StatusAccepted)
+}
@@ -0,0 +1,15 @@
+package v1
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Returns a random 256-bit token, encoded as hex.
+func random_token() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
@@ -1,18 +1,15 @@
 package v1
 
 import (
-	"fmt"
-	"slices"
-	"strconv"
 	"time"
 
 	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/cloudlink-omega/storage/pkg/common"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	scrypt "github.com/elithrar/simple-scrypt"
 	"github.com/gofiber/fiber/v2"
-	"github.com/pquerna/otp"
-	"github.com/pquerna/otp/totp"
 )
 
 func (v *API) LoginEndpoint(c *fiber.Ctx) error {
@@ -61,99 +58,29 @@ func (v *API) LoginEndpoint(c *fiber.Ctx) error {
 		return APIResult(c, fiber.StatusBadRequest, "Missing password.", nil)
 	}
 
-	// Check if the password has six numbers at the end (legacy client compatibility). If so, read it as TOTP and trim it from the password.
-	if totp, err := strconv.Atoi(creds.Password[len(creds.Password)-6:]); err == nil {
-		creds.TOTP = fmt.Sprintf("%06d", totp)
-		creds.Password = creds.Password[:len(creds.Password)-6]
-	}
-
 	// Verify password
 	if scrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password)) != nil {
 		return APIResult(c, fiber.StatusUnauthorized, "Invalid password.", nil)
 	}
 
-	// Check if TOTP is required
-	if user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+	// Blocked and banned accounts can't be logged into
+	if database.UserBlocked(user) {
+		return APIResult(c, fiber.StatusForbidden, "This account has been disabled.", nil)
+	}
+
+	// Accounts with a second factor need it to finish logging in. Clients may send a TOTP or backup code along with
+	// the password, otherwise they are given an mfa_token to send it to the MFA endpoint.
+	if has_mfa, err := v.DB.HasSecondFactor(user); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if has_mfa {
 		if creds.TOTP == "" && creds.BackupCode == "" {
-			return APIResult(c, fiber.StatusBadRequest, "TOTP required!", nil)
-
-		} else if creds.TOTP != "" {
-
-			// Get secret
-			secret := v.DB.GetTotpSecret(user)
-
-			// Verify the TOTP
-			success, err := totp.ValidateCustom(
-				creds.TOTP,
-				secret,
-				time.Now().UTC(),
-				totp.ValidateOpts{
-					Digits:    otp.DigitsSix,
-					Period:    30,
-					Skew:      1,
-					Algorithm: otp.AlgorithmSHA512,
-				})
-			if err != nil {
-
-				// Log the event
-				event_id := common.LogEvent(v.DB.DB, &types.SystemEvent{
-					EventID:    "totp_error",
-					Details:    err.Error(),
-					Successful: false,
-				})
-
-				return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
-			}
-
-			if !success {
-				return APIResult(c, fiber.StatusUnauthorized, "Invalid TOTP!", nil)
-			}
-
-		} else {
-			// Verify the backup code
-
-			// Get backup codes
-			backupCodes, err := v.DB.GetRecoveryCodes(user)
-			if err != nil {
-
-				// Log the event
-				event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
-					UserID:     user.ID,
-					EventID:    "recovery_code_retrieval_error",
-					Details:    err.Error(),
-					Successful: false,
-				})
-
-				return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
-			}
-
-			// Check if there is a match in the backup codes
-			match := slices.Contains(backupCodes, creds.BackupCode)
-			if !match {
-				return APIResult(c, fiber.StatusUnauthorized, "Invalid backup code!", nil)
-			}
-
-			// Delete the backup code
-			backupCodes = slices.Delete(backupCodes, slices.Index(backupCodes, creds.BackupCode), 1)
-
-			// Update the backup codes
-			if err := v.DB.StoreRecoveryCodes(user, backupCodes); err != nil {
-
-				// Log the event
-				event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
-					UserID:     user.ID,
-					EventID:    "recovery_code_store_error",
-					Details:    err.Error(),
-					Successful: false,
-				})
-
-				return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
-			}
+			return v.require_mfa(c, user, "local")
 		}
+		return v.complete_mfa(c, user, "local", creds.TOTP, creds.BackupCode)
 	}
 
 	// Create a new session
-	if err := v.CreateSession(c, user, time.Now().Add(24*time.Hour)); err != nil {
+	if err := v.CreateSession(c, user, []string{structs.AMR_PASSWORD}, time.Now().Add(24*time.Hour)); err != nil {
 		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
 	}
 
@@ -0,0 +1,232 @@
+package v1
+
+import (
+	"fmt"
+	math_rand "math/rand"
+	"net/url"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/sanitizer"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+)
+
+// How long a magic link (and its code) can be used for.
+const MAGIC_LINK_LIFETIME = 15 * time.Minute
+
+type MagicLinkArgs struct {
+	Email    string `json:"email" form:"email"`
+	Redirect string `json:"redirect" form:"redirect"`
+}
+
+type ConfirmMagicLinkArgs struct {
+	Token string `json:"token" form:"token"` // The signed token from the emailed link, or...
+	Email string `json:"email" form:"email"` // ...the email address and...
+	Code  string `json:"code" form:"code"`   // ...the emailed code.
+	TOTP  string `json:"totp" form:"totp"`
+}
+
+func (v *API) SendMagicLinkEndpoint(c *fiber.Ctx) error {
+
+	// Check if the user is already logged in. If so, tell them
+	if v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusBadRequest, "Already logged in!", nil)
+	}
+
+	if !v.MailConfig.Enabled {
+		return APIResult(c, fiber.StatusServiceUnavailable, "Passwordless login is unavailable because email is not enabled.", nil)
+	}
+
+	var args MagicLinkArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	if args.Email == "" {
+		return APIResult(c, fiber.StatusBadRequest, "Missing email.", nil)
+	}
+
+	user, err := v.DB.GetUserByEmail(args.Email)
+	if err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.SystemEvent{
+			EventID:    "get_user_error",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// For security reasons we never leak that an account exists or not, or whether it can receive email or log in
+	if user == nil || user.State.Read(constants.USER_IS_EMAIL_DISABLED) || database.UserBlocked(user) {
+		return APIResult(c, fiber.StatusOK, "OK", nil)
+	}
+
+	// Generate a random 6-digit code, which can be entered instead of opening the link
+	code := fmt.Sprintf("%06d", math_rand.Intn(1000000))
+
+	// Store the link, replacing any that were sent before
+	link, err := v.DB.CreateMagicLink(user.ID, code, time.Now().Add(MAGIC_LINK_LIFETIME))
+	if err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_magic_link_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Sign the link, so it can't be guessed from its ID
+	token := v.Auth.Create(&structs.MagicLinkToken{LinkID: link.ID, UserID: user.ID}, link.ExpiresAt)
+	login_url := fmt.Sprintf("%s%s/magic?token=%s&redirect=%s", v.ServerURL, v.RouterPath, token, url.QueryEscape(sanitizer.Sanitized(c, args.Redirect)))
+
+	// Send the link and code to the user's email
+	if err := v.Outbox.Send(&structs.EmailArgs{
+		To:       user.Email,
+		Nickname: v.ServerNickname,
+		Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+	}, email.TEMPLATE_MAGIC_LINK, map[string]any{
+		"Username": user.Username,
+		"Link":     login_url,
+		"Code":     code,
+	}); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_magic_link_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_magic_link_sent",
+		Details:    "",
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
+
+func (v *API) ConfirmMagicLinkEndpoint(c *fiber.Ctx) error {
+
+	// Check if the user is already logged in. If so, tell them
+	if v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusBadRequest, "Already logged in!", nil)
+	}
+
+	var args ConfirmMagicLinkArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	var user *types.User
+	var link *database.MagicLink
+	var err error
+
+	if args.Token != "" {
+
+		// Opened from the emailed link
+		magic, err := v.Auth.GetMagicLinkToken(args.Token)
+		if err != nil {
+			return APIResult(c, fiber.StatusUnauthorized, "This sign-in link is invalid or has expired.", nil)
+		}
+		if user, err = v.DB.GetUser(magic.UserID); err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+		if link, err = v.DB.GetMagicLink(magic.LinkID, magic.UserID); err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+		if link == nil {
+			return APIResult(c, fiber.StatusUnauthorized, "This sign-in link is invalid or has expired.", nil)
+		}
+
+	} else {
+
+		// Entered the emailed code
+		if args.Email == "" || args.Code == "" {
+			return APIResult(c, fiber.StatusBadRequest, "Missing email or code.", nil)
+		}
+		if user, err = v.DB.GetUserByEmail(args.Email); err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+
+		// Don't leak whether the account exists
+		if user == nil {
+			return APIResult(c, fiber.StatusUnauthorized, "Invalid or expired code.", nil)
+		}
+		if link, err = v.DB.CheckMagicLinkCode(user.ID, args.Code); err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+		if link == nil {
+
+			// Log the event
+			common.LogEvent(v.DB.DB, &types.UserEvent{
+				UserID:     user.ID,
+				EventID:    "user_magic_link_failure",
+				Details:    "Invalid code",
+				Successful: false,
+			})
+
+			return APIResult(c, fiber.StatusUnauthorized, "Invalid or expired code.", nil)
+		}
+	}
+
+	// Blocked and banned accounts can't be logged into
+	if database.UserBlocked(user) {
+		return APIResult(c, fiber.StatusForbidden, "This account has been disabled.", nil)
+	}
+
+	// The link only replaces the password, so a second factor is still required if the user has one.
+	// With a security key, the link is used up once the key has been checked.
+	if required, err := v.requires_webauthn(user, args.TOTP, ""); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if required {
+		return v.begin_webauthn_mfa(c, user, &structs.WebAuthnCeremony{MagicLinkID: link.ID})
+	}
+	if status, err := v.verify_totp(user, args.TOTP); err != nil {
+		return APIResult(c, status, err.Error(), nil)
+	}
+
+	// Links can only be used once
+	if used, err := v.DB.UseMagicLink(link); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if !used {
+		return APIResult(c, fiber.StatusUnauthorized, "This sign-in link is invalid or has expired.", nil)
+	}
+
+	// Create a new session
+	amr := []string{structs.AMR_EMAIL}
+	if user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		amr = append(amr, structs.AMR_OTP, structs.AMR_MFA)
+	}
+	if err := v.CreateSession(c, user, amr, time.Now().Add(24*time.Hour)); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_login",
+		Details:    "Logged in using a magic link",
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
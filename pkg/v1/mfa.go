@@ -0,0 +1,172 @@
+package v1
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+)
+
+// How long a user has to provide their second factor after giving their password.
+const MFA_TOKEN_LIFETIME = 5 * time.Minute
+
+type MFAArgs struct {
+	MFAToken   string `json:"mfa_token" form:"mfa_token"`
+	TOTP       string `json:"totp" form:"totp"`
+	BackupCode string `json:"backup_code" form:"backup_code"`
+}
+
+// MFAEndpoint completes a login for an account with a second factor. The user has already given their password, and
+// holds the mfa_token returned by LoginEndpoint, or signed in with an OAuth provider, and holds the MFA cookie. This
+// only checks their TOTP, backup code or security key before creating the session.
+func (v *API) MFAEndpoint(c *fiber.Ctx) error {
+
+	// Check if the user is already logged in. If so, tell them
+	if v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusBadRequest, "Already logged in!", nil)
+	}
+
+	var args MFAArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	var pending *structs.MFAPending
+	var err error
+	if args.MFAToken != "" {
+		pending, err = v.Auth.GetMFAToken(args.MFAToken)
+	} else {
+		pending, err = v.Auth.GetMFAPending(c)
+	}
+	if err != nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Your sign-in has expired. Please try again.", nil)
+	}
+
+	user, err := v.DB.GetUser(pending.UserID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if user == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Your sign-in has expired. Please try again.", nil)
+	}
+
+	return v.complete_mfa(c, user, pending.Provider, args.TOTP, args.BackupCode)
+}
+
+// Responds to a login for an account with a second factor with an mfa_token and the factors that can be used with it,
+// so the client can finish the login at MFAEndpoint without sending the password again.
+func (v *API) require_mfa(c *fiber.Ctx, user *types.User, identity_provider string) error {
+	factors := []string{}
+	if user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		factors = append(factors, "totp", "backup_code")
+	}
+	if has, err := v.DB.HasWebAuthnCredentials(user.ID); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if has {
+		factors = append(factors, "webauthn")
+	}
+
+	expiration := time.Now().Add(MFA_TOKEN_LIFETIME)
+	token := v.Auth.Create(&structs.MFAPending{
+		UserID:   user.ID,
+		Provider: identity_provider,
+	}, expiration)
+
+	return APIResult(c, fiber.StatusBadRequest, "MFA required!", fiber.Map{
+		"mfa_token":  token,
+		"factors":    factors,
+		"expires_at": expiration.Unix(),
+	})
+}
+
+// Checks the second factor of a user who has already been identified, then creates the session. Without a TOTP or
+// backup code, users with a security key are asked to use it instead.
+func (v *API) complete_mfa(c *fiber.Ctx, user *types.User, identity_provider string, totp_code string, backup_code string) error {
+
+	// The account may have been blocked since the first factor was checked
+	if database.UserBlocked(user) {
+		return APIResult(c, fiber.StatusForbidden, "This account has been disabled.", nil)
+	}
+
+	// Check if a security key is required
+	if required, err := v.requires_webauthn(user, totp_code, backup_code); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if required {
+		return v.begin_webauthn_mfa(c, user, &structs.WebAuthnCeremony{Provider: identity_provider})
+	}
+
+	if backup_code != "" && user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		if status, err := v.use_recovery_code(user, backup_code); err != nil {
+			return APIResult(c, status, err.Error(), nil)
+		}
+	} else if status, err := v.verify_totp(user, totp_code); err != nil {
+		return APIResult(c, status, err.Error(), nil)
+	}
+
+	// Create a new session
+	v.ClearMFACookie(c)
+	amr := []string{first_factor(identity_provider), structs.AMR_OTP, structs.AMR_MFA}
+	if err := v.create_session(c, user, identity_provider, amr, time.Now().Add(24*time.Hour)); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_login",
+		Details:    "Logged in using " + identity_provider + " provider with a second factor",
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
+
+// Returns the authentication method of the first factor of a login through the given provider.
+func first_factor(identity_provider string) string {
+	if identity_provider == "local" {
+		return structs.AMR_PASSWORD
+	}
+	return structs.AMR_FEDERATED
+}
+
+// Checks a backup code and removes it, so it can only be used once.
+func (v *API) use_recovery_code(user *types.User, code string) (int, error) {
+	codes, err := v.DB.GetRecoveryCodes(user)
+	if err != nil {
+
+		// Log the event
+		common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "recovery_code_retrieval_error",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return fiber.StatusInternalServerError, err
+	}
+
+	index := slices.Index(codes, code)
+	if index == -1 {
+		return fiber.StatusUnauthorized, errors.New("Invalid backup code!")
+	}
+
+	if err := v.DB.StoreRecoveryCodes(user, slices.Delete(codes, index, index+1)); err != nil {
+
+		// Log the event
+		common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "recovery_code_store_error",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return fiber.StatusInternalServerError, err
+	}
+	return fiber.StatusOK, nil
+}
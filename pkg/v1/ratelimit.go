@@ -0,0 +1,52 @@
+package v1
+
+import (
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/ratelimit"
+	"github.com/gofiber/fiber/v2"
+)
+
+// DefaultRateLimits returns the rate limits used when none are configured. Logins and anything that sends mail are
+// limited tightly, while checks that clients make often are allowed more.
+func DefaultRateLimits() ratelimit.Policies {
+	return ratelimit.Policies{
+		ratelimit.DEFAULT_ROUTE: {Max: 60, Window: time.Minute, Key: ratelimit.KEY_IP},
+		"/login":                {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_IP},
+		"/mfa":                  {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_IP},
+		"/reauth":               {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_BOTH},
+		"/webauthn/login":       {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_IP},
+		"/register":             {Max: 5, Window: 10 * time.Minute, Key: ratelimit.KEY_IP},
+		"/magic-link":           {Max: 5, Window: 10 * time.Minute, Key: ratelimit.KEY_IP},
+		"/magic-link/confirm":   {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_IP},
+		"/send-recovery":        {Max: 5, Window: 10 * time.Minute, Key: ratelimit.KEY_IP},
+		"/confirm-recovery":     {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_IP},
+		"/resend-verify":        {Max: 5, Window: 10 * time.Minute, Key: ratelimit.KEY_BOTH},
+		"/change-email":         {Max: 5, Window: 10 * time.Minute, Key: ratelimit.KEY_BOTH},
+		"/confirm-email-change": {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_BOTH},
+		"/reset-password":       {Max: 10, Window: 30 * time.Second, Key: ratelimit.KEY_BOTH},
+		"/check":                {Max: 30, Window: 30 * time.Second, Key: ratelimit.KEY_IP},
+		"/check-password":       {Max: 30, Window: 30 * time.Second, Key: ratelimit.KEY_IP},
+		"/validate":             {Max: 120, Window: time.Minute, Key: ratelimit.KEY_IP},
+	}
+}
+
+// Applies the rate limit policy of the requested route.
+func (v *API) rate_limit(c *fiber.Ctx) error {
+	allowed, err := v.RateLimiter.Allow(c, "v1", v.RateLimits, v.rate_limit_account)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if !allowed {
+		return APIResult(c, fiber.StatusTooManyRequests, "You're going too damn fast! Please slow down your requests.", nil)
+	}
+	return c.Next()
+}
+
+// Identifies the logged in user for rate limits that are kept per account.
+func (v *API) rate_limit_account(c *fiber.Ctx) string {
+	if claims := v.Auth.GetNormalClaims(c); claims != nil {
+		return claims.ULID
+	}
+	return ""
+}
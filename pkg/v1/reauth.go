@@ -0,0 +1,135 @@
+package v1
+
+import (
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	scrypt "github.com/elithrar/simple-scrypt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type ReauthArgs struct {
+	Password string `json:"password" form:"password"`
+	TOTP     string `json:"totp" form:"totp"`
+}
+
+// RequireReauth is middleware for sensitive routes, such as changing the password, email or second factors, or
+// deleting the account. Anyone holding the session cookie could otherwise make them, so the user must have logged in or
+// re-authenticated within the last authorization.REAUTH_WINDOW. Multi-step changes are gated at every step, so a
+// change begun by the user can't be finished with a stale session.
+func (v *API) RequireReauth(c *fiber.Ctx) error {
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+	if !v.Auth.RecentlyAuthenticated(claims) {
+		return APIResult(c, fiber.StatusUnauthorized, "Re-authentication required!", nil)
+	}
+	return c.Next()
+}
+
+// RequireReauthOrRecovery is RequireReauth for routes that can also be used with a recovery token, which proves
+// ownership of the account's email on its own.
+func (v *API) RequireReauthOrRecovery(c *fiber.Ctx) error {
+	if v.Auth.GetNormalClaims(c) == nil && v.Auth.ValidFromRecovery(c) {
+		return c.Next()
+	}
+	return v.RequireReauth(c)
+}
+
+// ReauthEndpoint confirms that the logged in user is the owner of the account, so they can make sensitive changes.
+// Users with a password must enter it, and users with a second factor must also provide it. OAuth-only users without
+// a second factor have to log in again instead.
+func (v *API) ReauthEndpoint(c *fiber.Ctx) error {
+
+	// Require a session
+	if !v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	var args ReauthArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	claims := v.Auth.GetNormalClaims(c)
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	has_mfa, err := v.DB.HasSecondFactor(user)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	var amr []string
+	if user.State.Read(constants.USER_IS_OAUTH_ONLY) {
+		if !has_mfa {
+			return APIResult(c, fiber.StatusUnauthorized, "Please log out and log in again to make this change.", nil)
+		}
+	} else {
+		if args.Password == "" {
+			return APIResult(c, fiber.StatusBadRequest, "Missing password.", nil)
+		}
+		if scrypt.CompareHashAndPassword([]byte(user.Password), []byte(args.Password)) != nil {
+
+			// Log the event
+			event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+				UserID:     user.ID,
+				EventID:    "user_reauth_failure",
+				Details:    "Invalid password",
+				Successful: false,
+			})
+
+			return APIResult(c, fiber.StatusUnauthorized, "Invalid password.", nil, event_id)
+		}
+		amr = append(amr, structs.AMR_PASSWORD)
+	}
+
+	if has_mfa {
+
+		// Check if a security key is required
+		if required, err := v.requires_webauthn(user, args.TOTP, ""); err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+		} else if required {
+			return v.begin_webauthn_mfa(c, user, &structs.WebAuthnCeremony{Purpose: WEBAUTHN_REAUTH})
+		}
+
+		if status, err := v.verify_totp(user, args.TOTP); err != nil {
+			return APIResult(c, status, err.Error(), nil)
+		}
+		amr = append(amr, structs.AMR_OTP)
+	}
+
+	return v.finish_reauth(c, user, amr)
+}
+
+// Records that the logged in user has just re-authenticated, by reissuing their session cookie.
+func (v *API) finish_reauth(c *fiber.Ctx, user *types.User, amr []string) error {
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil || claims.ULID != user.ID {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	if len(amr) > 1 {
+		amr = append(amr, structs.AMR_MFA)
+	}
+	claims.AuthTime = jwt.NewNumericDate(time.Now())
+	claims.AMR = amr
+	v.RefreshCookie(user, claims, c)
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_reauth",
+		Details:    "",
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
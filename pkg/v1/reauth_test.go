@@ -0,0 +1,85 @@
+package v1
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/authorization"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/oklog/ulid/v2"
+)
+
+// Gives the client a session for the user that was authenticated at the given time.
+func (c *test_client) session_since(api *API, user *types.User, auth_time time.Time) {
+	c.t.Helper()
+	session_id := ulid.Make().String()
+	expiration := time.Now().Add(time.Hour)
+	if err := api.DB.CreateSession(user, session_id, "", "", "", expiration); err != nil {
+		c.t.Fatal(err)
+	}
+	c.cookies["clomega-authorization"] = api.Auth.Create(&structs.Claims{
+		SessionID:        session_id,
+		Email:            user.Email,
+		Username:         user.Username,
+		ULID:             user.ID,
+		IdentityProvider: "local",
+		AuthTime:         jwt.NewNumericDate(auth_time),
+		AMR:              []string{structs.AMR_PASSWORD},
+	}, expiration)
+}
+
+func TestRequireReauth(t *testing.T) {
+	api, app := new_test_api(t)
+	user := new_test_user(t, api)
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{fiber.MethodPost, "/api/v1/change-email"},
+		{fiber.MethodPost, "/api/v1/confirm-email-change"},
+		{fiber.MethodGet, "/api/v1/begin-totp-enrollment"},
+		{fiber.MethodGet, "/api/v1/verify-totp-enrollment"},
+		{fiber.MethodPost, "/api/v1/webauthn/register/begin"},
+		{fiber.MethodPost, "/api/v1/webauthn/register/finish"},
+		{fiber.MethodPost, "/api/v1/reset-password"},
+		{fiber.MethodPost, "/api/v1/delete-account"},
+	}
+
+	// Without a session, nothing reaches the endpoint
+	client := new_test_client(t, app)
+	for _, route := range routes {
+		if r := client.do(route.method, route.path, fiber.Map{}); r.Status != fiber.StatusUnauthorized || r.Result != "Not logged in!" {
+			t.Errorf("%s without a session: %d %s", route.path, r.Status, r.Result)
+		}
+	}
+
+	// Nor with a session that was authenticated too long ago
+	client.session_since(api, user, time.Now().Add(-2*authorization.REAUTH_WINDOW))
+	for _, route := range routes {
+		if r := client.do(route.method, route.path, fiber.Map{}); r.Status != fiber.StatusUnauthorized || r.Result != "Re-authentication required!" {
+			t.Errorf("%s with a stale session: %d %s", route.path, r.Status, r.Result)
+		}
+	}
+
+	// A recent session gets through to the endpoint, which rejects the empty request
+	client.session_since(api, user, time.Now())
+	if r := client.do(fiber.MethodPost, "/api/v1/confirm-email-change", fiber.Map{}); r.Status != fiber.StatusBadRequest {
+		t.Errorf("confirm-email-change with a recent session: %d %s", r.Status, r.Result)
+	}
+
+	// Password resets can also be made with a recovery token instead of a session
+	recovery := new_test_client(t, app)
+	recovery.cookies["clomega-recovery"] = api.Auth.Create(&structs.Claims{
+		ClaimType:        1,
+		Email:            user.Email,
+		Username:         user.Username,
+		ULID:             user.ID,
+		IdentityProvider: "local",
+	}, time.Now().Add(time.Hour))
+	if r := recovery.do(fiber.MethodPost, "/api/v1/reset-password", fiber.Map{}); r.Status != fiber.StatusBadRequest || r.Result != "Missing password." {
+		t.Errorf("reset-password with a recovery token: %d %s", r.Status, r.Result)
+	}
+}
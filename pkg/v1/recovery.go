@@ -7,13 +7,12 @@ import (
 	"time"
 
 	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
 	"github.com/cloudlink-omega/accounts/pkg/email"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/cloudlink-omega/storage/pkg/common"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	"github.com/gofiber/fiber/v2"
-	"github.com/pquerna/otp"
-	"github.com/pquerna/otp/totp"
 )
 
 type SendArgs struct {
@@ -41,60 +40,75 @@ func (v *API) SendRecoveryEmail(c *fiber.Ctx) error {
 			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
 		}
 
-		if user == nil {
-			// User not found, but for security reasons we never leak that an account exists or not
+		if user == nil || database.UserBlocked(user) {
+			// User not found or can't log in, but for security reasons we never leak that an account exists or not
 			return APIResult(c, fiber.StatusOK, "OK", nil)
 		}
 
 		if user.State.Read(constants.USER_IS_OAUTH_ONLY) {
-			return APIResult(c, fiber.StatusBadRequest, "Please use your OAuth provider to recover your account.", nil)
+			return APIResult(c, fiber.StatusBadRequest, "Please use your OAuth provider, or sign in with an emailed link instead, to recover your account.", nil)
 		}
 
-		// Generate a random 6-digit verification code
-		code := fmt.Sprintf("%06d", rand.Intn(1000000))
+		if event_id, err := v.send_recovery_code(c, user); err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+		}
 
-		// Store the verification code in the database, with a 15 minute expiration
-		if err := v.DB.AddVerificationCode(user.ID, code, time.Now().Add(15*time.Minute)); err != nil {
+		return APIResult(c, fiber.StatusOK, "OK", nil)
+	}
 
-			// Log the event
-			event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
-				UserID:     user.ID,
-				EventID:    "user_password_reset_failure",
-				Details:    err.Error(),
-				Successful: false,
-			})
+	return APIResult(c, fiber.StatusServiceUnavailable, "Recovery services unavailable because email is not enabled.", nil)
+}
 
-			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
-		}
+// Emails the user a code they can use to recover their account. Returns the ID of the logged event if it fails.
+func (v *API) send_recovery_code(c *fiber.Ctx, user *types.User) (string, error) {
 
-		// Send the verification code to the user's email
-		email.SendPlainEmail(v.MailConfig, &structs.EmailArgs{
-			Subject:  "Recover your account",
-			To:       user.Email,
-			Nickname: v.ServerNickname,
-		}, fmt.Sprintf(`Hello %s, You are receiving this email because you recently requested to recover your CloudLink Omega account on server %s.
+	// Generate a random 6-digit verification code
+	code := fmt.Sprintf("%06d", rand.Intn(1000000))
 
-			To recover your account, please use the following verification code: %s.
+	// Store the verification code in the database, with a 15 minute expiration
+	if err := v.DB.AddVerificationCode(user.ID, code, time.Now().Add(15*time.Minute)); err != nil {
 
-			This code will expire in 15 minutes.
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_password_reset_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
 
-			If you did not create this account, you can safely ignore this email.
+		return event_id, err
+	}
 
-			Regards,
-			- %s.`, user.Username, v.ServerNickname, code, v.ServerNickname))
+	// Send the verification code to the user's email
+	if err := v.Outbox.Send(&structs.EmailArgs{
+		To:       user.Email,
+		Nickname: v.ServerNickname,
+		Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+	}, email.TEMPLATE_RECOVERY, map[string]any{
+		"Username": user.Username,
+		"Code":     code,
+	}); err != nil {
 
 		// Log the event
-		common.LogEvent(v.DB.DB, &types.UserEvent{
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
 			UserID:     user.ID,
-			EventID:    "user_password_reset_sent",
-			Details:    "",
-			Successful: true,
+			EventID:    "user_password_reset_failure",
+			Details:    err.Error(),
+			Successful: false,
 		})
 
-		return APIResult(c, fiber.StatusOK, "OK", nil)
+		return event_id, err
 	}
 
-	return APIResult(c, fiber.StatusServiceUnavailable, "Recovery services unavailable because email is not enabled.", nil)
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_password_reset_sent",
+		Details:    "",
+		Successful: true,
+	})
+
+	return "", nil
 }
 
 type ConfirmArgs struct {
@@ -132,6 +146,11 @@ func (v *API) ConfirmRecoveryEmail(c *fiber.Ctx) error {
 		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
 	}
 
+	// No code was sent if the account doesn't exist or can't log in
+	if user == nil || database.UserBlocked(user) {
+		return APIResult(c, fiber.StatusBadRequest, "Invalid verification code!", nil)
+	}
+
 	verified, err = v.DB.VerifyCode(user.ID, args.Code)
 	if err != nil {
 
@@ -157,20 +176,8 @@ func (v *API) ConfirmRecoveryEmail(c *fiber.Ctx) error {
 
 		} else if args.TOTP != "" {
 
-			// Get secret
-			secret := v.DB.GetTotpSecret(user)
-
-			// Verify the TOTP
-			success, err := totp.ValidateCustom(
-				args.TOTP,
-				secret,
-				time.Now().UTC(),
-				totp.ValidateOpts{
-					Digits:    otp.DigitsSix,
-					Period:    30,
-					Skew:      1,
-					Algorithm: otp.AlgorithmSHA512,
-				})
+			// Verify the TOTP. Each code can only be used once.
+			success, err := v.DB.VerifyTotp(user, args.TOTP)
 			if err != nil {
 
 				// Log the event
@@ -231,8 +238,8 @@ func (v *API) ConfirmRecoveryEmail(c *fiber.Ctx) error {
 		}
 	}
 
-	// Remove verification codes from the database
-	if err := v.DB.DeleteVerificationCodes(user.ID); err != nil {
+	// Whoever may have been in the account is logged out, and the verification code can't be used again
+	if err := v.credentials_changed(c, user, CREDENTIAL_RECOVERY, ""); err != nil {
 		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
 	}
 
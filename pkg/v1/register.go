@@ -1,12 +1,16 @@
 package v1
 
 import (
+	"errors"
 	"fmt"
 	math_rand "math/rand"
 	"time"
 
 	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
 	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/identity"
+	"github.com/cloudlink-omega/accounts/pkg/proxy"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/cloudlink-omega/storage/pkg/common"
 	"github.com/cloudlink-omega/storage/pkg/types"
@@ -29,6 +33,17 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
 	}
 
+	// Normalize the requested username and email address
+	username, err := identity.NormalizeUsername(creds.Username)
+	if err != nil {
+		return APIResult(c, fiber.StatusBadRequest, fmt.Sprintf("Invalid username: %s.", err), nil)
+	}
+	email_address, err := identity.NormalizeEmail(creds.Email)
+	if err != nil {
+		return APIResult(c, fiber.StatusBadRequest, fmt.Sprintf("Invalid email: %s.", err), nil)
+	}
+	creds.Username, creds.Email = username, email_address
+
 	// Check if the email provided already exists.
 	if user, err := v.DB.GetUserByEmail(creds.Email); err == nil && user != nil {
 		return APIResult(c, fiber.StatusBadRequest, "Email already in use!", nil)
@@ -61,6 +76,11 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
 	}
 
+	// Enforce the password policy
+	if result := v.PasswordPolicy.Check(creds.Password, creds.Username, creds.Email); !result.Valid() {
+		return APIResult(c, fiber.StatusBadRequest, "Password does not meet the requirements.", result)
+	}
+
 	// Hash the password using scrypt
 	hash, err := scrypt.GenerateFromPassword([]byte(creds.Password), scrypt.DefaultParams)
 	if err != nil {
@@ -98,7 +118,10 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 		Secret:   userSecret,
 	}
 
-	if err := v.DB.CreateUser(user); err != nil {
+	if err := v.DB.CreateUser(user); errors.Is(err, database.ErrEmailInUse) {
+		return APIResult(c, fiber.StatusBadRequest, "Email already in use!", nil)
+
+	} else if err != nil {
 
 		// Log the event
 		event_id := common.LogEvent(v.DB.DB, &types.SystemEvent{
@@ -123,7 +146,7 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 	sessionExpiry := time.Now().Add(24 * time.Hour)
 
 	// Store the session ID in the database
-	err = v.DB.CreateSession(user, sessionID.String(), string(c.Request().Header.Peek("Origin")), string(c.Request().Header.Peek("User-Agent")), c.IP(), sessionExpiry)
+	err = v.DB.CreateSession(user, sessionID.String(), string(c.Request().Header.Peek("Origin")), string(c.Request().Header.Peek("User-Agent")), proxy.ClientIP(c), sessionExpiry)
 	if err != nil {
 
 		// Log the event
@@ -136,7 +159,7 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 
 		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
 	}
-	v.SetCookie(user, sessionID.String(), sessionExpiry, c)
+	v.SetCookie(user, sessionID.String(), "local", []string{structs.AMR_PASSWORD}, sessionExpiry, c)
 
 	// If email is enabled, send a verification email. Otherwise, automatically assign the user as verified. Bypass for localhost if enabled.
 	if v.BypassEmailRegistration {
@@ -170,22 +193,25 @@ func (v *API) RegisterEndpoint(c *fiber.Ctx) error {
 		}
 
 		// Send the verification code to the user's email
-		email.SendPlainEmail(v.MailConfig, &structs.EmailArgs{
-			Subject:  "Verify your account",
+		if err := v.Outbox.Send(&structs.EmailArgs{
 			To:       user.Email,
 			Nickname: v.ServerNickname,
-		}, fmt.Sprintf(
-			`Hello %s, You are receiving this email because you recently created a CloudLink Omega account on server %s.
+			Locale:   email.MatchLocale(c.Get(fiber.HeaderAcceptLanguage)),
+		}, email.TEMPLATE_VERIFY, map[string]any{
+			"Username": user.Username,
+			"Code":     code,
+		}); err != nil {
 
-		To verify your account, please use the following verification code: %s.
-
-		This code will expire in 15 minutes.
-
-		If you did not create this account, you can safely ignore this email.
+			// Log the event
+			event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+				UserID:     user.ID,
+				EventID:    "user_verify_failure",
+				Details:    err.Error(),
+				Successful: false,
+			})
 
-		Regards,
-		 - %s.`, user.Username, v.ServerNickname, code, v.ServerNickname),
-		)
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+		}
 
 		// Log the event
 		common.LogEvent(v.DB.DB, &types.UserEvent{
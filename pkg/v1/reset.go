@@ -55,8 +55,9 @@ func (v *API) ResetPasswordEndpoint(c *fiber.Ctx) error {
 		return APIResult(c, fiber.StatusBadRequest, "Missing password.", nil)
 	}
 
-	if len(args.Password) < 8 {
-		return APIResult(c, fiber.StatusBadRequest, "Password too short.", nil)
+	// Enforce the password policy
+	if result := v.PasswordPolicy.Check(args.Password, user.Username, user.Email); !result.Valid() {
+		return APIResult(c, fiber.StatusBadRequest, "Password does not meet the requirements.", result)
 	}
 
 	// Hash the new password using scrypt
@@ -96,10 +97,19 @@ func (v *API) ResetPasswordEndpoint(c *fiber.Ctx) error {
 		Successful: true,
 	})
 
+	// Log out everyone else. A recovery session replaces all of them with a new one.
+	keep_session := claims.SessionID
+	if switch_to_normal {
+		keep_session = ""
+	}
+	if err := v.credentials_changed(c, user, CREDENTIAL_PASSWORD, keep_session); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
 	// Switch to normal session if coming from a recovery session
 	if switch_to_normal {
 		v.ClearRecoveryCookie(c)
-		if err := v.CreateSession(c, user, time.Now().Add(24*time.Hour)); err != nil {
+		if err := v.CreateSession(c, user, []string{structs.AMR_EMAIL, structs.AMR_PASSWORD}, time.Now().Add(24*time.Hour)); err != nil {
 			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
 		}
 	}
@@ -0,0 +1,101 @@
+package v1
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/device"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+	"github.com/oklog/ulid/v2"
+)
+
+type SessionInfo struct {
+	ID        string          `json:"id"`
+	Current   bool            `json:"current"`
+	Device    *device.Details `json:"device"`
+	IP        string          `json:"ip"`
+	CreatedAt time.Time       `json:"created_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+type RevokeSessionArgs struct {
+	ID string `json:"id" form:"id"`
+}
+
+// Lists the user's sessions, newest first, with the browser and device they came from. Their locations are included
+// if geolocation is on.
+func (v *API) SessionsEndpoint(c *fiber.Ctx) error {
+
+	// Require a session
+	if !v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	claims := v.Auth.GetNormalClaims(c)
+	records, err := v.DB.GetAllSessions(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Session IDs are ULIDs, so they sort by when the session was created
+	slices.SortFunc(records, func(a, b *types.UserSession) int { return strings.Compare(b.ID, a.ID) })
+
+	sessions := make([]*SessionInfo, len(records))
+	for i, record := range records {
+		sessions[i] = &SessionInfo{
+			ID:        record.ID,
+			Current:   record.ID == claims.SessionID,
+			Device:    v.GeoIP.Describe(record.UserAgent, record.IP),
+			IP:        record.IP,
+			ExpiresAt: record.ExpiresAt,
+		}
+		if id, err := ulid.Parse(record.ID); err == nil {
+			sessions[i].CreatedAt = ulid.Time(id.Time())
+		}
+	}
+
+	return APIResult(c, fiber.StatusOK, "OK", sessions)
+}
+
+// Logs out one of the user's other sessions. The current session is ended by logging out instead.
+func (v *API) RevokeSessionEndpoint(c *fiber.Ctx) error {
+
+	// Require a session
+	if !v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	var args RevokeSessionArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+	if args.ID == "" {
+		return APIResult(c, fiber.StatusBadRequest, "Missing ID.", nil)
+	}
+
+	claims := v.Auth.GetNormalClaims(c)
+	if args.ID == claims.SessionID {
+		return APIResult(c, fiber.StatusBadRequest, "This is the current session, log out instead.", nil)
+	}
+
+	deleted, err := v.DB.DeleteUserSession(claims.ULID, args.ID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if !deleted {
+		return APIResult(c, fiber.StatusNotFound, "Session not found.", nil)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     claims.ULID,
+		EventID:    "user_session_revoked",
+		Details:    "Logged out session " + args.ID,
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
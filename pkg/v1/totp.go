@@ -2,20 +2,28 @@ package v1
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"image/png"
-	"math/rand"
+	"math/big"
 	"time"
 
 	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
 	"github.com/cloudlink-omega/storage/pkg/common"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	"github.com/gofiber/fiber/v2"
-	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 )
 
+// How long the user has to verify a new authenticator before they have to start over.
+const TOTP_ENROLLMENT_LIFETIME = 15 * time.Minute
+
+// Number of recovery codes given to the user whenever they are (re)generated.
+const RECOVERY_CODE_COUNT = 10
+
 type EnrollResponse struct {
 	QR  string `json:"qr"`
 	Key string `json:"key"`
@@ -61,16 +69,27 @@ func (v *API) EnrollTotpEndpoint(c *fiber.Ctx) error {
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      v.ServerNickname,
 		AccountName: user.Username,
-		Digits:      otp.DigitsSix,
-		Algorithm:   otp.AlgorithmSHA512,
-		Period:      30,
+		Digits:      database.TOTP_OPTIONS.Digits,
+		Algorithm:   database.TOTP_OPTIONS.Algorithm,
+		Period:      database.TOTP_PERIOD,
 	})
 	if err != nil {
 		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
 	}
 
-	// Store the secret. It will be encrypted by the function.
-	v.DB.StoreTotpSecret(user, key.Secret())
+	// Store the secret until it's verified. It will be encrypted by the function.
+	if err := v.DB.StorePendingTotpSecret(user, key.Secret(), time.Now().Add(TOTP_ENROLLMENT_LIFETIME)); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_totp_enroll_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
 
 	// Generate the QR code
 	var buf bytes.Buffer
@@ -158,20 +177,17 @@ func (v *API) VerifyTotpEndpoint(c *fiber.Ctx) error {
 		return APIResult(c, fiber.StatusInternalServerError, "Failed to get user.", nil, event_id)
 	}
 
-	// Read the secret from the database. It will be decrypted by the function.
-	secret := v.DB.GetTotpSecret(user)
+	// Read the secret being enrolled from the database. It will be decrypted by the function.
+	secret, err := v.DB.GetPendingTotpSecret(user)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if secret == "" {
+		return APIResult(c, fiber.StatusBadRequest, "No TOTP enrollment in progress, please start over.", nil)
+	}
 
 	// Verify the TOTP
-	success, err := totp.ValidateCustom(
-		c.Query("code"),
-		secret,
-		time.Now().UTC(),
-		totp.ValidateOpts{
-			Digits:    otp.DigitsSix,
-			Period:    30,
-			Skew:      1,
-			Algorithm: otp.AlgorithmSHA512,
-		})
+	success, err := totp.ValidateCustom(c.Query("code"), secret, time.Now().UTC(), database.TOTP_OPTIONS)
 	if err != nil {
 
 		// Log the event
@@ -188,6 +204,24 @@ func (v *API) VerifyTotpEndpoint(c *fiber.Ctx) error {
 		return APIResult(c, fiber.StatusBadRequest, "Invalid code.", nil)
 	}
 
+	// The new secret replaces the old one (if any) only now that it's known to work
+	if err := v.DB.ConfirmPendingTotpSecret(user); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_totp_enroll_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+	details := ""
+	if user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		details = "Replaced authenticator"
+	}
+
 	// Set the user flags necessary to enable TOTP
 	user.State.Set(constants.USER_IS_TOTP_ENABLED)
 	if err := v.DB.UpdateUserState(claims.ULID, user.State); err != nil {
@@ -207,18 +241,18 @@ func (v *API) VerifyTotpEndpoint(c *fiber.Ctx) error {
 	common.LogEvent(v.DB.DB, &types.UserEvent{
 		UserID:     user.ID,
 		EventID:    "user_totp_enroll_success",
-		Details:    "",
+		Details:    details,
 		Successful: true,
 	})
 
-	// Generate ten randomly generated 10-digit codes used for recovery.
-	var recovery_codes []string
-	for range [10]int{} {
-		recovery_codes = append(recovery_codes, fmt.Sprintf("%10d", rand.Intn(10000000000)))
+	// Log out everywhere else
+	if err := v.credentials_changed(c, user, CREDENTIAL_TOTP, claims.SessionID); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
 	}
 
-	// Store the recovery codes in the database. They will be encrypted by the function.
-	if err := v.DB.StoreRecoveryCodes(user, recovery_codes); err != nil {
+	// Generate new codes used for recovery. Any left from a previous authenticator are replaced.
+	recovery_codes, err := v.new_recovery_codes(user)
+	if err != nil {
 		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
 	}
 
@@ -235,3 +269,173 @@ func (v *API) VerifyTotpEndpoint(c *fiber.Ctx) error {
 		RecoveryCodes: recovery_codes,
 	})
 }
+
+func (v *API) DisableTotpEndpoint(c *fiber.Ctx) error {
+
+	// Get authorization
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if !user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		return APIResult(c, fiber.StatusBadRequest, "TOTP is not enabled.", nil)
+	}
+
+	user.State.Clear(constants.USER_IS_TOTP_ENABLED)
+	if err := v.DB.UpdateUserState(user.ID, user.State); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if err := v.DB.DeleteTotp(user); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_totp_disable_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_totp_disabled",
+		Details:    "",
+		Successful: true,
+	})
+
+	// Log out everywhere else
+	if err := v.credentials_changed(c, user, CREDENTIAL_TOTP, claims.SessionID); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
+
+// RecoveryCodesEndpoint shows the recovery codes the user has left.
+func (v *API) RecoveryCodesEndpoint(c *fiber.Ctx) error {
+
+	// Get authorization
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if !user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		return APIResult(c, fiber.StatusBadRequest, "TOTP is not enabled.", nil)
+	}
+	recovery_codes, err := v.DB.GetRecoveryCodes(user)
+	if err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "recovery_code_retrieval_error",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+	if recovery_codes == nil {
+		recovery_codes = []string{}
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_recovery_viewed",
+		Details:    "",
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", &VerifyResponse{
+		RecoveryCodes: recovery_codes,
+	})
+}
+
+// RegenerateRecoveryCodesEndpoint replaces the user's recovery codes with a new set, invalidating the old ones.
+func (v *API) RegenerateRecoveryCodesEndpoint(c *fiber.Ctx) error {
+
+	// Get authorization
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if !user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		return APIResult(c, fiber.StatusBadRequest, "TOTP is not enabled.", nil)
+	}
+	recovery_codes, err := v.new_recovery_codes(user)
+	if err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "recovery_code_store_error",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_recovery_set",
+		Details:    "Regenerated",
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", &VerifyResponse{
+		RecoveryCodes: recovery_codes,
+	})
+}
+
+// Generates and stores a new set of random 10-digit recovery codes for the user, replacing any they had left.
+// They will be encrypted by the database.
+func (v *API) new_recovery_codes(user *types.User) ([]string, error) {
+	var recovery_codes []string
+	for range RECOVERY_CODE_COUNT {
+		n, err := rand.Int(rand.Reader, big.NewInt(10000000000))
+		if err != nil {
+			return nil, err
+		}
+		recovery_codes = append(recovery_codes, fmt.Sprintf("%010d", n))
+	}
+	return recovery_codes, v.DB.StoreRecoveryCodes(user, recovery_codes)
+}
+
+// Checks the user's TOTP code, if they have TOTP enabled.
+func (v *API) verify_totp(user *types.User, totp_code string) (int, error) {
+	if !user.State.Read(constants.USER_IS_TOTP_ENABLED) {
+		return fiber.StatusOK, nil
+	}
+	if totp_code == "" {
+		return fiber.StatusBadRequest, errors.New("TOTP required!")
+	}
+	success, err := v.DB.VerifyTotp(user, totp_code)
+	if err != nil {
+		return fiber.StatusInternalServerError, err
+	}
+	if !success {
+		return fiber.StatusUnauthorized, errors.New("Invalid TOTP!")
+	}
+	return fiber.StatusOK, nil
+}
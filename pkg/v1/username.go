@@ -0,0 +1,101 @@
+package v1
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/identity"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Defaults for UsernameChangeCooldown and UsernameReservation.
+const (
+	DEFAULT_USERNAME_CHANGE_COOLDOWN = 30 * 24 * time.Hour
+	DEFAULT_USERNAME_RESERVATION     = 90 * 24 * time.Hour
+)
+
+type ChangeUsernameArgs struct {
+	Username string `json:"username" form:"username"`
+}
+
+func (v *API) ChangeUsernameEndpoint(c *fiber.Ctx) error {
+	claims := v.Auth.GetNormalClaims(c)
+	if claims == nil {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	var args ChangeUsernameArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Check the requested username
+	username, err := identity.NormalizeUsername(args.Username)
+	if err != nil {
+		return APIResult(c, fiber.StatusBadRequest, fmt.Sprintf("Invalid username: %s.", err), nil)
+	}
+	if username == user.Username {
+		return APIResult(c, fiber.StatusBadRequest, "That's already your username.", nil)
+	}
+
+	// Enforce the cooldown between changes
+	if next_change, err := v.NextUsernameChange(user.ID); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if time.Now().Before(next_change) {
+		return APIResult(c, fiber.StatusTooManyRequests, fmt.Sprintf("You can change your username again on %s.", next_change.UTC().Format("January 2, 2006")), next_change)
+	}
+
+	// Names held by this user (their current name, or one they recently changed away from) can be taken back
+	if own, err := v.DB.IsNameReservedBy(user.ID, username); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if !own {
+		if exists, err := v.DB.DoesNameExist(username); err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+		} else if exists {
+			return APIResult(c, fiber.StatusConflict, "Username unavailable.", nil)
+		}
+	}
+
+	old_name := user.Username
+	if err := v.DB.ChangeUsername(user, username, v.UsernameReservation); err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_username_change_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Update the username stored in the session cookie
+	v.RefreshCookie(user, claims, c)
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_username_changed",
+		Details:    "Changed from " + old_name + " to " + username,
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", username)
+}
+
+// NextUsernameChange returns the earliest time the user is allowed to change their username.
+func (v *API) NextUsernameChange(user_id string) (time.Time, error) {
+	history, err := v.DB.GetUsernameHistory(user_id)
+	if err != nil || len(history) == 0 {
+		return time.Time{}, err
+	}
+	return history[0].CreatedAt.Add(v.UsernameChangeCooldown), nil
+}
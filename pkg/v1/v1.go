@@ -5,24 +5,39 @@ import (
 
 	"github.com/cloudlink-omega/accounts/pkg/authorization"
 	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/device"
+	"github.com/cloudlink-omega/accounts/pkg/email"
+	"github.com/cloudlink-omega/accounts/pkg/password"
+	"github.com/cloudlink-omega/accounts/pkg/proxy"
+	"github.com/cloudlink-omega/accounts/pkg/ratelimit"
 	"github.com/cloudlink-omega/accounts/pkg/structs"
 	"github.com/cloudlink-omega/storage/pkg/types"
 	"github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/oklog/ulid/v2"
 )
 
 type API struct {
 	MailConfig              *structs.MailConfig
+	Outbox                  *email.Outbox
 	ServerNickname          string
 	RouterPath              string
+	ServerURL               string
 	EnforceHTTPS            bool
 	APIDomain               string
 	Routes                  func(fiber.Router)
 	Auth                    *authorization.Auth
 	DB                      *database.Database
 	BypassEmailRegistration bool
+	PasswordPolicy          *password.Policy
+	LoginAlerts             *device.Alerts     // Set by accounts.New, so users are told about logins from new devices.
+	GeoIP                   *device.GeoIP      // Set by accounts.EnableGeoIP, so sessions show where they came from.
+	RateLimiter             *ratelimit.Limiter // Shared with the other API versions by accounts.New.
+	RateLimits              ratelimit.Policies // Rate limit of each route, relative to where the API is mounted.
+	UsernameChangeCooldown  time.Duration      // Minimum time between username changes.
+	UsernameReservation     time.Duration      // How long an old username stays reserved for the user after they change it.
+	DeletionGracePeriod     time.Duration      // How long a user has to cancel the deletion of their account by logging in.
+	export_wake             chan struct{}
 }
 
 type ValidationData struct {
@@ -45,53 +60,100 @@ type Result struct {
 	EventID string `json:"error_id,omitempty"`
 }
 
-func New(router_path string, enforce_https bool, api_domain string, server_url string, server_secret string, db *database.Database, mail_config *structs.MailConfig, nickname string, bypass_email bool) *API {
+func New(router_path string, enforce_https bool, api_domain string, server_url string, server_secret string, db *database.Database, mail_config *structs.MailConfig, outbox *email.Outbox, nickname string, bypass_email bool) *API {
 
 	// Create new instance
 	v := &API{
+		RouterPath:              router_path,
+		ServerURL:               server_url,
 		EnforceHTTPS:            enforce_https,
 		APIDomain:               api_domain,
 		Auth:                    authorization.New(server_url, server_secret, db),
 		DB:                      db,
 		MailConfig:              mail_config,
+		Outbox:                  outbox,
 		ServerNickname:          nickname,
 		BypassEmailRegistration: bypass_email,
+		PasswordPolicy:          password.DefaultPolicy(),
+		RateLimiter:             ratelimit.New(nil),
+		RateLimits:              DefaultRateLimits(),
+		UsernameChangeCooldown:  DEFAULT_USERNAME_CHANGE_COOLDOWN,
+		UsernameReservation:     DEFAULT_USERNAME_RESERVATION,
+		DeletionGracePeriod:     DEFAULT_DELETION_GRACE_PERIOD,
+		export_wake:             make(chan struct{}, 1),
 	}
 
 	// Configure default handler for endpoints
 	v.Routes = func(router fiber.Router) {
 
-		// Configure rate limits. Default to 10 request per 30 seconds with a sliding window.
-		router.Use(limiter.New(limiter.Config{
-			Max:               10,
-			Expiration:        30 * time.Second,
-			LimiterMiddleware: limiter.SlidingWindow{},
-			LimitReached: func(c *fiber.Ctx) error {
-				return APIResult(c, fiber.StatusTooManyRequests, "You're going too damn fast! Please slow down your requests.", nil)
-			},
-		}))
+		// Configure rate limits for each route
+		router.Use(v.rate_limit)
 
 		// General
 		router.Post("/login", v.LoginEndpoint)
 		router.Get("/logout", v.LogoutEndpoint)
 		router.Post("/register", v.RegisterEndpoint)
-		router.Post("/reset-password", v.ResetPasswordEndpoint)
+		router.Post("/reset-password", v.RequireReauthOrRecovery, v.ResetPasswordEndpoint)
+
+		// Passwordless login
+		router.Post("/magic-link", v.SendMagicLinkEndpoint)
+		router.Post("/magic-link/confirm", v.ConfirmMagicLinkEndpoint)
+
+		// Second factor after the password or an OAuth provider
+		router.Post("/mfa", v.MFAEndpoint)
+
+		// Confirm it's the user before sensitive changes
+		router.Post("/reauth", v.ReauthEndpoint)
+
+		// Passkeys and security keys
+		router.Post("/webauthn/register/begin", v.RequireReauth, v.WebAuthnRegisterBeginEndpoint)
+		router.Post("/webauthn/register/finish", v.RequireReauth, v.WebAuthnRegisterFinishEndpoint)
+		router.Get("/webauthn/credentials", v.WebAuthnCredentialsEndpoint)
+		router.Post("/webauthn/delete-credential", v.RequireReauth, v.DeleteWebAuthnCredentialEndpoint)
+		router.Post("/webauthn/login/begin", v.WebAuthnLoginBeginEndpoint)
+		router.Post("/webauthn/login/finish", v.WebAuthnLoginFinishEndpoint)
 
 		// Verification
 		router.Get("/resend-verify", v.ResendVerificationEmail)
 		router.Get("/verify", v.VerifyVerificationEmail)
 
+		// Change email
+		router.Post("/change-email", v.RequireReauth, v.ChangeEmailEndpoint)
+		router.Post("/confirm-email-change", v.RequireReauth, v.ConfirmEmailChangeEndpoint)
+		router.Post("/revert-email-change", v.RevertEmailChangeEndpoint)
+
+		// Change username
+		router.Post("/change-username", v.RequireReauth, v.ChangeUsernameEndpoint)
+
+		// Delete account
+		router.Post("/delete-account", v.RequireReauth, v.DeleteAccountEndpoint)
+
+		// Export personal data
+		router.Post("/export", v.RequireReauth, v.RequestExportEndpoint)
+		router.Get("/export/status", v.ExportStatusEndpoint)
+		router.Get("/export/download", v.DownloadExportEndpoint)
+
 		// Utilities
 		router.Get("/validate", v.ValidateEndpoint)
 		router.Post("/check", v.UsernameChecker)
+		router.Post("/check-password", v.PasswordChecker)
 
-		// TOTP setup
-		router.Get("/begin-totp-enrollment", v.EnrollTotpEndpoint)
-		router.Get("/verify-totp-enrollment", v.VerifyTotpEndpoint)
+		// TOTP setup and management
+		router.Get("/begin-totp-enrollment", v.RequireReauth, v.EnrollTotpEndpoint)
+		router.Get("/verify-totp-enrollment", v.RequireReauth, v.VerifyTotpEndpoint)
+		router.Post("/begin-totp-enrollment", v.RequireReauth, v.EnrollTotpEndpoint)
+		router.Post("/disable-totp", v.RequireReauth, v.DisableTotpEndpoint)
+		router.Post("/recovery-codes", v.RequireReauth, v.RecoveryCodesEndpoint)
+		router.Post("/regenerate-recovery-codes", v.RequireReauth, v.RegenerateRecoveryCodesEndpoint)
 
 		// Recover account
 		router.Post("/send-recovery", v.SendRecoveryEmail)
 		router.Post("/confirm-recovery", v.ConfirmRecoveryEmail)
+		router.Post("/report-login", v.ReportLoginEndpoint)
+
+		// Sessions
+		router.Get("/sessions", v.SessionsEndpoint)
+		router.Post("/sessions/revoke", v.RevokeSessionEndpoint)
 
 		// Health check
 		router.Get("/", func(c *fiber.Ctx) error {
@@ -116,14 +178,20 @@ func APIResult(c *fiber.Ctx, status int, result string, data any, event_id ...st
 	return c.SendString(string(message))
 }
 
-func (v *API) CreateSession(c *fiber.Ctx, user *types.User, session_expiry time.Time) error {
+// CreateSession logs the user in. amr lists the methods the user authenticated with (see structs.Claims).
+func (v *API) CreateSession(c *fiber.Ctx, user *types.User, amr []string, session_expiry time.Time) error {
+	return v.create_session(c, user, "local", amr, session_expiry)
+}
+
+func (v *API) create_session(c *fiber.Ctx, user *types.User, identity_provider string, amr []string, session_expiry time.Time) error {
 	sessionID := ulid.Make()
 
 	// Store the session ID in the database
-	err := v.DB.CreateSession(user, sessionID.String(), string(c.Request().Header.Peek("Origin")), string(c.Request().Header.Peek("User-Agent")), c.IP(), session_expiry)
+	err := v.DB.CreateSession(user, sessionID.String(), string(c.Request().Header.Peek("Origin")), string(c.Request().Header.Peek("User-Agent")), proxy.ClientIP(c), session_expiry)
 	if err != nil {
 		return err
 	}
-	v.SetCookie(user, sessionID.String(), session_expiry, c)
+	v.SetCookie(user, sessionID.String(), identity_provider, amr, session_expiry, c)
+	v.LoginAlerts.CheckLogin(c, user, sessionID.String())
 	return nil
 }
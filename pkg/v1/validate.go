@@ -18,6 +18,14 @@ func (v *API) ValidateEndpoint(c *fiber.Ctx) error {
 
 	// Read user flags
 	user, _ := v.DB.GetUser(claims.ULID)
+
+	// Reissue the cookie if the username or email changed since it was issued
+	if claims.Username != user.Username || claims.Email != user.Email {
+		v.RefreshCookie(user, claims, c)
+		claims.Username = user.Username
+		claims.Email = user.Email
+	}
+
 	output := &ValidationData{
 		Claims:        claims,
 		VerifiedEmail: user.State.Read(constants.USER_IS_EMAIL_REGISTERED),
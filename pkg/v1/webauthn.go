@@ -0,0 +1,541 @@
+package v1
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/constants"
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/accounts/pkg/domain"
+	"github.com/cloudlink-omega/accounts/pkg/structs"
+	"github.com/cloudlink-omega/storage/pkg/common"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+)
+
+// How long the user has to respond to a passkey prompt.
+const WEBAUTHN_CEREMONY_TIMEOUT = 5 * time.Minute
+
+// Longest name a passkey or security key can be given.
+const WEBAUTHN_MAX_NAME_LENGTH = 64
+
+// Purposes of a WebAuthn ceremony.
+const (
+	WEBAUTHN_REGISTER = "register"
+	WEBAUTHN_LOGIN    = "login"
+	WEBAUTHN_MFA      = "mfa"
+	WEBAUTHN_REAUTH   = "reauth"
+)
+
+type FinishWebAuthnRegistrationArgs struct {
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+type DeleteWebAuthnCredentialArgs struct {
+	ID string `json:"id" form:"id"`
+}
+
+type WebAuthnCredentialInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Wraps a user and their stored credentials for the WebAuthn library.
+type webauthn_user struct {
+	user        *types.User
+	credentials []webauthn.Credential
+	records     []*database.WebAuthnCredential
+}
+
+func (u *webauthn_user) WebAuthnID() []byte                         { return []byte(u.user.ID) }
+func (u *webauthn_user) WebAuthnName() string                       { return u.user.Email }
+func (u *webauthn_user) WebAuthnDisplayName() string                { return u.user.Username }
+func (u *webauthn_user) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// Returns the stored record of a credential that the library has just validated.
+func (u *webauthn_user) record(credential *webauthn.Credential) *database.WebAuthnCredential {
+	for i, stored := range u.credentials {
+		if bytes.Equal(stored.ID, credential.ID) {
+			return u.records[i]
+		}
+	}
+	return nil
+}
+
+func (v *API) load_webauthn_user(user *types.User) (*webauthn_user, error) {
+	records, err := v.DB.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	wu := &webauthn_user{user: user, records: records}
+	for _, record := range records {
+		var credential webauthn.Credential
+		if err := json.Unmarshal(record.Data, &credential); err != nil {
+			return nil, err
+		}
+		wu.credentials = append(wu.credentials, credential)
+	}
+	return wu, nil
+}
+
+// The relying party is the server itself, so passkeys are bound to the host name of the server URL.
+func (v *API) relying_party() (*webauthn.WebAuthn, error) {
+	server_url := v.ServerURL
+	if !strings.Contains(server_url, "://") {
+		server_url = "https://" + server_url
+	}
+	server, err := url.Parse(server_url)
+	if err != nil {
+		return nil, err
+	}
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: WEBAUTHN_CEREMONY_TIMEOUT, TimeoutUVD: WEBAUTHN_CEREMONY_TIMEOUT}
+	return webauthn.New(&webauthn.Config{
+		RPID:          server.Hostname(),
+		RPDisplayName: v.ServerNickname,
+		RPOrigins:     []string{server.Scheme + "://" + server.Host},
+		Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+}
+
+func (v *API) SetWebAuthnCookie(ceremony *structs.WebAuthnCeremony, c *fiber.Ctx) {
+	expiration := time.Now().Add(WEBAUTHN_CEREMONY_TIMEOUT)
+	c.Cookie(&fiber.Cookie{
+		Name:     "clomega-webauthn",
+		Value:    v.Auth.Create(ceremony, expiration),
+		Path:     "/",
+		Expires:  expiration,
+		Secure:   v.EnforceHTTPS,
+		HTTPOnly: true,
+		Domain:   domain.GetDomain(c.Hostname()),
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
+
+func (v *API) ClearWebAuthnCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "clomega-webauthn",
+		Path:     "/",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		Secure:   true,
+		HTTPOnly: true,
+		Domain:   domain.GetDomain(c.Hostname()),
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+}
+
+// Users with a passkey or security key must use it as their second factor, unless they also have TOTP enabled and
+// gave a TOTP or backup code instead.
+func (v *API) requires_webauthn(user *types.User, totp_code string, backup_code string) (bool, error) {
+	has, err := v.DB.HasWebAuthnCredentials(user.ID)
+	if err != nil || !has {
+		return false, err
+	}
+	return !user.State.Read(constants.USER_IS_TOTP_ENABLED) || (totp_code == "" && backup_code == ""), nil
+}
+
+// Starts an assertion for a user who has already given their password, used a magic link or signed in with a provider,
+// and responds with the options for the browser. The ceremony may carry the magic link or provider used as the first
+// factor, or be nil. The login is completed by WebAuthnLoginFinishEndpoint. This is also used to re-authenticate, when
+// the ceremony's purpose is WEBAUTHN_REAUTH.
+func (v *API) begin_webauthn_mfa(c *fiber.Ctx, user *types.User, ceremony *structs.WebAuthnCeremony) error {
+	rp, err := v.relying_party()
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	wu, err := v.load_webauthn_user(user)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	assertion, session, err := rp.BeginLogin(wu)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if ceremony == nil {
+		ceremony = &structs.WebAuthnCeremony{}
+	}
+	if ceremony.Purpose == "" {
+		ceremony.Purpose = WEBAUTHN_MFA
+	}
+	ceremony.UserID = user.ID
+	ceremony.Session = *session
+	v.SetWebAuthnCookie(ceremony, c)
+
+	return APIResult(c, fiber.StatusBadRequest, "Security key required!", fiber.Map{
+		"options": assertion,
+		"totp":    user.State.Read(constants.USER_IS_TOTP_ENABLED),
+	})
+}
+
+func (v *API) WebAuthnRegisterBeginEndpoint(c *fiber.Ctx) error {
+
+	// Require a session
+	if !v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	claims := v.Auth.GetNormalClaims(c)
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	rp, err := v.relying_party()
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	wu, err := v.load_webauthn_user(user)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Prefer discoverable credentials so the key can also be used for passwordless login, and don't let the same
+	// authenticator be registered twice
+	creation, session, err := rp.BeginRegistration(wu,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		webauthn.WithExclusions(webauthn.Credentials(wu.credentials).CredentialDescriptors()),
+	)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	v.SetWebAuthnCookie(&structs.WebAuthnCeremony{Purpose: WEBAUTHN_REGISTER, UserID: user.ID, Session: *session}, c)
+
+	return APIResult(c, fiber.StatusOK, "OK", creation)
+}
+
+func (v *API) WebAuthnRegisterFinishEndpoint(c *fiber.Ctx) error {
+
+	// Require a session
+	if !v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	var args FinishWebAuthnRegistrationArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+	args.Name = strings.TrimSpace(args.Name)
+	if args.Name == "" {
+		args.Name = "Passkey"
+	}
+	if len([]rune(args.Name)) > WEBAUTHN_MAX_NAME_LENGTH {
+		return APIResult(c, fiber.StatusBadRequest, "Name is too long.", nil)
+	}
+
+	claims := v.Auth.GetNormalClaims(c)
+	ceremony, err := v.Auth.GetWebAuthnCeremony(c)
+	if err != nil || ceremony.Purpose != WEBAUTHN_REGISTER || ceremony.UserID != claims.ULID {
+		return APIResult(c, fiber.StatusBadRequest, "Registration expired, please try again.", nil)
+	}
+	v.ClearWebAuthnCookie(c)
+
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	rp, err := v.relying_party()
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	wu, err := v.load_webauthn_user(user)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(args.Credential))
+	if err != nil {
+		return APIResult(c, fiber.StatusBadRequest, "Invalid credential: "+err.Error(), nil)
+	}
+	credential, err := rp.CreateCredential(wu, ceremony.Session, parsed)
+	if err != nil {
+
+		// Log the event
+		common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_webauthn_registration_failure",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusBadRequest, "Invalid credential: "+err.Error(), nil)
+	}
+
+	// Credential IDs are unique, so the authenticator may not be registered to another account
+	if existing, err := v.DB.GetWebAuthnCredential(credential.ID); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	} else if existing != nil {
+		return APIResult(c, fiber.StatusConflict, "This security key is already registered.", nil)
+	}
+
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	record, err := v.DB.AddWebAuthnCredential(user.ID, args.Name, credential.ID, data, credential.Authenticator.SignCount)
+	if err != nil {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     user.ID,
+			EventID:    "user_webauthn_store_error",
+			Details:    err.Error(),
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil, event_id)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_webauthn_added",
+		Details:    "Added " + record.Name,
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", &WebAuthnCredentialInfo{ID: record.ID, Name: record.Name, CreatedAt: record.CreatedAt})
+}
+
+func (v *API) WebAuthnCredentialsEndpoint(c *fiber.Ctx) error {
+
+	// Require a session
+	if !v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	claims := v.Auth.GetNormalClaims(c)
+	records, err := v.DB.GetWebAuthnCredentials(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	credentials := make([]*WebAuthnCredentialInfo, len(records))
+	for i, record := range records {
+		credentials[i] = &WebAuthnCredentialInfo{
+			ID:         record.ID,
+			Name:       record.Name,
+			CreatedAt:  record.CreatedAt,
+			LastUsedAt: record.LastUsedAt,
+		}
+	}
+
+	return APIResult(c, fiber.StatusOK, "OK", credentials)
+}
+
+func (v *API) DeleteWebAuthnCredentialEndpoint(c *fiber.Ctx) error {
+
+	// Require a session
+	if !v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusUnauthorized, "Not logged in!", nil)
+	}
+
+	var args DeleteWebAuthnCredentialArgs
+	if err := c.BodyParser(&args); err != nil {
+		return APIResult(c, fiber.StatusBadRequest, err.Error(), nil)
+	}
+	if args.ID == "" {
+		return APIResult(c, fiber.StatusBadRequest, "Missing ID.", nil)
+	}
+
+	claims := v.Auth.GetNormalClaims(c)
+	user, err := v.DB.GetUser(claims.ULID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	deleted, err := v.DB.DeleteWebAuthnCredential(user.ID, args.ID)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if !deleted {
+		return APIResult(c, fiber.StatusNotFound, "Security key not found.", nil)
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     user.ID,
+		EventID:    "user_webauthn_removed",
+		Details:    "Removed credential " + args.ID,
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
+
+// Starts a passwordless login. The browser lets the user pick any passkey they have for this server.
+func (v *API) WebAuthnLoginBeginEndpoint(c *fiber.Ctx) error {
+
+	// Check if the user is already logged in. If so, tell them
+	if v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusBadRequest, "Already logged in!", nil)
+	}
+
+	rp, err := v.relying_party()
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// The passkey replaces both the password and the second factor, so user verification (PIN or biometrics) is required
+	assertion, session, err := rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	v.SetWebAuthnCookie(&structs.WebAuthnCeremony{Purpose: WEBAUTHN_LOGIN, Session: *session}, c)
+
+	return APIResult(c, fiber.StatusOK, "OK", assertion)
+}
+
+// Completes a passwordless login or the security key step of a login, depending on how the ceremony was started.
+// The request body is the PublicKeyCredential returned by navigator.credentials.get().
+func (v *API) WebAuthnLoginFinishEndpoint(c *fiber.Ctx) error {
+	ceremony, err := v.Auth.GetWebAuthnCeremony(c)
+	if err != nil || (ceremony.Purpose != WEBAUTHN_LOGIN && ceremony.Purpose != WEBAUTHN_MFA && ceremony.Purpose != WEBAUTHN_REAUTH) {
+		return APIResult(c, fiber.StatusBadRequest, "Login expired, please try again.", nil)
+	}
+
+	// Check if the user is already logged in. If so, tell them, unless they're re-authenticating
+	if ceremony.Purpose != WEBAUTHN_REAUTH && v.Auth.ValidFromNormal(c) {
+		return APIResult(c, fiber.StatusBadRequest, "Already logged in!", nil)
+	}
+	v.ClearWebAuthnCookie(c)
+
+	rp, err := v.relying_party()
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(c.Body()))
+	if err != nil {
+		return APIResult(c, fiber.StatusBadRequest, "Invalid credential: "+err.Error(), nil)
+	}
+
+	var wu *webauthn_user
+	var credential *webauthn.Credential
+	if ceremony.Purpose != WEBAUTHN_LOGIN {
+		user, err := v.DB.GetUser(ceremony.UserID)
+		if err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+		if user == nil {
+			return APIResult(c, fiber.StatusBadRequest, "Login expired, please try again.", nil)
+		}
+		if wu, err = v.load_webauthn_user(user); err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+		}
+		credential, err = rp.ValidateLogin(wu, ceremony.Session, parsed)
+	} else {
+
+		// The user handle returned by the authenticator is the user's ID
+		var found webauthn.User
+		found, credential, err = rp.ValidatePasskeyLogin(func(_, user_handle []byte) (webauthn.User, error) {
+			user, err := v.DB.GetUser(string(user_handle))
+			if err != nil {
+				return nil, err
+			}
+			if user == nil {
+				return nil, errors.New("unknown user")
+			}
+			return v.load_webauthn_user(user)
+		}, ceremony.Session, parsed)
+		if found != nil {
+			wu = found.(*webauthn_user)
+		}
+	}
+	if err != nil {
+		if wu != nil {
+
+			// Log the event
+			common.LogEvent(v.DB.DB, &types.UserEvent{
+				UserID:     wu.user.ID,
+				EventID:    "user_webauthn_failure",
+				Details:    err.Error(),
+				Successful: false,
+			})
+		}
+		return APIResult(c, fiber.StatusUnauthorized, "Security key not recognized.", nil)
+	}
+
+	// A counter that went backwards means the authenticator may have been cloned, so refuse it
+	record := wu.record(credential)
+	if credential.Authenticator.CloneWarning {
+
+		// Log the event
+		event_id := common.LogEvent(v.DB.DB, &types.UserEvent{
+			UserID:     wu.user.ID,
+			EventID:    "user_webauthn_clone_warning",
+			Details:    "Signature counter of " + record.Name + " did not increase",
+			Successful: false,
+		})
+
+		return APIResult(c, fiber.StatusUnauthorized, "This security key may have been cloned. Please use another way to log in and remove it from your account.", nil, event_id)
+	}
+
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+	if err := v.DB.UpdateWebAuthnCredential(record, data, credential.Authenticator.SignCount); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	// Blocked and banned accounts can't be logged into
+	if database.UserBlocked(wu.user) {
+		return APIResult(c, fiber.StatusForbidden, "This account has been disabled.", nil)
+	}
+
+	// The password, if the user has one, was checked before the key was asked for
+	if ceremony.Purpose == WEBAUTHN_REAUTH {
+		amr := []string{structs.AMR_HARDWARE_KEY}
+		if !wu.user.State.Read(constants.USER_IS_OAUTH_ONLY) {
+			amr = []string{structs.AMR_PASSWORD, structs.AMR_HARDWARE_KEY}
+		}
+		return v.finish_reauth(c, wu.user, amr)
+	}
+
+	// Magic links can only be used once
+	if ceremony.MagicLinkID != "" {
+		if used, err := v.DB.UseMagicLink(&database.MagicLink{ID: ceremony.MagicLinkID}); err != nil {
+			return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+		} else if !used {
+			return APIResult(c, fiber.StatusUnauthorized, "This sign-in link is invalid or has expired.", nil)
+		}
+	}
+
+	// Create a new session, recording the provider if the first factor was an OAuth sign-in
+	identity_provider := "local"
+	amr := []string{structs.AMR_HARDWARE_KEY}
+	if ceremony.Provider != "" {
+		identity_provider = ceremony.Provider
+		amr = []string{first_factor(identity_provider), structs.AMR_HARDWARE_KEY, structs.AMR_MFA}
+		v.ClearMFACookie(c)
+	} else if ceremony.MagicLinkID != "" {
+		amr = []string{structs.AMR_EMAIL, structs.AMR_HARDWARE_KEY, structs.AMR_MFA}
+	}
+	if err := v.create_session(c, wu.user, identity_provider, amr, time.Now().Add(24*time.Hour)); err != nil {
+		return APIResult(c, fiber.StatusInternalServerError, err.Error(), nil)
+	}
+
+	details := "Logged in using a passkey"
+	if ceremony.Provider != "" {
+		details = "Logged in using " + ceremony.Provider + " provider with a security key as second factor"
+	} else if ceremony.Purpose == WEBAUTHN_MFA {
+		details = "Logged in using a security key as second factor"
+	}
+
+	// Log the event
+	common.LogEvent(v.DB.DB, &types.UserEvent{
+		UserID:     wu.user.ID,
+		EventID:    "user_login",
+		Details:    details,
+		Successful: true,
+	})
+
+	return APIResult(c, fiber.StatusOK, "OK", nil)
+}
@@ -0,0 +1,448 @@
+package v1
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-omega/accounts/pkg/database"
+	"github.com/cloudlink-omega/storage/pkg/types"
+	scrypt "github.com/elithrar/simple-scrypt"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/oklog/ulid/v2"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	TEST_SERVER_URL = "https://accounts.example.com"
+	TEST_RP_ID      = "accounts.example.com"
+	TEST_PASSWORD   = "correct horse battery staple"
+)
+
+// Authenticator flags, as set in authenticator data.
+const (
+	FLAG_USER_PRESENT  = 0x01
+	FLAG_USER_VERIFIED = 0x04
+	FLAG_ATTESTED_DATA = 0x40
+)
+
+// A software authenticator holding a single P-256 credential. Its signature counter is set by each test, so that
+// counters can be made to go backwards.
+type test_authenticator struct {
+	key        *ecdsa.PrivateKey
+	id         []byte
+	user       []byte
+	sign_count uint32
+}
+
+// A client for the API, keeping cookies between requests like a browser would.
+type test_client struct {
+	t       *testing.T
+	app     *fiber.App
+	cookies map[string]string
+}
+
+type test_result struct {
+	Status int
+	Result string          `json:"result"`
+	Data   json.RawMessage `json:"data"`
+}
+
+func new_test_authenticator(t *testing.T) *test_authenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 32)
+	rand.Read(id)
+	return &test_authenticator{key: key, id: id}
+}
+
+// Creates an API backed by an in-memory database, mounted at /api/v1.
+func new_test_api(t *testing.T) (*API, *fiber.App) {
+	db, err := gorm.Open(sqlite.Open("file:"+ulid.Make().String()+"?mode=memory&cache=shared"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&types.User{}, &types.UserSession{}, &types.UserTOTP{}, &types.RecoveryCode{}, &types.Verification{}); err != nil {
+		t.Fatal(err)
+	}
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	accounts_db := &database.Database{DB: db, ServerSecret: base64.StdEncoding.EncodeToString(secret), Cache: &types.DBCache{}}
+	if err := accounts_db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := New("/api/v1", true, TEST_RP_ID, TEST_SERVER_URL, accounts_db.ServerSecret, accounts_db, nil, nil, "Test", true)
+	app := fiber.New()
+	app.Route("/api/v1", api.Routes)
+	return api, app
+}
+
+// Creates a user who logs in with TEST_PASSWORD.
+func new_test_user(t *testing.T, api *API) *types.User {
+	hash, err := scrypt.GenerateFromPassword([]byte(TEST_PASSWORD), scrypt.DefaultParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := api.DB.CreateUserSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := ulid.Make().String()
+	user := &types.User{
+		ID:       id,
+		Username: "user" + strings.ToLower(id[len(id)-6:]),
+		Email:    strings.ToLower(id) + "@example.com",
+		Password: string(hash),
+		Secret:   secret,
+	}
+	if err := api.DB.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func new_test_client(t *testing.T, app *fiber.App) *test_client {
+	return &test_client{t: t, app: app, cookies: make(map[string]string)}
+}
+
+// Sends a request with a JSON body (if any), and decodes the APIResult it responds with.
+func (c *test_client) do(method string, path string, body any) *test_result {
+	c.t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, TEST_SERVER_URL+path, reader)
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	for name, value := range c.cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	resp, err := c.app.Test(req, -1)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Value == "" || (!cookie.Expires.IsZero() && cookie.Expires.Before(time.Now())) {
+			delete(c.cookies, cookie.Name)
+		} else {
+			c.cookies[cookie.Name] = cookie.Value
+		}
+	}
+
+	result := &test_result{Status: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		c.t.Fatalf("%s %s: failed to decode response: %s", method, path, err)
+	}
+	return result
+}
+
+// Fails the test unless the response has the expected status.
+func (r *test_result) expect(t *testing.T, status int) *test_result {
+	t.Helper()
+	if r.Status != status {
+		t.Fatalf("expected status %d, got %d: %s", status, r.Status, r.Result)
+	}
+	return r
+}
+
+func (c *test_client) logged_in() bool {
+	return c.do(fiber.MethodGet, "/api/v1/validate", nil).Status == fiber.StatusOK
+}
+
+// Logs in with a password, for a user without a second factor.
+func (c *test_client) login(user *types.User) {
+	c.t.Helper()
+	c.do(fiber.MethodPost, "/api/v1/login", fiber.Map{"email": user.Email, "password": TEST_PASSWORD}).expect(c.t, fiber.StatusOK)
+}
+
+// Registers the authenticator to the logged in user.
+func (c *test_client) register(a *test_authenticator) {
+	c.t.Helper()
+	begin := c.do(fiber.MethodPost, "/api/v1/webauthn/register/begin", nil).expect(c.t, fiber.StatusOK)
+	var creation protocol.CredentialCreation
+	if err := json.Unmarshal(begin.Data, &creation); err != nil {
+		c.t.Fatal(err)
+	}
+	c.do(fiber.MethodPost, "/api/v1/webauthn/register/finish", fiber.Map{
+		"name":       "Test key",
+		"credential": a.create(c.t, creation.Response.Challenge),
+	}).expect(c.t, fiber.StatusOK)
+}
+
+// Responds to an assertion with the authenticator, using the options returned when the ceremony began.
+func (c *test_client) assert(a *test_authenticator, options json.RawMessage) *test_result {
+	c.t.Helper()
+	var assertion protocol.CredentialAssertion
+	if err := json.Unmarshal(options, &assertion); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.do(fiber.MethodPost, "/api/v1/webauthn/login/finish", a.get(c.t, assertion.Response.Challenge))
+}
+
+// Reads the assertion options from the response of an endpoint that asked for a security key.
+func security_key_options(t *testing.T, r *test_result) json.RawMessage {
+	t.Helper()
+	r.expect(t, fiber.StatusBadRequest)
+	var data struct {
+		Options json.RawMessage `json:"options"`
+	}
+	if err := json.Unmarshal(r.Data, &data); err != nil || data.Options == nil {
+		t.Fatalf("expected a security key to be asked for, got %q", r.Result)
+	}
+	return data.Options
+}
+
+// Builds the response to navigator.credentials.create(), with "none" attestation.
+func (a *test_authenticator) create(t *testing.T, challenge protocol.URLEncodedBase64) map[string]any {
+	client_data := a.client_data(t, protocol.CreateCeremony, challenge)
+
+	public_key, err := webauthncbor.Marshal(&webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth_data := a.auth_data(FLAG_USER_PRESENT | FLAG_USER_VERIFIED | FLAG_ATTESTED_DATA)
+	auth_data = append(auth_data, make([]byte, 16)...) // AAGUID
+	auth_data = binary.BigEndian.AppendUint16(auth_data, uint16(len(a.id)))
+	auth_data = append(auth_data, a.id...)
+	auth_data = append(auth_data, public_key...)
+
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": auth_data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]any{
+		"id":    encode(a.id),
+		"rawId": encode(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    encode(client_data),
+			"attestationObject": encode(attestation),
+		},
+	}
+}
+
+// Builds the response to navigator.credentials.get(), signed with the current counter.
+func (a *test_authenticator) get(t *testing.T, challenge protocol.URLEncodedBase64) map[string]any {
+	client_data := a.client_data(t, protocol.AssertCeremony, challenge)
+	auth_data := a.auth_data(FLAG_USER_PRESENT | FLAG_USER_VERIFIED)
+
+	client_data_hash := sha256.Sum256(client_data)
+	digest := sha256.Sum256(append(append([]byte{}, auth_data...), client_data_hash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]any{
+		"id":    encode(a.id),
+		"rawId": encode(a.id),
+		"type":  "public-key",
+		"response": map[string]any{
+			"clientDataJSON":    encode(client_data),
+			"authenticatorData": encode(auth_data),
+			"signature":         encode(signature),
+			"userHandle":        encode(a.user),
+		},
+	}
+}
+
+func (a *test_authenticator) client_data(t *testing.T, ceremony protocol.CeremonyType, challenge protocol.URLEncodedBase64) []byte {
+	client_data, err := json.Marshal(fiber.Map{
+		"type":      ceremony,
+		"challenge": encode(challenge),
+		"origin":    TEST_SERVER_URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client_data
+}
+
+// The start of authenticator data: the relying party ID hash, flags and signature counter.
+func (a *test_authenticator) auth_data(flags byte) []byte {
+	rp_id_hash := sha256.Sum256([]byte(TEST_RP_ID))
+	auth_data := append(rp_id_hash[:], flags)
+	return binary.BigEndian.AppendUint32(auth_data, a.sign_count)
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Sets up a user with the authenticator registered as a passkey, and logs them out again.
+func setup_passkey(t *testing.T) (*API, *fiber.App, *types.User, *test_authenticator) {
+	api, app := new_test_api(t)
+	user := new_test_user(t, api)
+	authenticator := new_test_authenticator(t)
+	authenticator.user = []byte(user.ID)
+
+	client := new_test_client(t, app)
+	client.login(user)
+	client.register(authenticator)
+
+	if records, err := api.DB.GetWebAuthnCredentials(user.ID); err != nil {
+		t.Fatal(err)
+	} else if len(records) != 1 || records[0].CredentialHash != database.WebAuthnCredentialHash(authenticator.id) {
+		t.Fatalf("expected the passkey to be stored, got %d credential(s)", len(records))
+	}
+	return api, app, user, authenticator
+}
+
+func TestWebAuthnPasskeyLogin(t *testing.T) {
+	api, app, user, authenticator := setup_passkey(t)
+
+	client := new_test_client(t, app)
+	begin := client.do(fiber.MethodPost, "/api/v1/webauthn/login/begin", nil).expect(t, fiber.StatusOK)
+	authenticator.sign_count = 1
+	client.assert(authenticator, begin.Data).expect(t, fiber.StatusOK)
+	if !client.logged_in() {
+		t.Fatal("expected to be logged in with the passkey")
+	}
+
+	records, err := api.DB.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].SignCount != 1 || records[0].LastUsedAt == nil {
+		t.Fatalf("expected the counter and last use to be recorded, got %d", records[0].SignCount)
+	}
+}
+
+func TestWebAuthnRejectsOtherKeys(t *testing.T) {
+	_, app, user, _ := setup_passkey(t)
+
+	// A key that claims to be the user's, but was never registered
+	impostor := new_test_authenticator(t)
+	impostor.user = []byte(user.ID)
+
+	client := new_test_client(t, app)
+	begin := client.do(fiber.MethodPost, "/api/v1/webauthn/login/begin", nil).expect(t, fiber.StatusOK)
+	client.assert(impostor, begin.Data).expect(t, fiber.StatusUnauthorized)
+	if client.logged_in() {
+		t.Fatal("expected an unregistered key to be refused")
+	}
+}
+
+func TestWebAuthnSignCountRegression(t *testing.T) {
+	api, app, user, authenticator := setup_passkey(t)
+
+	client := new_test_client(t, app)
+	begin := client.do(fiber.MethodPost, "/api/v1/webauthn/login/begin", nil).expect(t, fiber.StatusOK)
+	authenticator.sign_count = 5
+	client.assert(authenticator, begin.Data).expect(t, fiber.StatusOK)
+
+	// A clone of the key would sign with a counter that isn't ahead of the one last seen
+	for _, sign_count := range []uint32{3, 5} {
+		clone := new_test_client(t, app)
+		begin = clone.do(fiber.MethodPost, "/api/v1/webauthn/login/begin", nil).expect(t, fiber.StatusOK)
+		authenticator.sign_count = sign_count
+		result := clone.assert(authenticator, begin.Data).expect(t, fiber.StatusUnauthorized)
+		if !strings.Contains(result.Result, "cloned") {
+			t.Fatalf("expected a clone warning for counter %d, got %q", sign_count, result.Result)
+		}
+		if clone.logged_in() {
+			t.Fatalf("expected counter %d to be refused", sign_count)
+		}
+	}
+
+	// The stored counter isn't moved back by the refused assertions
+	records, err := api.DB.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].SignCount != 5 {
+		t.Fatalf("expected the counter to stay at 5, got %d", records[0].SignCount)
+	}
+}
+
+func TestWebAuthnSecondFactorAfterPassword(t *testing.T) {
+	_, app, user, authenticator := setup_passkey(t)
+
+	// The password alone only gets an mfa_token
+	client := new_test_client(t, app)
+	login := client.do(fiber.MethodPost, "/api/v1/login", fiber.Map{"email": user.Email, "password": TEST_PASSWORD}).expect(t, fiber.StatusBadRequest)
+	var pending struct {
+		MFAToken string   `json:"mfa_token"`
+		Factors  []string `json:"factors"`
+	}
+	if err := json.Unmarshal(login.Data, &pending); err != nil || pending.MFAToken == "" {
+		t.Fatalf("expected an mfa_token, got %q", login.Result)
+	}
+	if len(pending.Factors) != 1 || pending.Factors[0] != "webauthn" {
+		t.Fatalf("expected only a security key to be offered, got %v", pending.Factors)
+	}
+	if client.logged_in() {
+		t.Fatal("expected the password alone not to log in")
+	}
+
+	// Which asks for the security key
+	options := security_key_options(t, client.do(fiber.MethodPost, "/api/v1/mfa", fiber.Map{"mfa_token": pending.MFAToken}))
+	authenticator.sign_count = 1
+	client.assert(authenticator, options).expect(t, fiber.StatusOK)
+	if !client.logged_in() {
+		t.Fatal("expected to be logged in after the security key")
+	}
+}
+
+func TestWebAuthnSecondFactorAfterMagicLink(t *testing.T) {
+	api, app, user, authenticator := setup_passkey(t)
+	if _, err := api.DB.CreateMagicLink(user.ID, "123456", time.Now().Add(MAGIC_LINK_LIFETIME)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link's code replaces the password, but not the security key
+	client := new_test_client(t, app)
+	options := security_key_options(t, client.do(fiber.MethodPost, "/api/v1/magic-link/confirm", fiber.Map{"email": user.Email, "code": "123456"}))
+	if client.logged_in() {
+		t.Fatal("expected the magic link alone not to log in")
+	}
+	authenticator.sign_count = 1
+	client.assert(authenticator, options).expect(t, fiber.StatusOK)
+	if !client.logged_in() {
+		t.Fatal("expected to be logged in after the security key")
+	}
+
+	// The link was used up by the login
+	other := new_test_client(t, app)
+	other.do(fiber.MethodPost, "/api/v1/magic-link/confirm", fiber.Map{"email": user.Email, "code": "123456"}).expect(t, fiber.StatusUnauthorized)
+}